@@ -0,0 +1,48 @@
+package client
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/segmentio/kafka-go"
+
+	"github.com/zlyuancn/order/conf"
+)
+
+var (
+	kafkaWriter     *kafka.Writer
+	kafkaWriterOnce sync.Once
+)
+
+// 获取kafka生产者, 消息会按key分配到分区
+func GetKafkaWriter() *kafka.Writer {
+	kafkaWriterOnce.Do(func() {
+		kafkaWriter = &kafka.Writer{
+			Addr:         kafka.TCP(GetKafkaBrokers()...),
+			Topic:        conf.Conf.KafkaTopic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+		}
+	})
+	return kafkaWriter
+}
+
+// 关闭kafka生产者
+func CloseKafkaWriter() error {
+	if kafkaWriter == nil {
+		return nil
+	}
+	return kafkaWriter.Close()
+}
+
+// 获取kafka地址列表
+func GetKafkaBrokers() []string {
+	var brokers []string
+	for _, addr := range strings.Split(conf.Conf.KafkaAddress, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr != "" {
+			brokers = append(brokers, addr)
+		}
+	}
+	return brokers
+}
@@ -18,16 +18,87 @@ const (
 	defOrderUnlockDBLimitProcessTime = 10
 	defOrderLockKeyFormat            = "order:lock:op:<order_id>"
 	defOrderSeqNoKeyFormat           = "order:seqno:<order_type>:<shard_num>"
+	defLockType                      = LockType_Redis
+	defOrderLockWaitTime             = 0
+	defMySQLLockMaxConns             = 10
+	defOIDGeneratorType              = OIDGeneratorType_Redis
+	defOIDWorkerID                   = -1
+	defOIDSegmentSize                = 1
+	defOIDSegmentPrefetchPercent     = 20
+	defOrderCodeSecret               = ""
+
+	defForwardMaxAttempts = 0
+	defForwardMaxAge      = 0
 
 	defMQType                = MQType_Pulsar
 	defMQProducerName        = "order"
 	defAllowMqCompensation   = false
 	defCompensationDelayTime = 20
 	defMQConsumeName         = "order"
+
+	defKafkaTopic              = "order_compensation"
+	defKafkaConsumeGroup       = "order"
+	defKafkaConsumeThreadCount = 1
+
+	defRedisMQDelayKey           = "order:mq:{compensation}:delay"
+	defRedisMQStreamKey          = "order:mq:{compensation}:stream"
+	defRedisMQConsumeGroup       = "order"
+	defRedisMQConsumeThreadCount = 1
+
+	defCompensationMQMsgLifeTime = 3600
+	defMQMsgOmitUid              = false
+
+	defAllowOutbox          = false
+	defOutboxRelayInterval  = 1
+	defOutboxRelayBatchSize = 100
+	defOutboxLockKeyFormat  = "order:lock:outbox:<shard_num>"
+
+	defAllowDBScanCompensation = false
+	defDBScanInterval          = 60
+	defDBScanBatchSize         = 100
+	defDBScanConcurrency       = 10
+	defDBScanLockKeyFormat     = "order:lock:scan:<shard_num>"
+
+	defAllowThirdPayOIDMapping = false
+
+	defAllowAutoClose         = false
+	defAutoCloseInterval      = 60
+	defAutoCloseBatchSize     = 100
+	defAutoCloseLockKeyFormat = "order:lock:close:<shard_num>"
+
+	defTableVersion             = ""
+	defMigrateTableShardNums    = 0
+	defMigrateTableVersion      = ""
+	defMigrateStage             = ""
+	defLegacyShardNums          = 0
+	defMigrateCopyBatchSize     = 100
+	defMigrateCopyLockKeyFormat = "order:lock:migrate:<shard_num>"
+)
+
+const (
+	LockType_Redis = "redis"
+	LockType_MySQL = "mysql"
+	LockType_Local = "local"
+)
+
+const (
+	OIDGeneratorType_Redis     = "redis"
+	OIDGeneratorType_Snowflake = "snowflake"
+)
+
+// snowflake生成器的最大实例id
+const OIDMaxWorkerID = 1023
+
+const (
+	MigrateStage_DualWrite = "dual_write"
+	MigrateStage_Copy      = "copy"
+	MigrateStage_Cutover   = "cutover"
 )
 
 const (
 	MQType_Pulsar = "pulsar"
+	MQType_Kafka  = "kafka"
+	MQType_Redis  = "redis"
 )
 
 var Conf = Config{
@@ -39,12 +110,61 @@ var Conf = Config{
 	OrderUnlockDBLimitProcessTime: defOrderUnlockDBLimitProcessTime,
 	OrderLockKeyFormat:            defOrderLockKeyFormat,
 	OrderSeqNoKeyFormat:           defOrderSeqNoKeyFormat,
+	LockType:                      defLockType,
+	OrderLockWaitTime:             defOrderLockWaitTime,
+	MySQLLockMaxConns:             defMySQLLockMaxConns,
+	OIDGeneratorType:              defOIDGeneratorType,
+	OIDWorkerID:                   defOIDWorkerID,
+	OIDSegmentSize:                defOIDSegmentSize,
+	OIDSegmentPrefetchPercent:     defOIDSegmentPrefetchPercent,
+	OrderCodeSecret:               defOrderCodeSecret,
+
+	ForwardMaxAttempts: defForwardMaxAttempts,
+	ForwardMaxAge:      defForwardMaxAge,
 
 	MQType:                defMQType,
 	MQProducerName:        defMQProducerName,
 	AllowMqCompensation:   defAllowMqCompensation,
 	CompensationDelayTime: defCompensationDelayTime,
 	MQConsumeName:         defMQConsumeName,
+
+	KafkaTopic:              defKafkaTopic,
+	KafkaConsumeGroup:       defKafkaConsumeGroup,
+	KafkaConsumeThreadCount: defKafkaConsumeThreadCount,
+
+	RedisMQDelayKey:           defRedisMQDelayKey,
+	RedisMQStreamKey:          defRedisMQStreamKey,
+	RedisMQConsumeGroup:       defRedisMQConsumeGroup,
+	RedisMQConsumeThreadCount: defRedisMQConsumeThreadCount,
+
+	CompensationMQMsgLifeTime: defCompensationMQMsgLifeTime,
+	MQMsgOmitUid:              defMQMsgOmitUid,
+
+	AllowOutbox:          defAllowOutbox,
+	OutboxRelayInterval:  defOutboxRelayInterval,
+	OutboxRelayBatchSize: defOutboxRelayBatchSize,
+	OutboxLockKeyFormat:  defOutboxLockKeyFormat,
+
+	AllowDBScanCompensation: defAllowDBScanCompensation,
+	DBScanInterval:          defDBScanInterval,
+	DBScanBatchSize:         defDBScanBatchSize,
+	DBScanConcurrency:       defDBScanConcurrency,
+	DBScanLockKeyFormat:     defDBScanLockKeyFormat,
+
+	AllowThirdPayOIDMapping: defAllowThirdPayOIDMapping,
+
+	AllowAutoClose:         defAllowAutoClose,
+	AutoCloseInterval:      defAutoCloseInterval,
+	AutoCloseBatchSize:     defAutoCloseBatchSize,
+	AutoCloseLockKeyFormat: defAutoCloseLockKeyFormat,
+
+	TableVersion:             defTableVersion,
+	MigrateTableShardNums:    defMigrateTableShardNums,
+	MigrateTableVersion:      defMigrateTableVersion,
+	MigrateStage:             defMigrateStage,
+	LegacyShardNums:          defLegacyShardNums,
+	MigrateCopyBatchSize:     defMigrateCopyBatchSize,
+	MigrateCopyLockKeyFormat: defMigrateCopyLockKeyFormat,
 }
 
 type Config struct {
@@ -52,16 +172,66 @@ type Config struct {
 	TableShardNums uint32 // 表分片数量
 
 	RedisName                     string // redis组件名
-	OrderLockDBExpire             int    // 订单锁有效时间, 单位秒
-	OrderUnlockDBLimitProcessTime int    // 订单处理在多少时间内完成才会主动解锁, 单位秒
+	OrderLockDBExpire             int    // 订单锁有效时间, 单位秒. 订单处理未完成时会自动续期
+	OrderUnlockDBLimitProcessTime int    // 已废弃, 锁使用持有者token解锁, 不会误删其它持有者的锁
 	OrderLockKeyFormat            string // 订单锁key格式化字符串
 	OrderSeqNoKeyFormat           string // 生成订单序列号key格式化字符串
+	LockType                      string // 锁类型. 支持 redis, mysql(使用 SqlxName 的sqlx组件, 每个持有中的锁会占用一个连接直到解锁, sqlx组件的最大连接数需要大于 MySQLLockMaxConns, 扫表使用的租约记录在 order_lease 表中, 不占用连接), local(进程内锁, 仅用于单实例部署)
+	OrderLockWaitTime             int    // 订单锁被占用时最多等待多少时间, 0表示不等待. 可以通过 order_model.WithLockWait 为单次调用设置. 单位毫秒
+	MySQLLockMaxConns             int    // mysql锁最多同时占用的连接数, 达到上限后加锁会返回错误, 避免锁占满sqlx连接池导致订单读写阻塞
+	OIDGeneratorType              string // 订单号生成器类型. 支持 redis(redis自增序列号), snowflake(不依赖redis, 需要为每个实例配置不同的 OIDWorkerID), 也可以是通过 RegistryOIDGenerator 注册的生成器名
+	OIDWorkerID                   int    // snowflake生成器的实例id, 范围为0-1023, 同时运行的实例不能重复. 使用snowflake生成器时必须配置, -1表示未配置
+	OIDSegmentSize                int64  // redis生成器每次从redis预留的序列号数量, 在进程内存中分配, 1表示每个订单都访问redis
+	OIDSegmentPrefetchPercent     int    // redis生成器当前号段剩余数量低于号段大小的这个百分比时在后台预取下一个号段, 范围为0-100
+	OrderCodeSecret               string // 客户订单号编码密钥, 为空表示不启用客户订单号. 修改后已发出的客户订单号无法解码
 
-	MQType                string // mq类型. 支持 pulsar
-	MQProducerName        string // mq生产者组件名
+	ForwardMaxAttempts int   // 订单在推进中状态下推进失败多少次后转为需要人工介入, 0表示不限制
+	ForwardMaxAge      int64 // 订单创建多少时间后推进失败会转为需要人工介入, 0表示不限制, 单位秒
+
+	MQType                string // mq类型. 支持 pulsar, kafka, redis
+	MQProducerName        string // mq生产者组件名, MQType为pulsar时有效
 	AllowMqCompensation   bool   // 是否允许mq补偿, 如果为false, 将不会启动mq补偿消费进程, 代码中的提交mq补偿会报错, 且不会启动mq补偿消费者
 	CompensationDelayTime int64  // mq补偿延迟时间, 单位秒
-	MQConsumeName         string // mq消费者组件名
+	MQConsumeName         string // mq消费者组件名, MQType为pulsar时有效
+
+	KafkaAddress            string // kafka地址, 多个地址用英文逗号连接, MQType为kafka时有效
+	KafkaTopic              string // kafka补偿topic
+	KafkaConsumeGroup       string // kafka补偿消费组
+	KafkaConsumeThreadCount int    // kafka补偿消费者数量
+
+	RedisMQDelayKey           string // redis补偿延迟队列key, 使用 RedisName 的redis组件, MQType为redis时有效
+	RedisMQStreamKey          string // redis补偿stream key, 集群模式下需要和延迟队列key在同一个slot
+	RedisMQConsumeGroup       string // redis补偿消费组
+	RedisMQConsumeThreadCount int    // redis补偿消费者数量
+
+	CompensationMQMsgLifeTime int64 // mq消息如果存活超过这个时间, 在失败后不会再重试了, 订单会转为需要人工介入. 单位秒, 0表示不限制
+	MQMsgOmitUid              bool  // 订单号能解析出分片时补偿mq消息中是否省略uid. 开启前需要确认所有消费者都支持从订单号中解析分片
+
+	AllowOutbox          bool   // 是否启用补偿信号发件箱, 启用后创建订单时补偿信号会和订单在同一个事务中写入发件箱表, 再由后台发送到mq. 需要开启 AllowMqCompensation
+	OutboxRelayInterval  int64  // 发件箱发送间隔, 单位秒
+	OutboxRelayBatchSize int    // 每次从发件箱表中查询的信号数
+	OutboxLockKeyFormat  string // 发件箱锁key格式化字符串, 同一个分表同时只会有一个实例在发送
+
+	AllowDBScanCompensation bool   // 是否允许扫表补偿, 会定时扫描各分表中更新时间早于 CompensationDelayTime 的推进中订单并推进, 等待外部支付的订单不会被推进, 不依赖mq
+	DBScanInterval          int64  // 扫表间隔, 单位秒
+	DBScanBatchSize         int    // 每次从分表中查询的订单数
+	DBScanConcurrency       int    // 扫表补偿推进订单的并发数
+	DBScanLockKeyFormat     string // 扫表锁key格式化字符串, 同一个分表同时只会有一个实例在扫描
+
+	AllowThirdPayOIDMapping bool // 是否启用第三方支付订单id映射表, 启用后创建订单时会在同一个事务中写入映射, 用于不知道uid时根据第三方支付订单id查询订单
+
+	AllowAutoClose         bool   // 是否自动关闭过期订单, 会定时扫描各分表中已过期且未支付的推进中订单并关闭, 混合支付中存在已支付的支付项时转为需要人工介入
+	AutoCloseInterval      int64  // 扫描过期订单间隔, 单位秒
+	AutoCloseBatchSize     int    // 每次从分表中查询的过期订单数
+	AutoCloseLockKeyFormat string // 关闭过期订单锁key格式化字符串, 同一个分表同时只会有一个实例在扫描
+
+	TableVersion             string // 分表版本, 不为空时分表名为 <表名><TableVersion>_<分片>, 如 order_v2_0. 扩容迁移完成后设为迁移的分表版本
+	MigrateTableShardNums    uint32 // 扩容迁移的新分表数量
+	MigrateTableVersion      string // 扩容迁移的新分表版本, 不能和 TableVersion 相同
+	MigrateStage             string // 扩容迁移阶段. 为空表示不迁移; dual_write 读写旧分表并同步写入新分表; copy 在 dual_write 基础上由后台复制存量数据; cutover 读写新分表并同步写入旧分表
+	MigrateCopyBatchSize     int    // 复制存量数据时每批复制的订单数
+	MigrateCopyLockKeyFormat string // 复制存量数据锁key格式化字符串, 同一个分表同时只会有一个实例在复制
+	LegacyShardNums          uint32 // 扩容迁移完成后配置为扩容前的分表数量, 不传uid的操作在订单号中的分片找不到订单时会扫描所有分表. 0表示不扫描, 扩容前生成的订单号不再使用后应该设为0
 }
 
 func (conf *Config) Check() {
@@ -87,13 +257,51 @@ func (conf *Config) Check() {
 	if conf.OrderSeqNoKeyFormat == "" {
 		conf.OrderSeqNoKeyFormat = defOrderSeqNoKeyFormat
 	}
+	if conf.LockType == "" {
+		conf.LockType = defLockType
+	}
+	conf.LockType = strings.ToLower(conf.LockType)
+	switch conf.LockType {
+	case LockType_Redis, LockType_MySQL, LockType_Local:
+	default:
+		logger.Log.Fatal("order config err. Unsupported LockType", zap.String("LockType", conf.LockType))
+	}
+	if conf.OrderLockWaitTime < 0 {
+		conf.OrderLockWaitTime = defOrderLockWaitTime
+	}
+	if conf.MySQLLockMaxConns < 1 {
+		conf.MySQLLockMaxConns = defMySQLLockMaxConns
+	}
+	if conf.OIDGeneratorType == "" {
+		conf.OIDGeneratorType = defOIDGeneratorType
+	}
+	conf.OIDGeneratorType = strings.ToLower(conf.OIDGeneratorType)
+	if conf.OIDSegmentSize < 1 {
+		conf.OIDSegmentSize = defOIDSegmentSize
+	}
+	if conf.OIDSegmentPrefetchPercent < 0 || conf.OIDSegmentPrefetchPercent > 100 {
+		conf.OIDSegmentPrefetchPercent = defOIDSegmentPrefetchPercent
+	}
+	if conf.OIDGeneratorType == OIDGeneratorType_Snowflake && conf.OIDWorkerID < 0 {
+		logger.Log.Fatal("order config err. OIDWorkerID must be set when OIDGeneratorType is snowflake")
+	}
+	if conf.OIDWorkerID > OIDMaxWorkerID {
+		logger.Log.Fatal("order config err. OIDWorkerID out of range", zap.Int("OIDWorkerID", conf.OIDWorkerID))
+	}
+
+	if conf.ForwardMaxAttempts < 0 {
+		conf.ForwardMaxAttempts = defForwardMaxAttempts
+	}
+	if conf.ForwardMaxAge < 0 {
+		conf.ForwardMaxAge = defForwardMaxAge
+	}
 
 	if conf.MQType == "" {
 		conf.MQType = defMQType
 	}
 	conf.MQType = strings.ToLower(conf.MQType)
 	switch conf.MQType {
-	case MQType_Pulsar:
+	case MQType_Pulsar, MQType_Kafka, MQType_Redis:
 	default:
 		logger.Log.Fatal("order config err. Unsupported MQType", zap.String("MQType", conf.MQType))
 	}
@@ -106,4 +314,88 @@ func (conf *Config) Check() {
 	if conf.MQConsumeName == "" {
 		conf.MQConsumeName = defMQConsumeName
 	}
+	if conf.MQType == MQType_Kafka && conf.AllowMqCompensation && conf.KafkaAddress == "" {
+		logger.Log.Fatal("order config err. KafkaAddress is empty")
+	}
+	if conf.KafkaTopic == "" {
+		conf.KafkaTopic = defKafkaTopic
+	}
+	if conf.KafkaConsumeGroup == "" {
+		conf.KafkaConsumeGroup = defKafkaConsumeGroup
+	}
+	if conf.KafkaConsumeThreadCount < 1 {
+		conf.KafkaConsumeThreadCount = defKafkaConsumeThreadCount
+	}
+	if conf.RedisMQDelayKey == "" {
+		conf.RedisMQDelayKey = defRedisMQDelayKey
+	}
+	if conf.RedisMQStreamKey == "" {
+		conf.RedisMQStreamKey = defRedisMQStreamKey
+	}
+	if conf.RedisMQConsumeGroup == "" {
+		conf.RedisMQConsumeGroup = defRedisMQConsumeGroup
+	}
+	if conf.RedisMQConsumeThreadCount < 1 {
+		conf.RedisMQConsumeThreadCount = defRedisMQConsumeThreadCount
+	}
+	if conf.CompensationMQMsgLifeTime < 0 {
+		conf.CompensationMQMsgLifeTime = defCompensationMQMsgLifeTime
+	}
+
+	if conf.AllowOutbox && !conf.AllowMqCompensation {
+		logger.Log.Fatal("order config err. AllowOutbox requires AllowMqCompensation")
+	}
+	if conf.OutboxRelayInterval < 1 {
+		conf.OutboxRelayInterval = defOutboxRelayInterval
+	}
+	if conf.OutboxRelayBatchSize < 1 {
+		conf.OutboxRelayBatchSize = defOutboxRelayBatchSize
+	}
+	if conf.OutboxLockKeyFormat == "" {
+		conf.OutboxLockKeyFormat = defOutboxLockKeyFormat
+	}
+
+	if conf.DBScanInterval < 1 {
+		conf.DBScanInterval = defDBScanInterval
+	}
+	if conf.DBScanBatchSize < 1 {
+		conf.DBScanBatchSize = defDBScanBatchSize
+	}
+	if conf.DBScanConcurrency < 1 {
+		conf.DBScanConcurrency = defDBScanConcurrency
+	}
+	if conf.DBScanLockKeyFormat == "" {
+		conf.DBScanLockKeyFormat = defDBScanLockKeyFormat
+	}
+
+	if conf.AutoCloseInterval < 1 {
+		conf.AutoCloseInterval = defAutoCloseInterval
+	}
+	if conf.AutoCloseBatchSize < 1 {
+		conf.AutoCloseBatchSize = defAutoCloseBatchSize
+	}
+	if conf.AutoCloseLockKeyFormat == "" {
+		conf.AutoCloseLockKeyFormat = defAutoCloseLockKeyFormat
+	}
+
+	conf.MigrateStage = strings.ToLower(conf.MigrateStage)
+	switch conf.MigrateStage {
+	case "":
+	case MigrateStage_DualWrite, MigrateStage_Copy, MigrateStage_Cutover:
+		if conf.MigrateTableShardNums < 1 {
+			logger.Log.Fatal("order config err. MigrateTableShardNums must be greater than 0")
+		}
+		if conf.MigrateTableVersion == conf.TableVersion {
+			logger.Log.Fatal("order config err. MigrateTableVersion must be different from TableVersion",
+				zap.String("MigrateTableVersion", conf.MigrateTableVersion))
+		}
+	default:
+		logger.Log.Fatal("order config err. Unsupported MigrateStage", zap.String("MigrateStage", conf.MigrateStage))
+	}
+	if conf.MigrateCopyBatchSize < 1 {
+		conf.MigrateCopyBatchSize = defMigrateCopyBatchSize
+	}
+	if conf.MigrateCopyLockKeyFormat == "" {
+		conf.MigrateCopyLockKeyFormat = defMigrateCopyLockKeyFormat
+	}
 }
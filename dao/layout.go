@@ -0,0 +1,98 @@
+package dao
+
+import (
+	"hash/crc32"
+
+	"github.com/spf13/cast"
+
+	"github.com/zlyuancn/order/conf"
+)
+
+/*
+分表布局
+
+扩容迁移期间同时存在当前布局(TableVersion/TableShardNums)和迁移布局(MigrateTableVersion/MigrateTableShardNums).
+读写都在主布局中进行, 订单变更会在同一个事务中同步写入镜像布局. cutover 阶段之前主布局为当前布局, 之后为迁移布局.
+*/
+type Layout struct {
+	Version   string // 分表版本
+	ShardNums uint32 // 分表数量
+}
+
+// 当前布局
+func CurrentLayout() Layout {
+	return Layout{Version: conf.Conf.TableVersion, ShardNums: conf.Conf.TableShardNums}
+}
+
+// 迁移布局, 不在扩容迁移时返回false
+func MigrateLayout() (Layout, bool) {
+	if conf.Conf.MigrateStage == "" {
+		return Layout{}, false
+	}
+	return Layout{Version: conf.Conf.MigrateTableVersion, ShardNums: conf.Conf.MigrateTableShardNums}, true
+}
+
+// 主布局, 订单的读写都在主布局中
+func PrimaryLayout() Layout {
+	if l, ok := MigrateLayout(); ok && conf.Conf.MigrateStage == conf.MigrateStage_Cutover {
+		return l
+	}
+	return CurrentLayout()
+}
+
+// 镜像布局, 扩容迁移期间订单变更会同步写入镜像布局, 不在扩容迁移时返回false
+func MirrorLayout() (Layout, bool) {
+	l, ok := MigrateLayout()
+	if !ok {
+		return Layout{}, false
+	}
+	if conf.Conf.MigrateStage == conf.MigrateStage_Cutover {
+		return CurrentLayout(), true
+	}
+	return l, true
+}
+
+// 是否在扩容迁移的切换窗口中, 为true时订单号中的分片可能是扩容前的分片. 扩容迁移完成后由 LegacyShardNums 决定
+func LayoutChanged() bool {
+	return conf.Conf.MigrateStage == conf.MigrateStage_Cutover || conf.Conf.LegacyShardNums > 0
+}
+
+// 主布局的分表数量
+func ShardNums() uint32 {
+	return PrimaryLayout().ShardNums
+}
+
+// 生成分片
+func (l Layout) GenShard(key string) string {
+	shardID := crc32.ChecksumIEEE([]byte(key)) % l.ShardNums
+	return cast.ToString(shardID)
+}
+
+// 分表名后缀, 分表名为 <表名><后缀>
+func (l Layout) TableSuffix(shard string) string {
+	if l.Version == "" {
+		return shard
+	}
+	return l.Version + "_" + shard
+}
+
+// 根据分片获取实例, 用于跨用户的查询, 不会同步写入镜像布局
+func (l Layout) DaoByShard(shard string) RPC {
+	return l.newImpl(shard, "")
+}
+
+func (l Layout) newImpl(shard, uid string) *impl {
+	suffix := l.TableSuffix(shard)
+	return &impl{
+		layout:        l,
+		tabName:       TableName + suffix,
+		logTabName:    LogTableName + suffix,
+		outboxTabName: OutboxTableName + suffix,
+		uid:           uid,
+	}
+}
+
+// 第三方支付订单id映射表按第三方支付订单id分表
+func (l Layout) thirdPayOIDTabName(thirdPayOid string) string {
+	return ThirdPayOIDTableName + l.TableSuffix(l.GenShard(thirdPayOid))
+}
@@ -0,0 +1,105 @@
+package dao
+
+import (
+	"testing"
+
+	"github.com/zlyuancn/order/conf"
+)
+
+// 设置分表布局配置, 返回恢复函数
+func setLayoutConf(stage string, legacyShardNums uint32) func() {
+	old := conf.Conf
+	conf.Conf.TableShardNums = 2
+	conf.Conf.TableVersion = ""
+	conf.Conf.MigrateTableShardNums = 8
+	conf.Conf.MigrateTableVersion = "v2"
+	conf.Conf.MigrateStage = stage
+	conf.Conf.LegacyShardNums = legacyShardNums
+	return func() { conf.Conf = old }
+}
+
+func TestLayoutByMigrateStage(t *testing.T) {
+	cur := Layout{Version: "", ShardNums: 2}
+	dst := Layout{Version: "v2", ShardNums: 8}
+
+	tests := []struct {
+		stage         string
+		primary       Layout
+		mirror        Layout
+		migrating     bool
+		layoutChanged bool
+	}{
+		{"", cur, Layout{}, false, false},
+		{conf.MigrateStage_DualWrite, cur, dst, true, false},
+		{conf.MigrateStage_Copy, cur, dst, true, false},
+		{conf.MigrateStage_Cutover, dst, cur, true, true},
+	}
+	for _, tt := range tests {
+		t.Run("stage="+tt.stage, func(t *testing.T) {
+			defer setLayoutConf(tt.stage, 0)()
+
+			if got := CurrentLayout(); got != cur {
+				t.Errorf("CurrentLayout() = %+v, want %+v", got, cur)
+			}
+			migrate, ok := MigrateLayout()
+			if ok != tt.migrating || ok && migrate != dst {
+				t.Errorf("MigrateLayout() = %+v, %v, want %+v, %v", migrate, ok, dst, tt.migrating)
+			}
+			if got := PrimaryLayout(); got != tt.primary {
+				t.Errorf("PrimaryLayout() = %+v, want %+v", got, tt.primary)
+			}
+			mirror, ok := MirrorLayout()
+			if ok != tt.migrating || mirror != tt.mirror {
+				t.Errorf("MirrorLayout() = %+v, %v, want %+v, %v", mirror, ok, tt.mirror, tt.migrating)
+			}
+			if got := ShardNums(); got != tt.primary.ShardNums {
+				t.Errorf("ShardNums() = %d, want %d", got, tt.primary.ShardNums)
+			}
+			if got := LayoutChanged(); got != tt.layoutChanged {
+				t.Errorf("LayoutChanged() = %v, want %v", got, tt.layoutChanged)
+			}
+
+			i := Dao("u100").(*impl)
+			if i.layout != tt.primary || i.tabName != TableName+tt.primary.TableSuffix(tt.primary.GenShard("u100")) {
+				t.Errorf("Dao layout = %+v, tabName = %s", i.layout, i.tabName)
+			}
+			if (i.mirror != nil) != tt.migrating {
+				t.Fatalf("Dao mirror = %v, want migrating %v", i.mirror, tt.migrating)
+			}
+			if i.mirror != nil && i.mirror.tabName != TableName+tt.mirror.TableSuffix(tt.mirror.GenShard("u100")) {
+				t.Errorf("Dao mirror tabName = %s", i.mirror.tabName)
+			}
+		})
+	}
+}
+
+func TestLayoutChangedAfterMigration(t *testing.T) {
+	defer setLayoutConf("", 0)()
+	conf.Conf.TableShardNums = 8
+	conf.Conf.TableVersion = "v2"
+	if LayoutChanged() {
+		t.Error("LayoutChanged() = true after migration without LegacyShardNums")
+	}
+	conf.Conf.LegacyShardNums = 2
+	if !LayoutChanged() {
+		t.Error("LayoutChanged() = false with LegacyShardNums")
+	}
+}
+
+func TestLayoutTableSuffix(t *testing.T) {
+	if got := (Layout{ShardNums: 2}).TableSuffix("1"); got != "1" {
+		t.Errorf("TableSuffix without version = %q, want 1", got)
+	}
+	if got := (Layout{Version: "v2", ShardNums: 8}).TableSuffix("7"); got != "v2_7" {
+		t.Errorf("TableSuffix with version = %q, want v2_7", got)
+	}
+
+	l := Layout{Version: "v2", ShardNums: 8}
+	i := l.newImpl("3", "")
+	if i.tabName != "order_v2_3" || i.logTabName != LogTableName+"v2_3" || i.outboxTabName != OutboxTableName+"v2_3" {
+		t.Errorf("newImpl table names = %s, %s, %s", i.tabName, i.logTabName, i.outboxTabName)
+	}
+	if got := l.thirdPayOIDTabName("tp1"); got != ThirdPayOIDTableName+l.TableSuffix(l.GenShard("tp1")) {
+		t.Errorf("thirdPayOIDTabName = %s", got)
+	}
+}
@@ -0,0 +1,288 @@
+package dao
+
+import (
+	"context"
+	"crypto/md5"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/zly-app/zapp/logger"
+	"go.uber.org/zap"
+
+	"github.com/zlyuancn/order/client"
+	"github.com/zlyuancn/order/conf"
+)
+
+// 锁
+type Locker interface {
+	/*
+		加锁, 锁已被其它持有者获取时返回 ok=false
+
+			key 锁key
+			expireTime 锁有效时间, 单位秒, 未解锁时到期后会自动释放
+			watchdog 是否启用看门狗, 启用后在解锁前锁不会过期
+
+		return
+
+			unlock 解锁操作, 返回是否由自己释放了锁, 为false表示锁已经过期或被其它持有者获取
+	*/
+	Lock(ctx context.Context, key string, expireTime int, watchdog bool) (
+		unlock func(ctx context.Context) (bool, error), ok bool, err error)
+	/*
+		获取租约, 租约已被其它持有者获取且未过期时返回 ok=false. 租约不能主动释放, 到期后自动失效, 持有期间不占用连接.
+		用于定时任务在每个间隔内只由一个实例执行
+
+			key 租约key
+			expireTime 租约有效时间, 单位秒
+	*/
+	Lease(ctx context.Context, key string, expireTime int) (ok bool, err error)
+}
+
+var lockers = map[string]Locker{
+	conf.LockType_Redis: redisLocker{},
+	conf.LockType_MySQL: &mysqlLocker{},
+	conf.LockType_Local: newLocalLocker(),
+}
+
+// 获取配置的锁
+func GetLocker() Locker {
+	return lockers[conf.Conf.LockType]
+}
+
+// redis锁
+type redisLocker struct{}
+
+func (redisLocker) Lock(ctx context.Context, key string, expireTime int, watchdog bool) (
+	unlock func(ctx context.Context) (bool, error), ok bool, err error) {
+	return SetRedisLock(ctx, key, expireTime, watchdog)
+}
+
+func (redisLocker) Lease(ctx context.Context, key string, expireTime int) (bool, error) {
+	_, ok, err := SetRedisLock(ctx, key, expireTime, false)
+	return ok, err
+}
+
+/*
+mysql锁, 使用订单sqlx组件的 GET_LOCK, 锁和连接绑定, 进程退出后会随连接断开自动释放
+
+每个持有中的锁会占用一个连接池中的连接直到解锁, 同时占用的连接数达到 MySQLLockMaxConns 后加锁返回 ErrLockConnLimit,
+避免锁占满连接池导致订单读写阻塞
+
+租约不使用 GET_LOCK, 而是记录在不分表的租约表中, 不占用连接
+*/
+type mysqlLocker struct {
+	once  sync.Once
+	conns chan struct{}
+}
+
+// mysql锁占用的连接数达到上限
+var ErrLockConnLimit = errors.New("mysqlLocker conns exceeded MySQLLockMaxConns")
+
+// 占用一个锁连接名额, 达到上限时返回false
+func (l *mysqlLocker) acquireConn() bool {
+	l.once.Do(func() {
+		l.conns = make(chan struct{}, conf.Conf.MySQLLockMaxConns)
+	})
+	select {
+	case l.conns <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *mysqlLocker) releaseConn() {
+	<-l.conns
+}
+
+// mysql锁名最大长度
+const mysqlLockNameMaxLen = 64
+
+func (*mysqlLocker) lockName(key string) string {
+	if len(key) <= mysqlLockNameMaxLen {
+		return key
+	}
+	sum := md5.Sum([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (l *mysqlLocker) Lock(ctx context.Context, key string, expireTime int, watchdog bool) (
+	unlock func(ctx context.Context) (bool, error), ok bool, err error) {
+	db := client.GetSqlxClient().GetDB()
+	if db == nil {
+		return nil, false, errors.New("mysqlLocker sqlx db is nil")
+	}
+	if !l.acquireConn() {
+		logger.Log.Error(ctx, "mysqlLocker conns exceeded limit",
+			zap.String("key", key),
+			zap.Int("MySQLLockMaxConns", conf.Conf.MySQLLockMaxConns),
+		)
+		return nil, false, ErrLockConnLimit
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		l.releaseConn()
+		logger.Log.Error(ctx, "mysqlLocker get conn error",
+			zap.String("key", key),
+			zap.Error(err),
+		)
+		return nil, false, err
+	}
+
+	name := l.lockName(key)
+	var ret sql.NullInt64
+	err = conn.QueryRowContext(ctx, "select get_lock(?, 0)", name).Scan(&ret)
+	if err != nil {
+		_ = conn.Close()
+		l.releaseConn()
+		logger.Log.Error(ctx, "mysqlLocker get_lock error",
+			zap.String("key", key),
+			zap.Error(err),
+		)
+		return nil, false, err
+	}
+	if !ret.Valid || ret.Int64 != 1 {
+		_ = conn.Close()
+		l.releaseConn()
+		return nil, false, nil
+	}
+
+	done := make(chan struct{})
+	var once sync.Once
+	unlock = func(ctx context.Context) (bool, error) {
+		var released bool
+		var err error
+		once.Do(func() {
+			close(done)
+			var ret sql.NullInt64
+			err = conn.QueryRowContext(ctx, "select release_lock(?)", name).Scan(&ret)
+			released = ret.Valid && ret.Int64 == 1
+			_ = conn.Close()
+			l.releaseConn()
+			if err != nil {
+				logger.Log.Error(ctx, "mysqlLocker release_lock error",
+					zap.String("key", key),
+					zap.Error(err),
+				)
+			}
+		})
+		return released, err
+	}
+
+	// GET_LOCK 没有有效时间, 未启用看门狗时到期后主动释放
+	if !watchdog {
+		go func() {
+			t := time.NewTimer(time.Duration(expireTime) * time.Second)
+			defer t.Stop()
+			select {
+			case <-done:
+			case <-t.C:
+				_, _ = unlock(context.Background())
+			}
+		}()
+	}
+	return unlock, true, nil
+}
+
+// mysql租约表, 不分表
+const LeaseTableName = "order_lease"
+
+func (*mysqlLocker) Lease(ctx context.Context, key string, expireTime int) (bool, error) {
+	now := time.Now().Unix()
+	expireAt := now + int64(expireTime)
+
+	// 租约已过期时由自己续期
+	query := `update ` + LeaseTableName + ` set expire_at=? where lease_key=? and expire_at<=?;`
+	result, err := client.GetSqlxClient().Exec(ctx, query, expireAt, key, now)
+	if err != nil {
+		logger.Log.Error(ctx, "mysqlLocker renew lease error",
+			zap.String("key", key),
+			zap.Error(err),
+		)
+		return false, err
+	}
+	nums, err := result.RowsAffected()
+	if err != nil {
+		logger.Log.Error(ctx, "mysqlLocker renew lease get RowsAffected error",
+			zap.String("key", key),
+			zap.Error(err),
+		)
+		return false, err
+	}
+	if nums > 0 {
+		return true, nil
+	}
+
+	// 租约不存在时创建, 已存在说明租约被其它持有者获取且未过期
+	query = `insert ignore into ` + LeaseTableName + ` (lease_key, expire_at) values (?, ?);`
+	result, err = client.GetSqlxClient().Exec(ctx, query, key, expireAt)
+	if err != nil {
+		logger.Log.Error(ctx, "mysqlLocker create lease error",
+			zap.String("key", key),
+			zap.Error(err),
+		)
+		return false, err
+	}
+	nums, err = result.RowsAffected()
+	if err != nil {
+		logger.Log.Error(ctx, "mysqlLocker create lease get RowsAffected error",
+			zap.String("key", key),
+			zap.Error(err),
+		)
+		return false, err
+	}
+	return nums > 0, nil
+}
+
+// 进程内的锁, 用于单实例部署和单元测试
+type localLocker struct {
+	mx    sync.Mutex
+	seq   uint64
+	locks map[string]*localLock
+}
+
+type localLock struct {
+	token    uint64
+	expireAt time.Time // 为零值表示不会过期
+}
+
+func newLocalLocker() *localLocker {
+	return &localLocker{locks: make(map[string]*localLock)}
+}
+
+func (l *localLocker) Lock(ctx context.Context, key string, expireTime int, watchdog bool) (
+	unlock func(ctx context.Context) (bool, error), ok bool, err error) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	now := time.Now()
+	if v, ok := l.locks[key]; ok && (v.expireAt.IsZero() || now.Before(v.expireAt)) {
+		return nil, false, nil
+	}
+
+	l.seq++
+	lock := &localLock{token: l.seq}
+	if !watchdog {
+		lock.expireAt = now.Add(time.Duration(expireTime) * time.Second)
+	}
+	l.locks[key] = lock
+
+	unlock = func(ctx context.Context) (bool, error) {
+		l.mx.Lock()
+		defer l.mx.Unlock()
+		if v, ok := l.locks[key]; ok && v.token == lock.token {
+			delete(l.locks, key)
+			return true, nil
+		}
+		return false, nil
+	}
+	return unlock, true, nil
+}
+
+func (l *localLocker) Lease(ctx context.Context, key string, expireTime int) (bool, error) {
+	_, ok, err := l.Lock(ctx, key, expireTime, false)
+	return ok, err
+}
@@ -0,0 +1,87 @@
+package dao
+
+import (
+	"context"
+	"testing"
+
+	"github.com/zlyuancn/order/conf"
+)
+
+func TestMySQLLockerConnBudget(t *testing.T) {
+	conf.Conf.MySQLLockMaxConns = 2
+	l := &mysqlLocker{}
+	if !l.acquireConn() || !l.acquireConn() {
+		t.Fatal("acquireConn failed within budget")
+	}
+	if l.acquireConn() {
+		t.Fatal("acquireConn succeeded over budget")
+	}
+	l.releaseConn()
+	if !l.acquireConn() {
+		t.Fatal("acquireConn failed after releaseConn")
+	}
+}
+
+func TestLocalLockerLease(t *testing.T) {
+	ctx := context.Background()
+	l := newLocalLocker()
+	if ok, _ := l.Lease(ctx, "k", 60); !ok {
+		t.Fatal("first Lease failed")
+	}
+	if ok, _ := l.Lease(ctx, "k", 60); ok {
+		t.Fatal("Lease succeeded while held by another")
+	}
+	if _, ok, _ := l.Lock(ctx, "k", 60, false); ok {
+		t.Fatal("Lock succeeded while lease held")
+	}
+	if ok, _ := l.Lease(ctx, "k2", 60); !ok {
+		t.Fatal("Lease of another key failed")
+	}
+
+	// 到期后可以重新获取
+	if ok, _ := l.Lease(ctx, "k3", 0); !ok {
+		t.Fatal("Lease k3 failed")
+	}
+	if ok, _ := l.Lease(ctx, "k3", 60); !ok {
+		t.Fatal("Lease after expired failed")
+	}
+}
+
+func TestLocalLockerOwnerUnlock(t *testing.T) {
+	ctx := context.Background()
+	l := newLocalLocker()
+
+	// 锁过期后被其它持有者获取, 原持有者解锁不会删除新持有者的锁
+	unlock1, ok, _ := l.Lock(ctx, "k", 0, false)
+	if !ok {
+		t.Fatal("first Lock failed")
+	}
+	unlock2, ok, _ := l.Lock(ctx, "k", 60, false)
+	if !ok {
+		t.Fatal("Lock after expired failed")
+	}
+	if deleted, _ := unlock1(ctx); deleted {
+		t.Fatal("stale unlock deleted the lock of another holder")
+	}
+	if _, ok, _ := l.Lock(ctx, "k", 60, false); ok {
+		t.Fatal("Lock succeeded after stale unlock")
+	}
+	if deleted, _ := unlock2(ctx); !deleted {
+		t.Fatal("owner unlock failed")
+	}
+	if deleted, _ := unlock2(ctx); deleted {
+		t.Fatal("repeated unlock returned deleted")
+	}
+
+	// 看门狗锁在解锁前不会过期
+	unlock3, ok, _ := l.Lock(ctx, "k", 0, true)
+	if !ok {
+		t.Fatal("watchdog Lock failed")
+	}
+	if _, ok, _ := l.Lock(ctx, "k", 60, false); ok {
+		t.Fatal("Lock succeeded while watchdog lock held")
+	}
+	if deleted, _ := unlock3(ctx); !deleted {
+		t.Fatal("watchdog unlock failed")
+	}
+}
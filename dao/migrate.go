@@ -0,0 +1,318 @@
+package dao
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/didi/gendry/builder"
+	"github.com/zly-app/component/sqlx"
+	"github.com/zly-app/zapp/logger"
+	"go.uber.org/zap"
+
+	"github.com/zlyuancn/order/client"
+	"github.com/zlyuancn/order/conf"
+)
+
+const MigrateCheckpointTableName = "order_migrate_checkpoint"
+
+// 扩容迁移复制存量数据的检查点
+type MigrateCheckpointModel struct {
+	SrcTab     string `db:"src_tab"`     // 源分表名
+	DstVersion string `db:"dst_version"` // 迁移的新分表版本
+	LastID     uint   `db:"last_id"`     // 已复制的最大订单记录id
+	Finished   byte   `db:"finished"`    // 是否已复制完成
+}
+
+// 订单表中除id外的字段, 不同分表的id会重复, 迁移时按订单号覆盖写入
+var migrateOrderFields = []string{
+	"oid",
+	"uid",
+	"o_type",
+	"o_status",
+
+	"pay_type",
+	"pay_status",
+	"pay_amount",
+	"third_pay_oid",
+	"pay_legs",
+	"refund_amount",
+	"expire_at",
+
+	"extend",
+	"remark",
+
+	"ctime",
+	"utime",
+	"update_nums",
+	"forward_nums",
+}
+
+// 流水表中除id外的字段
+var migrateLogFields = []string{
+	"oid",
+	"uid",
+	"log_type",
+
+	"old_o_status",
+	"new_o_status",
+	"old_pay_status",
+	"new_pay_status",
+
+	"extend",
+	"remark",
+	"caller",
+	"ctime",
+}
+
+// 生成 in 条件的占位符
+func inPlaceholder(n int) string {
+	return "(?" + strings.Repeat(",?", n-1) + ")"
+}
+
+// 把订单数据从 srcTab 覆盖写入到 dstTab, 需要在事务中调用
+func copyOrders(ctx context.Context, tx sqlx.Txx, srcTab, dstTab string, oids []interface{}) error {
+	// 更新时直接引用源表的列, 不使用 MySQL 8.0.20 起废弃的 values(), insert ... select 也不支持行别名
+	fields := strings.Join(migrateOrderFields, ",")
+	srcFields := make([]string, 0, len(migrateOrderFields))
+	updates := make([]string, 0, len(migrateOrderFields)-1)
+	for i, f := range migrateOrderFields {
+		srcFields = append(srcFields, "src."+f)
+		if i > 0 {
+			updates = append(updates, f+"=src."+f)
+		}
+	}
+	cond := `insert into ` + dstTab + ` (` + fields + `) select ` + strings.Join(srcFields, ",") + ` from ` + srcTab +
+		` as src where src.oid in ` + inPlaceholder(len(oids)) + ` on duplicate key update ` + strings.Join(updates, ",") + `;`
+	_, err := tx.Exec(ctx, cond, oids...)
+	if err != nil {
+		logger.Log.Error(ctx, "order copyOrders err",
+			zap.String("cond", cond),
+			zap.Any("vals", oids),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
+
+// 把订单流水从 srcTab 覆盖写入到 dstTab, 会先删除 dstTab 中这些订单的流水, 需要在事务中调用
+func copyLogs(ctx context.Context, tx sqlx.Txx, srcTab, dstTab string, oids []interface{}) error {
+	cond := `delete from ` + dstTab + ` where oid in ` + inPlaceholder(len(oids)) + `;`
+	_, err := tx.Exec(ctx, cond, oids...)
+	if err != nil {
+		logger.Log.Error(ctx, "order copyLogs delete err",
+			zap.String("cond", cond),
+			zap.Any("vals", oids),
+			zap.Error(err),
+		)
+		return err
+	}
+
+	fields := strings.Join(migrateLogFields, ",")
+	cond = `insert into ` + dstTab + ` (` + fields + `) select ` + fields + ` from ` + srcTab +
+		` where oid in ` + inPlaceholder(len(oids)) + ` order by id asc;`
+	_, err = tx.Exec(ctx, cond, oids...)
+	if err != nil {
+		logger.Log.Error(ctx, "order copyLogs insert err",
+			zap.String("cond", cond),
+			zap.Any("vals", oids),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
+
+// 扩容迁移期间把订单的最新数据同步到镜像布局, 需要在订单变更的事务中调用
+func (i *impl) syncMirror(ctx context.Context, tx sqlx.Txx, orderID string) error {
+	if i.mirror == nil {
+		return nil
+	}
+	return copyOrders(ctx, tx, i.tabName, i.mirror.tabName, []interface{}{orderID})
+}
+
+var migrateCheckpointSelectField = []string{
+	"src_tab",
+	"dst_version",
+	"last_id",
+	"finished",
+}
+
+// 获取复制存量数据的检查点, 不存在时返回从头开始的检查点
+func GetMigrateCheckpoint(ctx context.Context, srcTab, dstVersion string) (*MigrateCheckpointModel, error) {
+	where := map[string]interface{}{
+		"src_tab":     srcTab,
+		"dst_version": dstVersion,
+		"_limit":      []uint{1},
+	}
+	cond, vals, err := builder.BuildSelect(MigrateCheckpointTableName, where, migrateCheckpointSelectField)
+	if err != nil {
+		logger.Log.Error(ctx, "order GetMigrateCheckpoint BuildSelect err",
+			zap.Any("select", migrateCheckpointSelectField),
+			zap.Any("where", where),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+	var ret = &MigrateCheckpointModel{}
+	err = client.GetSqlxClient().FindOne(ctx, ret, cond, vals...)
+	if err == sql.ErrNoRows {
+		return &MigrateCheckpointModel{SrcTab: srcTab, DstVersion: dstVersion}, nil
+	}
+	if err != nil {
+		logger.Log.Error(ctx, "order GetMigrateCheckpoint err",
+			zap.String("cond", cond),
+			zap.Any("vals", vals),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+	return ret, nil
+}
+
+// 保存检查点, 需要和复制数据在同一个事务中调用
+func saveMigrateCheckpoint(ctx context.Context, tx sqlx.Txx, cp *MigrateCheckpointModel) error {
+	var data []map[string]interface{}
+	data = append(data, map[string]interface{}{
+		"src_tab":     cp.SrcTab,
+		"dst_version": cp.DstVersion,
+		"last_id":     cp.LastID,
+		"finished":    cp.Finished,
+	})
+	update := map[string]interface{}{
+		"last_id":  cp.LastID,
+		"finished": cp.Finished,
+	}
+	cond, vals, err := builder.BuildInsertOnDuplicate(MigrateCheckpointTableName, data, update)
+	if err != nil {
+		logger.Log.Error(ctx, "order saveMigrateCheckpoint BuildInsertOnDuplicate err",
+			zap.Any("data", data),
+			zap.Error(err),
+		)
+		return err
+	}
+	_, err = tx.Exec(ctx, cond, vals...)
+	if err != nil {
+		logger.Log.Error(ctx, "order saveMigrateCheckpoint err",
+			zap.String("cond", cond),
+			zap.Any("vals", vals),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
+
+var migrateCopySelectField = []string{
+	"id",
+	"oid",
+	"uid",
+	"third_pay_oid",
+}
+
+/*
+从源布局的一个分片复制一批存量数据到目标布局, 包括订单, 流水和第三方支付订单id映射, 返回复制后的检查点
+
+这批订单在复制期间会被锁定, 和订单变更互斥. 复制和检查点在同一个事务中提交, 中断后从检查点继续复制.
+已复制完成的分片不会再复制.
+*/
+func MigrateCopyBatch(ctx context.Context, src Layout, shard string, dst Layout, limit uint) (*MigrateCheckpointModel, error) {
+	s := src.newImpl(shard, "")
+	cp, err := GetMigrateCheckpoint(ctx, s.tabName, dst.Version)
+	if err != nil {
+		return nil, err
+	}
+	if cp.Finished == 1 {
+		return cp, nil
+	}
+
+	where := map[string]interface{}{
+		"id >":      cp.LastID,
+		"_orderby":  "id asc",
+		"_limit":    []uint{limit},
+		"_lockMode": "exclusive",
+	}
+	cond, vals, err := builder.BuildSelect(s.tabName, where, migrateCopySelectField)
+	if err != nil {
+		logger.Log.Error(ctx, "order MigrateCopyBatch BuildSelect err",
+			zap.Any("select", migrateCopySelectField),
+			zap.Any("where", where),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+
+	ret := *cp
+	err = client.GetSqlxClient().TransactionX(ctx, func(ctx context.Context, tx sqlx.Txx) error {
+		var models []*Model
+		err := tx.Find(ctx, &models, cond, vals...)
+		if err != nil {
+			logger.Log.Error(ctx, "order MigrateCopyBatch err",
+				zap.String("cond", cond),
+				zap.Any("vals", vals),
+				zap.Error(err),
+			)
+			return err
+		}
+
+		// 按目标分片分组
+		groups := make(map[string][]interface{})
+		for _, m := range models {
+			dstShard := dst.GenShard(m.Uid)
+			groups[dstShard] = append(groups[dstShard], m.OrderID)
+		}
+		for dstShard, oids := range groups {
+			d := dst.newImpl(dstShard, "")
+			err = copyOrders(ctx, tx, s.tabName, d.tabName, oids)
+			if err != nil {
+				return err
+			}
+			err = copyLogs(ctx, tx, s.logTabName, d.logTabName, oids)
+			if err != nil {
+				return err
+			}
+		}
+
+		if conf.Conf.AllowThirdPayOIDMapping {
+			for _, m := range models {
+				if m.ThirdPayOrderID == "" {
+					continue
+				}
+				err = insertThirdPayOIDMapping(ctx, tx, dst.thirdPayOIDTabName(m.ThirdPayOrderID), m.ThirdPayOrderID,
+					m.OrderID, m.Uid, true)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if len(models) > 0 {
+			ret.LastID = models[len(models)-1].ID
+		}
+		if len(models) < int(limit) {
+			ret.Finished = 1
+		}
+		return saveMigrateCheckpoint(ctx, tx, &ret)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+// 获取源布局一个分片中最大的订单记录id, 用于查看复制进度
+func GetMaxOrderRecordID(ctx context.Context, l Layout, shard string) (uint, error) {
+	tabName := l.newImpl(shard, "").tabName
+	query := `select ifnull(max(id), 0) from ` + tabName + `;`
+	var ret uint
+	err := client.GetSqlxClient().FindOne(ctx, &ret, query)
+	if err != nil {
+		logger.Log.Error(ctx, "order GetMaxOrderRecordID err",
+			zap.String("query", query),
+			zap.Error(err),
+		)
+		return 0, err
+	}
+	return ret, nil
+}
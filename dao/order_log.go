@@ -0,0 +1,133 @@
+package dao
+
+import (
+	"context"
+
+	"github.com/didi/gendry/builder"
+	"github.com/zly-app/component/sqlx"
+	"github.com/zly-app/zapp"
+	"github.com/zly-app/zapp/logger"
+	"go.uber.org/zap"
+
+	"github.com/zlyuancn/order/client"
+	"github.com/zlyuancn/order/order_model"
+)
+
+const LogTableName = "order_log_"
+
+type LogModel struct {
+	ID      uint   `db:"id"`
+	OrderID string `db:"oid"`      // 订单id
+	Uid     string `db:"uid"`      // 唯一标识一个用户
+	LogType byte   `db:"log_type"` // 流水类型
+
+	OldOrderStatus byte `db:"old_o_status"`   // 变更前订单状态
+	NewOrderStatus byte `db:"new_o_status"`   // 变更后订单状态
+	OldPayStatus   byte `db:"old_pay_status"` // 变更前支付状态
+	NewPayStatus   byte `db:"new_pay_status"` // 变更后支付状态
+
+	Extend string `db:"extend"` // 变更后的扩展数据快照
+	Remark string `db:"remark"` // 备注
+	Caller string `db:"caller"` // 调用方
+	Ctime  int64  `db:"ctime"`  // 创建时间, 秒级时间戳
+}
+
+// 获取调用方, 未设置时使用app名
+func getCaller(ctx context.Context) string {
+	caller := order_model.GetCaller(ctx)
+	if caller == "" && zapp.App() != nil {
+		caller = zapp.App().Name()
+	}
+	return caller
+}
+
+// 写入流水, 需要和订单变更在同一个事务中调用. 扩容迁移期间会同时写入镜像布局
+func (i *impl) createLog(ctx context.Context, tx sqlx.Txx, v *LogModel) error {
+	if v.Extend == "" {
+		v.Extend = "{}"
+	}
+	var data []map[string]interface{}
+	data = append(data, map[string]interface{}{
+		"oid":      v.OrderID,
+		"uid":      v.Uid,
+		"log_type": v.LogType,
+
+		"old_o_status":   v.OldOrderStatus,
+		"new_o_status":   v.NewOrderStatus,
+		"old_pay_status": v.OldPayStatus,
+		"new_pay_status": v.NewPayStatus,
+
+		"extend": v.Extend,
+		"remark": v.Remark,
+		"caller": getCaller(ctx),
+	})
+	tabNames := []string{i.logTabName}
+	if i.mirror != nil {
+		tabNames = append(tabNames, i.mirror.logTabName)
+	}
+	for _, tabName := range tabNames {
+		cond, vals, err := builder.BuildInsert(tabName, data)
+		if err != nil {
+			logger.Log.Error(ctx, "order createLog BuildInsert err",
+				zap.Any("data", data),
+				zap.Error(err),
+			)
+			return err
+		}
+
+		_, err = tx.Exec(ctx, cond, vals...)
+		if err != nil {
+			logger.Log.Error(ctx, "order createLog err",
+				zap.String("cond", cond),
+				zap.Any("vals", vals),
+				zap.Error(err),
+			)
+			return err
+		}
+	}
+	return nil
+}
+
+var getLogsSelectField = []string{
+	"id",
+	"oid",
+	"uid",
+	"log_type",
+
+	"old_o_status",
+	"new_o_status",
+	"old_pay_status",
+	"new_pay_status",
+
+	"extend",
+	"remark",
+	"caller",
+	"unix_timestamp(ctime) as ctime",
+}
+
+func (i *impl) GetLogs(ctx context.Context, orderID string) ([]*LogModel, error) {
+	where := map[string]interface{}{
+		"oid":      orderID,
+		"_orderby": "id asc",
+	}
+	cond, vals, err := builder.BuildSelect(i.logTabName, where, getLogsSelectField)
+	if err != nil {
+		logger.Log.Error(ctx, "order GetLogs BuildSelect err",
+			zap.Any("select", getLogsSelectField),
+			zap.Any("where", where),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+	var ret []*LogModel
+	err = client.GetSqlxClient().Find(ctx, &ret, cond, vals...)
+	if err != nil {
+		logger.Log.Error(ctx, "order GetLogs err",
+			zap.String("cond", cond),
+			zap.Any("vals", vals),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+	return ret, nil
+}
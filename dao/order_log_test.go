@@ -0,0 +1,19 @@
+package dao
+
+import (
+	"context"
+	"testing"
+
+	"github.com/zlyuancn/order/order_model"
+)
+
+func TestGetCaller(t *testing.T) {
+	ctx := order_model.WithCaller(context.Background(), "svc")
+	if got := getCaller(ctx); got != "svc" {
+		t.Errorf("getCaller = %q, want svc", got)
+	}
+	// 未设置调用方且没有app时为空
+	if got := getCaller(context.Background()); got != "" {
+		t.Errorf("getCaller without caller = %q, want empty", got)
+	}
+}
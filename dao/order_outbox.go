@@ -0,0 +1,106 @@
+package dao
+
+import (
+	"context"
+
+	"github.com/didi/gendry/builder"
+	"github.com/zly-app/component/sqlx"
+	"github.com/zly-app/zapp/logger"
+	"go.uber.org/zap"
+
+	"github.com/zlyuancn/order/client"
+)
+
+const OutboxTableName = "order_outbox_"
+
+type OutboxModel struct {
+	ID      uint   `db:"id"`
+	OrderID string `db:"oid"` // 订单id
+	Uid     string `db:"uid"` // 唯一标识一个用户
+}
+
+// 写入待发送的补偿信号, 需要和订单创建在同一个事务中调用
+func (i *impl) createOutbox(ctx context.Context, tx sqlx.Txx, orderID, uid string) error {
+	var data []map[string]interface{}
+	data = append(data, map[string]interface{}{
+		"oid": orderID,
+		"uid": uid,
+	})
+	cond, vals, err := builder.BuildInsert(i.outboxTabName, data)
+	if err != nil {
+		logger.Log.Error(ctx, "order createOutbox BuildInsert err",
+			zap.Any("data", data),
+			zap.Error(err),
+		)
+		return err
+	}
+
+	_, err = tx.Exec(ctx, cond, vals...)
+	if err != nil {
+		logger.Log.Error(ctx, "order createOutbox err",
+			zap.String("cond", cond),
+			zap.Any("vals", vals),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
+
+var listOutboxSelectField = []string{
+	"id",
+	"oid",
+	"uid",
+}
+
+func (i *impl) ListOutbox(ctx context.Context, startID uint, limit uint) ([]*OutboxModel, error) {
+	where := map[string]interface{}{
+		"id >":     startID,
+		"_orderby": "id asc",
+		"_limit":   []uint{limit},
+	}
+	cond, vals, err := builder.BuildSelect(i.outboxTabName, where, listOutboxSelectField)
+	if err != nil {
+		logger.Log.Error(ctx, "order ListOutbox BuildSelect err",
+			zap.Any("select", listOutboxSelectField),
+			zap.Any("where", where),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+	var ret []*OutboxModel
+	err = client.GetSqlxClient().Find(ctx, &ret, cond, vals...)
+	if err != nil {
+		logger.Log.Error(ctx, "order ListOutbox err",
+			zap.String("cond", cond),
+			zap.Any("vals", vals),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (i *impl) DeleteOutbox(ctx context.Context, id uint) error {
+	where := map[string]interface{}{
+		"id": id,
+	}
+	cond, vals, err := builder.BuildDelete(i.outboxTabName, where)
+	if err != nil {
+		logger.Log.Error(ctx, "order DeleteOutbox BuildDelete err",
+			zap.Any("where", where),
+			zap.Error(err),
+		)
+		return err
+	}
+	_, err = client.GetSqlxClient().Exec(ctx, cond, vals...)
+	if err != nil {
+		logger.Log.Error(ctx, "order DeleteOutbox err",
+			zap.String("cond", cond),
+			zap.Any("vals", vals),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
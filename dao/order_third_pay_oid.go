@@ -0,0 +1,110 @@
+package dao
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/didi/gendry/builder"
+	"github.com/zly-app/component/sqlx"
+	"github.com/zly-app/zapp/logger"
+	"go.uber.org/zap"
+
+	"github.com/zlyuancn/order/client"
+)
+
+const ThirdPayOIDTableName = "order_third_pay_oid_"
+
+type ThirdPayOIDModel struct {
+	ThirdPayOrderID string `db:"third_pay_oid"` // 第三方支付订单id
+	OrderID         string `db:"oid"`           // 订单id
+	Uid             string `db:"uid"`           // 唯一标识一个用户
+}
+
+// 写入第三方支付订单id映射, 需要和订单创建在同一个事务中调用. 扩容迁移期间会同时写入镜像布局
+func (i *impl) createThirdPayOIDMapping(ctx context.Context, tx sqlx.Txx, thirdPayOid, orderID, uid string) error {
+	err := insertThirdPayOIDMapping(ctx, tx, i.layout.thirdPayOIDTabName(thirdPayOid), thirdPayOid, orderID, uid, false)
+	if err != nil {
+		return err
+	}
+	if i.mirror != nil {
+		return insertThirdPayOIDMapping(ctx, tx, i.mirror.layout.thirdPayOIDTabName(thirdPayOid), thirdPayOid, orderID, uid, true)
+	}
+	return nil
+}
+
+// 写入映射, ignore 为true时忽略已存在的映射, 用于扩容迁移
+func insertThirdPayOIDMapping(ctx context.Context, tx sqlx.Txx, tabName, thirdPayOid, orderID, uid string,
+	ignore bool) error {
+	cond, vals, err := buildThirdPayOIDMappingInsert(tabName, thirdPayOid, orderID, uid, ignore)
+	if err != nil {
+		logger.Log.Error(ctx, "order insertThirdPayOIDMapping BuildInsert err",
+			zap.String("tabName", tabName),
+			zap.String("thirdPayOid", thirdPayOid),
+			zap.String("orderID", orderID),
+			zap.String("uid", uid),
+			zap.Error(err),
+		)
+		return err
+	}
+
+	_, err = tx.Exec(ctx, cond, vals...)
+	if err != nil {
+		logger.Log.Error(ctx, "order insertThirdPayOIDMapping err",
+			zap.String("cond", cond),
+			zap.Any("vals", vals),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
+
+func buildThirdPayOIDMappingInsert(tabName, thirdPayOid, orderID, uid string, ignore bool) (string, []interface{}, error) {
+	var data []map[string]interface{}
+	data = append(data, map[string]interface{}{
+		"third_pay_oid": thirdPayOid,
+		"oid":           orderID,
+		"uid":           uid,
+	})
+	build := builder.BuildInsert
+	if ignore {
+		build = builder.BuildInsertIgnore
+	}
+	return build(tabName, data)
+}
+
+var thirdPayOIDSelectField = []string{
+	"third_pay_oid",
+	"oid",
+	"uid",
+}
+
+// 根据第三方支付订单id在主布局中获取映射, 不存在时返回 sql.ErrNoRows
+func GetThirdPayOIDMapping(ctx context.Context, thirdPayOid string) (*ThirdPayOIDModel, error) {
+	where := map[string]interface{}{
+		"third_pay_oid": thirdPayOid,
+		"_limit":        []uint{1},
+	}
+	cond, vals, err := builder.BuildSelect(PrimaryLayout().thirdPayOIDTabName(thirdPayOid), where, thirdPayOIDSelectField)
+	if err != nil {
+		logger.Log.Error(ctx, "order GetThirdPayOIDMapping BuildSelect err",
+			zap.Any("select", thirdPayOIDSelectField),
+			zap.Any("where", where),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+	var ret = &ThirdPayOIDModel{}
+	err = client.GetSqlxClient().FindOne(ctx, ret, cond, vals...)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			logger.Log.Error(ctx, "order GetThirdPayOIDMapping err",
+				zap.String("cond", cond),
+				zap.Any("vals", vals),
+				zap.Error(err),
+			)
+		}
+		return nil, err
+	}
+	return ret, nil
+}
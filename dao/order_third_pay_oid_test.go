@@ -0,0 +1,46 @@
+package dao
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/zlyuancn/order/conf"
+)
+
+func TestBuildThirdPayOIDMappingInsert(t *testing.T) {
+	cond, vals, err := buildThirdPayOIDMappingInsert("order_third_pay_oid_1", "tp1", "oid1", "u1", false)
+	if err != nil {
+		t.Fatalf("buildThirdPayOIDMappingInsert err: %v", err)
+	}
+	if !strings.HasPrefix(cond, "INSERT INTO order_third_pay_oid_1 ") || len(vals) != 3 {
+		t.Errorf("insert cond = %s, vals = %v", cond, vals)
+	}
+
+	// 扩容迁移写入镜像布局时忽略已存在的映射
+	cond, _, err = buildThirdPayOIDMappingInsert("order_third_pay_oid_v2_1", "tp1", "oid1", "u1", true)
+	if err != nil {
+		t.Fatalf("buildThirdPayOIDMappingInsert ignore err: %v", err)
+	}
+	if !strings.HasPrefix(cond, "INSERT IGNORE INTO order_third_pay_oid_v2_1 ") {
+		t.Errorf("insert ignore cond = %s", cond)
+	}
+}
+
+func TestThirdPayOIDMappingMirror(t *testing.T) {
+	defer setLayoutConf(conf.MigrateStage_DualWrite, 0)()
+
+	// 映射按第三方支付订单id分表, 和订单所在的分表无关
+	i := Dao("u1").(*impl)
+	if i.mirror == nil {
+		t.Fatal("Dao mirror is nil in dual write stage")
+	}
+	primary := i.layout.thirdPayOIDTabName("tp1")
+	mirror := i.mirror.layout.thirdPayOIDTabName("tp1")
+	if primary != ThirdPayOIDTableName+PrimaryLayout().GenShard("tp1") {
+		t.Errorf("primary thirdPayOIDTabName = %s", primary)
+	}
+	m, _ := MirrorLayout()
+	if mirror != ThirdPayOIDTableName+"v2_"+m.GenShard("tp1") {
+		t.Errorf("mirror thirdPayOIDTabName = %s", mirror)
+	}
+}
@@ -2,6 +2,9 @@ package dao
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
 	"time"
 
 	"github.com/zly-app/zapp/logger"
@@ -10,22 +13,55 @@ import (
 	"github.com/zlyuancn/order/client"
 )
 
+const (
+	redisUnlockScript = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`
+	redisExtendLockScript = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`
+)
+
+// 生成锁持有者token
+func genLockToken() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
 /*
-从redis设置一个锁
+从redis设置一个锁, 锁的值为随机的持有者token, 解锁时只会删除自己持有的锁
 
-	op 操作类型
+	key 锁key
 	expireTime 锁有效时间, 单位秒
+	watchdog 是否启用看门狗, 启用后在解锁前会定时将锁的有效时间续期为 expireTime
 
 return
 
-	unlock 解锁操作.
-	    limitProcessTime 限制过程时间, 单位秒. lock到unlock之间的时间如果超过了limitProcessTime的值则不会去解锁.
-			limitProcessTime > 0 && limitProcessTime < expireTime 才会生效
+	unlock 解锁操作, 返回是否删除了锁, 为false表示锁已经过期或被其它持有者获取
 */
-func SetRedisLock(ctx context.Context, key string, expireTime int) (
-	unlock func(ctx context.Context, limitProcessTime int) (bool, error), ok bool, err error) {
-	startTime := time.Now().UnixNano()
-	ok, err = client.GetRedisClient().SetNX(ctx, key, 1, time.Duration(expireTime)*time.Second).Result()
+func SetRedisLock(ctx context.Context, key string, expireTime int, watchdog bool) (
+	unlock func(ctx context.Context) (bool, error), ok bool, err error) {
+	token, err := genLockToken()
+	if err != nil {
+		logger.Log.Error(ctx, "SetRedisLock genLockToken error",
+			zap.String("key", key),
+			zap.Error(err),
+		)
+		return nil, false, err
+	}
+
+	expire := time.Duration(expireTime) * time.Second
+	ok, err = client.GetRedisClient().SetNX(ctx, key, token, expire).Result()
 	if err != nil {
 		logger.Log.Error(ctx, "SetRedisLock error",
 			zap.String("key", key),
@@ -37,22 +73,65 @@ func SetRedisLock(ctx context.Context, key string, expireTime int) (
 	if !ok {
 		return nil, false, nil
 	}
-	unlock = func(ctx context.Context, limitProcessTime int) (bool, error) {
-		if limitProcessTime < 0 || limitProcessTime >= expireTime {
-			limitProcessTime = expireTime / 2
-		}
 
-		nowTime := time.Now().UnixNano()
-		if nowTime-startTime > int64(limitProcessTime)*int64(time.Second) {
-			return false, nil
-		}
+	stopWatchdog := func() {}
+	if watchdog {
+		stopWatchdog = startLockWatchdog(ctx, key, token, expire)
+	}
 
-		_, err := client.GetRedisClient().Del(ctx, key).Result()
-		return true, err // 这里不判断是否真的删了key, 因为锁失效了也表示删除成功
+	var once sync.Once
+	unlock = func(ctx context.Context) (bool, error) {
+		var n int
+		var err error
+		once.Do(func() {
+			stopWatchdog()
+			n, err = client.GetRedisClient().Eval(ctx, redisUnlockScript, []string{key}, token).Int()
+			if err != nil {
+				logger.Log.Error(ctx, "RedisUnlock error",
+					zap.String("key", key),
+					zap.Error(err),
+				)
+			}
+		})
+		return n == 1, err
 	}
 	return unlock, true, nil
 }
 
+// 启动锁看门狗, 每隔 expire/3 将锁的有效时间续期为 expire, 锁不再由自己持有时停止续期. 返回停止函数
+func startLockWatchdog(ctx context.Context, key, token string, expire time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(expire / 3)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+
+			// 使用新的ctx续期, 避免调用方ctx结束后锁无法续期
+			n, err := client.GetRedisClient().Eval(context.Background(), redisExtendLockScript, []string{key},
+				token, expire.Milliseconds()).Int()
+			if err != nil {
+				logger.Log.Error(ctx, "RedisLock watchdog extend error",
+					zap.String("key", key),
+					zap.Error(err),
+				)
+				continue
+			}
+			if n != 1 {
+				logger.Log.Warn(ctx, "RedisLock watchdog lock lost",
+					zap.String("key", key),
+				)
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
 func RedisIncrBy(ctx context.Context, key string, incr int64) (int64, error) {
 	if incr == 0 {
 		incr = 1
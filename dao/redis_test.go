@@ -0,0 +1,22 @@
+package dao
+
+import (
+	"testing"
+)
+
+func TestGenLockToken(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		token, err := genLockToken()
+		if err != nil {
+			t.Fatalf("genLockToken err: %v", err)
+		}
+		if len(token) != 32 {
+			t.Fatalf("genLockToken len = %d, want 32", len(token))
+		}
+		if seen[token] {
+			t.Fatalf("genLockToken duplicated token %s", token)
+		}
+		seen[token] = true
+	}
+}
@@ -5,10 +5,10 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"hash/crc32"
+	"time"
 
 	"github.com/didi/gendry/builder"
-	"github.com/spf13/cast"
+	"github.com/zly-app/component/sqlx"
 	"github.com/zly-app/zapp/logger"
 	"go.uber.org/zap"
 
@@ -20,23 +20,33 @@ import (
 var (
 	// Dao 对外暴露实例
 	Dao = func(uid string) RPC {
-		return &impl{
-			tabName: TableName + GenShard(uid),
-			uid:     uid,
+		l := PrimaryLayout()
+		i := l.newImpl(l.GenShard(uid), uid)
+		if m, ok := MirrorLayout(); ok {
+			i.mirror = m.newImpl(m.GenShard(uid), uid)
 		}
+		return i
 	}
+	// DaoByShard 根据主布局的分片获取实例, 用于跨用户的查询
+	DaoByShard = func(shard string) RPC {
+		return PrimaryLayout().DaoByShard(shard)
+	}
+	// GenShard 生成主布局的分片
 	GenShard = func(uid string) string {
-		shardID := crc32.ChecksumIEEE([]byte(uid)) % conf.Conf.TableShardNums
-		return cast.ToString(shardID)
+		return PrimaryLayout().GenShard(uid)
 	}
 )
 
 type impl struct {
-	uid     string
-	tabName string
+	uid           string
+	layout        Layout
+	tabName       string
+	logTabName    string
+	outboxTabName string
+	mirror        *impl // 扩容迁移期间同步写入的镜像布局实例
 }
 
-func (i *impl) CreateOneModel(ctx context.Context, v *Model) (int64, error) {
+func (i *impl) CreateOneModel(ctx context.Context, v *Model, withOutbox bool) (int64, error) {
 	if v == nil {
 		return 0, errors.New("CreateOneModel v is empty")
 	}
@@ -50,6 +60,9 @@ func (i *impl) CreateOneModel(ctx context.Context, v *Model) (int64, error) {
 		"pay_status":    v.PayStatus,
 		"pay_amount":    v.PayAmount,
 		"third_pay_oid": v.ThirdPayOrderID,
+		"pay_legs":      v.PayLegs,
+		"refund_amount": v.RefundAmount,
+		"expire_at":     v.ExpireAt,
 
 		"uid":    v.Uid,
 		"extend": v.Extend,
@@ -64,16 +77,56 @@ func (i *impl) CreateOneModel(ctx context.Context, v *Model) (int64, error) {
 		return 0, err
 	}
 
-	result, err := client.GetSqlxClient().Exec(ctx, cond, vals...)
+	var id int64
+	err = client.GetSqlxClient().TransactionX(ctx, func(ctx context.Context, tx sqlx.Txx) error {
+		result, err := tx.Exec(ctx, cond, vals...)
+		if err != nil {
+			logger.Log.Error(ctx, "order CreateOneModel err",
+				zap.String("cond", cond),
+				zap.Any("vals", vals),
+				zap.Error(err),
+			)
+			return err
+		}
+		id, err = result.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		err = i.createLog(ctx, tx, &LogModel{
+			OrderID:        v.OrderID,
+			Uid:            v.Uid,
+			LogType:        byte(order_model.OrderLogType_Create),
+			NewOrderStatus: v.OrderStatus,
+			NewPayStatus:   v.PayStatus,
+			Extend:         v.Extend,
+			Remark:         v.Remark,
+		})
+		if err != nil {
+			return err
+		}
+
+		if v.ThirdPayOrderID != "" && conf.Conf.AllowThirdPayOIDMapping {
+			err = i.createThirdPayOIDMapping(ctx, tx, v.ThirdPayOrderID, v.OrderID, v.Uid)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = i.syncMirror(ctx, tx, v.OrderID)
+		if err != nil {
+			return err
+		}
+
+		if withOutbox {
+			return i.createOutbox(ctx, tx, v.OrderID, v.Uid)
+		}
+		return nil
+	})
 	if err != nil {
-		logger.Log.Error(ctx, "order CreateOneModel err",
-			zap.String("cond", cond),
-			zap.Any("vals", vals),
-			zap.Error(err),
-		)
 		return 0, err
 	}
-	return result.LastInsertId()
+	return id, nil
 }
 
 var getOneSelectField = []string{
@@ -85,21 +138,33 @@ var getOneSelectField = []string{
 	"pay_status",
 	"pay_amount",
 	"third_pay_oid",
+	"pay_legs",
+	"refund_amount",
+	"expire_at",
 
 	"extend",
 	"remark",
+	"update_nums",
+	"forward_nums",
+	"unix_timestamp(ctime) as ctime",
 }
 
+// 获取订单, 通过 DaoByShard 获取的实例不会限制uid
 func (i *impl) GetOne(ctx context.Context, orderID string) (*Model, error) {
 	where := map[string]interface{}{
 		"oid":    orderID,
-		"uid":    i.uid,
 		"_limit": []uint{1},
 	}
-	cond, vals, err := builder.BuildSelect(i.tabName, where, getOneSelectField)
+	selectField := getOneSelectField
+	if i.uid != "" {
+		where["uid"] = i.uid
+	} else {
+		selectField = listSelectField
+	}
+	cond, vals, err := builder.BuildSelect(i.tabName, where, selectField)
 	if nil != err {
 		logger.Log.Error(ctx, "order CreateOneModel BuildSelect err",
-			zap.Any("select", getOneSelectField),
+			zap.Any("select", selectField),
 			zap.Any("where", where),
 			zap.Error(err),
 		)
@@ -117,13 +182,85 @@ func (i *impl) GetOne(ctx context.Context, orderID string) (*Model, error) {
 		}
 		return nil, err
 	}
-	ret.OrderID = orderID
-	ret.Uid = i.uid
+	if i.uid != "" {
+		ret.OrderID = orderID
+		ret.Uid = i.uid
+	}
 	return ret, err
 }
 
+// 根据第三方支付订单id获取订单, 通过 DaoByShard 获取的实例不会限制uid
+func (i *impl) GetOneByThirdPayOID(ctx context.Context, thirdPayOid string) (*Model, error) {
+	where := map[string]interface{}{
+		"third_pay_oid": thirdPayOid,
+		"_limit":        []uint{1},
+	}
+	if i.uid != "" {
+		where["uid"] = i.uid
+	}
+	cond, vals, err := builder.BuildSelect(i.tabName, where, listSelectField)
+	if nil != err {
+		logger.Log.Error(ctx, "order GetOneByThirdPayOID BuildSelect err",
+			zap.Any("select", listSelectField),
+			zap.Any("where", where),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+	var ret = &Model{}
+	err = client.GetSqlxClient().FindOne(ctx, ret, cond, vals...)
+	if nil != err {
+		if err != sql.ErrNoRows {
+			logger.Log.Error(ctx, "order GetOneByThirdPayOID err",
+				zap.String("cond", cond),
+				zap.Any("vals", vals),
+				zap.Error(err),
+			)
+		}
+		return nil, err
+	}
+	return ret, nil
+}
+
+var lockOneSelectField = []string{
+	"oid",
+	"o_type",
+	"o_status",
+	"pay_status",
+	"extend",
+	"update_nums",
+}
+
+// 在事务中锁定一条订单记录, 用于获取变更前的数据写入流水
+func (i *impl) lockOne(ctx context.Context, tx sqlx.Txx, where map[string]interface{}) (*Model, error) {
+	where["_limit"] = []uint{1}
+	where["_lockMode"] = "exclusive"
+	cond, vals, err := builder.BuildSelect(i.tabName, where, lockOneSelectField)
+	if err != nil {
+		logger.Log.Error(ctx, "order lockOne BuildSelect err",
+			zap.Any("select", lockOneSelectField),
+			zap.Any("where", where),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+	var ret = &Model{}
+	err = tx.FindOne(ctx, ret, cond, vals...)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			logger.Log.Error(ctx, "order lockOne err",
+				zap.String("cond", cond),
+				zap.Any("vals", vals),
+				zap.Error(err),
+			)
+		}
+		return nil, err
+	}
+	return ret, nil
+}
+
 func (i *impl) UpdateOrderStatus(ctx context.Context, orderID string, extend string, status order_model.OrderStatus,
-	remark string) error {
+	remark string, expect order_model.UpdateExpect, canTransition TransitionChecker) error {
 	cond := `update ` + i.tabName + ` set o_status=?`
 	vals := []interface{}{status}
 
@@ -132,98 +269,548 @@ func (i *impl) UpdateOrderStatus(ctx context.Context, orderID string, extend str
 		vals = append(vals, extend)
 	}
 
+	cond += `, remark=?, update_nums=update_nums + 1, forward_nums=0, utime=now() where oid=? limit 1;`
+	vals = append(vals, remark, orderID)
+
+	return client.GetSqlxClient().TransactionX(ctx, func(ctx context.Context, tx sqlx.Txx) error {
+		old, err := i.lockOne(ctx, tx, map[string]interface{}{"oid": orderID})
+		if err != nil {
+			if err == sql.ErrNoRows {
+				logger.Log.Error(ctx, "order updateOrderStatus nums != 1",
+					zap.String("cond", cond),
+					zap.Any("vals", vals),
+					zap.Int64("nums", 0),
+				)
+				return fmt.Errorf("order updateOrderStatus nums!=1 is %v", 0)
+			}
+			return err
+		}
+		if !checkExpect(old, expect) {
+			logger.Log.Warn(ctx, "order updateOrderStatus version conflict",
+				zap.String("orderID", orderID),
+				zap.Uint8("status", old.OrderStatus),
+				zap.Uint32("updateNums", old.UpdateNums),
+				zap.Any("expect", expect),
+			)
+			return ErrVersionConflict
+		}
+		orderType := order_model.OrderType(old.OrderType)
+		oldStatus := order_model.OrderStatus(old.OrderStatus)
+		if canTransition != nil && !canTransition(orderType, oldStatus, status) {
+			logger.Log.Warn(ctx, "order updateOrderStatus transition not allowed",
+				zap.String("orderID", orderID),
+				zap.Int16("orderType", old.OrderType),
+				zap.Uint8("from", old.OrderStatus),
+				zap.Uint8("to", byte(status)),
+			)
+			return ErrStatusTransition
+		}
+
+		result, err := tx.Exec(ctx, cond, vals...)
+		if err != nil {
+			logger.Log.Error(ctx, "order updateOrderStatus err",
+				zap.String("cond", cond),
+				zap.Any("vals", vals),
+				zap.Error(err),
+			)
+			return err
+		}
+
+		nums, err := result.RowsAffected()
+		if err != nil {
+			logger.Log.Error(ctx, "order updateOrderStatus get RowsAffected err",
+				zap.String("cond", cond),
+				zap.Any("vals", vals),
+				zap.Error(err),
+			)
+			return err
+		}
+		if nums != 1 {
+			logger.Log.Error(ctx, "order updateOrderStatus nums != 1",
+				zap.String("cond", cond),
+				zap.Any("vals", vals),
+				zap.Int64("nums", nums),
+			)
+			return fmt.Errorf("order updateOrderStatus nums!=1 is %v", nums)
+		}
+
+		if extend == "" {
+			extend = old.Extend
+		}
+		err = i.syncMirror(ctx, tx, orderID)
+		if err != nil {
+			return err
+		}
+		return i.createLog(ctx, tx, &LogModel{
+			OrderID:        orderID,
+			Uid:            i.uid,
+			LogType:        byte(order_model.OrderLogType_Status),
+			OldOrderStatus: old.OrderStatus,
+			NewOrderStatus: byte(status),
+			OldPayStatus:   old.PayStatus,
+			NewPayStatus:   old.PayStatus,
+			Extend:         extend,
+			Remark:         remark,
+		})
+	})
+}
+
+func (i *impl) SetPayStatus(ctx context.Context, orderID, thirdPayOid string, payStatus byte, remark string,
+	expect order_model.UpdateExpect) error {
+	where := map[string]interface{}{}
+	if orderID != "" {
+		where["oid"] = orderID
+	} else if thirdPayOid != "" {
+		where["third_pay_oid"] = thirdPayOid
+	} else {
+		logger.Log.Error(ctx, "order SetPayStatus args err. orderID and thirdPayOid is empty")
+		return errors.New("order SetPayStatus args err. orderID and thirdPayOid is empty")
+	}
+	return i.updatePay(ctx, where, nil, payStatus, remark, expect)
+}
+
+func (i *impl) SetPayLegs(ctx context.Context, orderID string, payLegs string, payStatus byte, remark string) error {
+	where := map[string]interface{}{
+		"oid": orderID,
+	}
+	return i.updatePay(ctx, where, &payLegs, payStatus, remark, order_model.UpdateExpect{})
+}
+
+// 更新支付数据, payLegs 为 nil 时不会更新支付项
+func (i *impl) updatePay(ctx context.Context, where map[string]interface{}, payLegs *string, payStatus byte,
+	remark string, expect order_model.UpdateExpect) error {
+	return client.GetSqlxClient().TransactionX(ctx, func(ctx context.Context, tx sqlx.Txx) error {
+		old, err := i.lockOne(ctx, tx, where)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				logger.Log.Error(ctx, "order updatePay nums != 1",
+					zap.Any("where", where),
+					zap.Int64("nums", 0),
+				)
+				return fmt.Errorf("order updatePay nums!=1 is %v", 0)
+			}
+			return err
+		}
+		if !checkExpect(old, expect) {
+			logger.Log.Warn(ctx, "order updatePay version conflict",
+				zap.Any("where", where),
+				zap.Uint8("status", old.OrderStatus),
+				zap.Uint32("updateNums", old.UpdateNums),
+				zap.Any("expect", expect),
+			)
+			return ErrVersionConflict
+		}
+
+		cond := `update ` + i.tabName + ` set pay_status=?`
+		vals := []interface{}{payStatus}
+		if payLegs != nil {
+			cond += `, pay_legs=?`
+			vals = append(vals, *payLegs)
+		}
+		cond += `, remark=?, update_nums=update_nums + 1, utime=now() where oid=? limit 1;`
+		vals = append(vals, remark, old.OrderID)
+
+		result, err := tx.Exec(ctx, cond, vals...)
+		if err != nil {
+			logger.Log.Error(ctx, "order updatePay err",
+				zap.String("cond", cond),
+				zap.Any("vals", vals),
+				zap.Error(err),
+			)
+			return err
+		}
+
+		nums, err := result.RowsAffected()
+		if err != nil {
+			logger.Log.Error(ctx, "order updatePay get RowsAffected err",
+				zap.String("cond", cond),
+				zap.Any("vals", vals),
+				zap.Error(err),
+			)
+			return err
+		}
+		if nums != 1 {
+			logger.Log.Error(ctx, "order updatePay nums != 1",
+				zap.String("cond", cond),
+				zap.Any("vals", vals),
+				zap.Int64("nums", nums),
+			)
+			return fmt.Errorf("order updatePay nums!=1 is %v", nums)
+		}
+
+		err = i.syncMirror(ctx, tx, old.OrderID)
+		if err != nil {
+			return err
+		}
+		return i.createLog(ctx, tx, &LogModel{
+			OrderID:        old.OrderID,
+			Uid:            i.uid,
+			LogType:        byte(order_model.OrderLogType_PayStatus),
+			OldOrderStatus: old.OrderStatus,
+			NewOrderStatus: old.OrderStatus,
+			OldPayStatus:   old.PayStatus,
+			NewPayStatus:   payStatus,
+			Extend:         old.Extend,
+			Remark:         remark,
+		})
+	})
+}
+
+func (i *impl) SetRefund(ctx context.Context, orderID string, refundAmount uint32, payLegs string,
+	status order_model.OrderStatus, remark string, expect order_model.UpdateExpect, canTransition TransitionChecker) error {
+	cond := `update ` + i.tabName + ` set refund_amount=?, o_status=?`
+	vals := []interface{}{refundAmount, status}
+	if payLegs != "" {
+		cond += `, pay_legs=?`
+		vals = append(vals, payLegs)
+	}
 	cond += `, remark=?, update_nums=update_nums + 1, utime=now() where oid=? limit 1;`
 	vals = append(vals, remark, orderID)
 
-	result, err := client.GetSqlxClient().Exec(ctx, cond, vals...)
+	return client.GetSqlxClient().TransactionX(ctx, func(ctx context.Context, tx sqlx.Txx) error {
+		old, err := i.lockOne(ctx, tx, map[string]interface{}{"oid": orderID})
+		if err != nil {
+			if err == sql.ErrNoRows {
+				logger.Log.Error(ctx, "order SetRefund nums != 1",
+					zap.String("cond", cond),
+					zap.Any("vals", vals),
+					zap.Int64("nums", 0),
+				)
+				return fmt.Errorf("order SetRefund nums!=1 is %v", 0)
+			}
+			return err
+		}
+		if !checkExpect(old, expect) {
+			logger.Log.Warn(ctx, "order SetRefund version conflict",
+				zap.String("orderID", orderID),
+				zap.Uint8("status", old.OrderStatus),
+				zap.Uint32("updateNums", old.UpdateNums),
+				zap.Any("expect", expect),
+			)
+			return ErrVersionConflict
+		}
+		orderType := order_model.OrderType(old.OrderType)
+		oldStatus := order_model.OrderStatus(old.OrderStatus)
+		if oldStatus != status && canTransition != nil && !canTransition(orderType, oldStatus, status) {
+			logger.Log.Warn(ctx, "order SetRefund transition not allowed",
+				zap.String("orderID", orderID),
+				zap.Int16("orderType", old.OrderType),
+				zap.Uint8("from", old.OrderStatus),
+				zap.Uint8("to", byte(status)),
+			)
+			return ErrStatusTransition
+		}
+
+		result, err := tx.Exec(ctx, cond, vals...)
+		if err != nil {
+			logger.Log.Error(ctx, "order SetRefund err",
+				zap.String("cond", cond),
+				zap.Any("vals", vals),
+				zap.Error(err),
+			)
+			return err
+		}
+
+		nums, err := result.RowsAffected()
+		if err != nil {
+			logger.Log.Error(ctx, "order SetRefund get RowsAffected err",
+				zap.String("cond", cond),
+				zap.Any("vals", vals),
+				zap.Error(err),
+			)
+			return err
+		}
+		if nums != 1 {
+			logger.Log.Error(ctx, "order SetRefund nums != 1",
+				zap.String("cond", cond),
+				zap.Any("vals", vals),
+				zap.Int64("nums", nums),
+			)
+			return fmt.Errorf("order SetRefund nums!=1 is %v", nums)
+		}
+
+		err = i.syncMirror(ctx, tx, orderID)
+		if err != nil {
+			return err
+		}
+		return i.createLog(ctx, tx, &LogModel{
+			OrderID:        orderID,
+			Uid:            i.uid,
+			LogType:        byte(order_model.OrderLogType_Refund),
+			OldOrderStatus: old.OrderStatus,
+			NewOrderStatus: byte(status),
+			OldPayStatus:   old.PayStatus,
+			NewPayStatus:   old.PayStatus,
+			Extend:         old.Extend,
+			Remark:         remark,
+		})
+	})
+}
+
+func (i *impl) IncrForwardNums(ctx context.Context, orderID string) (uint32, int64, error) {
+	cond := `update ` + i.tabName + ` set forward_nums=forward_nums + 1 where oid=? limit 1;`
+	vals := []interface{}{orderID}
+
+	var ret = &Model{}
+	err := client.GetSqlxClient().TransactionX(ctx, func(ctx context.Context, tx sqlx.Txx) error {
+		_, err := tx.Exec(ctx, cond, vals...)
+		if err != nil {
+			logger.Log.Error(ctx, "order IncrForwardNums err",
+				zap.String("cond", cond),
+				zap.Any("vals", vals),
+				zap.Error(err),
+			)
+			return err
+		}
+
+		query := `select forward_nums, unix_timestamp(ctime) as ctime from ` + i.tabName + ` where oid=? limit 1;`
+		err = tx.FindOne(ctx, ret, query, orderID)
+		if err != nil {
+			logger.Log.Error(ctx, "order IncrForwardNums get forward_nums err",
+				zap.String("query", query),
+				zap.String("orderID", orderID),
+				zap.Error(err),
+			)
+			return err
+		}
+		return i.syncMirror(ctx, tx, orderID)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return ret.ForwardNums, ret.Ctime, nil
+}
+
+var listSelectField = append([]string{"oid", "uid"}, getOneSelectField...)
+
+func (i *impl) ListByStatus(ctx context.Context, status order_model.OrderStatus, startID uint, limit uint) ([]*Model, error) {
+	where := map[string]interface{}{
+		"o_status": status,
+		"id >":     startID,
+		"_orderby": "id asc",
+		"_limit":   []uint{limit},
+	}
+	cond, vals, err := builder.BuildSelect(i.tabName, where, listSelectField)
+	if err != nil {
+		logger.Log.Error(ctx, "order ListByStatus BuildSelect err",
+			zap.Any("select", listSelectField),
+			zap.Any("where", where),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+	var ret []*Model
+	err = client.GetSqlxClient().Find(ctx, &ret, cond, vals...)
 	if err != nil {
-		logger.Log.Error(ctx, "order updateOrderStatus err",
+		logger.Log.Error(ctx, "order ListByStatus err",
 			zap.String("cond", cond),
 			zap.Any("vals", vals),
 			zap.Error(err),
 		)
-		return err
+		return nil, err
 	}
+	return ret, nil
+}
 
-	nums, err := result.RowsAffected()
+func (i *impl) ListByStatusBefore(ctx context.Context, status order_model.OrderStatus, utime time.Time,
+	startID uint, limit uint) ([]*Model, error) {
+	where := map[string]interface{}{
+		"o_status": status,
+		"utime <":  utime,
+		"id >":     startID,
+		"_orderby": "id asc",
+		"_limit":   []uint{limit},
+	}
+	cond, vals, err := builder.BuildSelect(i.tabName, where, listSelectField)
 	if err != nil {
-		logger.Log.Error(ctx, "order updateOrderStatus get RowsAffected err",
-			zap.String("cond", cond),
-			zap.Any("vals", vals),
+		logger.Log.Error(ctx, "order ListByStatusBefore BuildSelect err",
+			zap.Any("select", listSelectField),
+			zap.Any("where", where),
 			zap.Error(err),
 		)
-		return err
+		return nil, err
 	}
-	if nums != 1 {
-		logger.Log.Error(ctx, "order updateOrderStatus nums != 1",
+	var ret []*Model
+	err = client.GetSqlxClient().Find(ctx, &ret, cond, vals...)
+	if err != nil {
+		logger.Log.Error(ctx, "order ListByStatusBefore err",
 			zap.String("cond", cond),
 			zap.Any("vals", vals),
-			zap.Int64("nums", nums),
+			zap.Error(err),
 		)
-		return fmt.Errorf("order updateOrderStatus nums!=1 is %v", nums)
+		return nil, err
 	}
-	return nil
+	return ret, nil
 }
 
-func (i *impl) SetPayStatus(ctx context.Context, orderID, thirdPayOid string, payStatus byte, remark string) error {
-	cond := `update ` + i.tabName + ` set pay_status=?, remark=?, update_nums=update_nums + 1, utime=now() where `
-	vals := []interface{}{payStatus, remark}
-	if orderID != "" {
-		cond += `oid=? limit 1;`
-		vals = append(vals, orderID)
-	} else if thirdPayOid != "" {
-		cond += `third_pay_oid=? limit 1;`
-		vals = append(vals, thirdPayOid)
-	} else {
-		logger.Log.Error(ctx, "order SetPayStatus args err. orderID and thirdPayOid is empty")
-		return errors.New("order SetPayStatus args err. orderID and thirdPayOid is empty")
+func (i *impl) ListByUid(ctx context.Context, filter *order_model.UserOrderFilter) ([]*Model, error) {
+	where := i.listByUidWhere(filter)
+	cond, vals, err := builder.BuildSelect(i.tabName, where, listSelectField)
+	if err != nil {
+		logger.Log.Error(ctx, "order ListByUid BuildSelect err",
+			zap.Any("select", listSelectField),
+			zap.Any("where", where),
+			zap.Error(err),
+		)
+		return nil, err
 	}
-
-	result, err := client.GetSqlxClient().Exec(ctx, cond, vals...)
+	var ret []*Model
+	err = client.GetSqlxClient().Find(ctx, &ret, cond, vals...)
 	if err != nil {
-		logger.Log.Error(ctx, "order SetPayStatus err",
+		logger.Log.Error(ctx, "order ListByUid err",
 			zap.String("cond", cond),
 			zap.Any("vals", vals),
 			zap.Error(err),
 		)
-		return err
+		return nil, err
+	}
+	return ret, nil
+}
+
+// 用户订单查询条件
+func (i *impl) listByUidWhere(filter *order_model.UserOrderFilter) map[string]interface{} {
+	where := map[string]interface{}{
+		"uid":      i.uid,
+		"_orderby": "id desc",
+		"_limit":   []uint{uint(filter.Limit)},
+	}
+	if len(filter.OrderTypes) > 0 {
+		in := make([]interface{}, len(filter.OrderTypes))
+		for idx, v := range filter.OrderTypes {
+			in[idx] = v
+		}
+		where["o_type in"] = in
 	}
+	if len(filter.OrderStatus) > 0 {
+		in := make([]interface{}, len(filter.OrderStatus))
+		for idx, v := range filter.OrderStatus {
+			in[idx] = v
+		}
+		where["o_status in"] = in
+	}
+	if filter.PayStatus != nil {
+		where["pay_status"] = *filter.PayStatus
+	}
+	if filter.CtimeStart > 0 {
+		where["ctime >="] = time.Unix(filter.CtimeStart, 0)
+	}
+	if filter.CtimeEnd > 0 {
+		where["ctime <"] = time.Unix(filter.CtimeEnd, 0)
+	}
+	if filter.Cursor > 0 {
+		where["id <"] = filter.Cursor
+	}
+	return where
+}
 
-	nums, err := result.RowsAffected()
+func (i *impl) ListExpired(ctx context.Context, status order_model.OrderStatus, expireAt int64,
+	startID uint, limit uint) ([]*Model, error) {
+	where := map[string]interface{}{
+		"o_status":     status,
+		"expire_at >":  0,
+		"expire_at <=": expireAt,
+		"id >":         startID,
+		"_orderby":     "id asc",
+		"_limit":       []uint{limit},
+	}
+	cond, vals, err := builder.BuildSelect(i.tabName, where, listSelectField)
 	if err != nil {
-		logger.Log.Error(ctx, "order SetPayStatus get RowsAffected err",
-			zap.String("cond", cond),
-			zap.Any("vals", vals),
+		logger.Log.Error(ctx, "order ListExpired BuildSelect err",
+			zap.Any("select", listSelectField),
+			zap.Any("where", where),
 			zap.Error(err),
 		)
-		return err
+		return nil, err
 	}
-	if nums != 1 {
-		logger.Log.Error(ctx, "order SetPayStatus nums != 1",
+	var ret []*Model
+	err = client.GetSqlxClient().Find(ctx, &ret, cond, vals...)
+	if err != nil {
+		logger.Log.Error(ctx, "order ListExpired err",
 			zap.String("cond", cond),
 			zap.Any("vals", vals),
-			zap.Int64("nums", nums),
+			zap.Error(err),
 		)
-		return fmt.Errorf("order SetPayStatus nums!=1 is %v", nums)
+		return nil, err
 	}
-	return nil
+	return ret, nil
+}
+
+var (
+	// 订单数据不满足乐观锁条件
+	ErrVersionConflict = errors.New("order version conflict")
+	// 订单状态机不允许这个状态变更
+	ErrStatusTransition = errors.New("order status transition not allowed")
+)
+
+// 检查订单类型是否允许状态变更
+type TransitionChecker func(orderType order_model.OrderType, from, to order_model.OrderStatus) bool
+
+// 检查订单数据是否满足乐观锁条件
+func checkExpect(old *Model, expect order_model.UpdateExpect) bool {
+	if expect.Status != 0 && old.OrderStatus != byte(expect.Status) {
+		return false
+	}
+	if expect.Version != nil && old.UpdateNums != *expect.Version {
+		return false
+	}
+	return true
 }
 
 const TableName = "order_"
 
 // RPC 接口
 type RPC interface {
-	CreateOneModel(ctx context.Context, v *Model) (int64, error)
+	/*创建订单
+	  withOutbox 是否在同一个事务中写入待发送的补偿信号
+	*/
+	CreateOneModel(ctx context.Context, v *Model, withOutbox bool) (int64, error)
 	GetOne(ctx context.Context, orderID string) (*Model, error)
+	// 根据第三方支付订单id获取订单
+	GetOneByThirdPayOID(ctx context.Context, thirdPayOid string) (*Model, error)
 
 	/*更新订单状态. 在绝大部分情况下, 更新订单数据只会更新 extend 和 status
 	  extend 如果extend为空字符串则不会更新extend
 	  status 订单状态
 	  remark 备注
+	  expect 乐观锁条件, 不满足时返回 ErrVersionConflict
+	  canTransition 检查是否允许状态变更, 不允许时返回 ErrStatusTransition. 为nil表示不检查
+	*/
+	UpdateOrderStatus(ctx context.Context, orderID string, extend string, status order_model.OrderStatus, remark string,
+		expect order_model.UpdateExpect, canTransition TransitionChecker) error
+	/*设置支付状态
+	  expect 乐观锁条件, 不满足时返回 ErrVersionConflict
 	*/
-	UpdateOrderStatus(ctx context.Context, orderID string, extend string, status order_model.OrderStatus, remark string) error
-	// 设置支付状态
-	SetPayStatus(ctx context.Context, orderID, thirdPayOid string, payStatus byte, remark string) error
+	SetPayStatus(ctx context.Context, orderID, thirdPayOid string, payStatus byte, remark string, expect order_model.UpdateExpect) error
+	// 设置混合支付的支付项和支付状态
+	SetPayLegs(ctx context.Context, orderID string, payLegs string, payStatus byte, remark string) error
+	/*设置退款数据
+	  refundAmount 退款后的已退款金额
+	  payLegs 混合支付的支付项, 为空字符串时不会更新
+	  status 退款后的订单状态
+	  expect 乐观锁条件, 不满足时返回 ErrVersionConflict
+	  canTransition 订单状态变化时检查是否允许状态变更, 不允许时返回 ErrStatusTransition. 为nil表示不检查
+	*/
+	SetRefund(ctx context.Context, orderID string, refundAmount uint32, payLegs string, status order_model.OrderStatus, remark string,
+		expect order_model.UpdateExpect, canTransition TransitionChecker) error
+
+	// 获取订单变动流水, 按变动顺序排列
+	GetLogs(ctx context.Context, orderID string) ([]*LogModel, error)
+
+	// 增加推进失败次数, 返回增加后的推进失败次数和订单创建时间
+	IncrForwardNums(ctx context.Context, orderID string) (forwardNums uint32, ctime int64, err error)
+	// 根据订单状态查询订单, 按id升序, 返回id大于 startID 的最多 limit 条数据
+	ListByStatus(ctx context.Context, status order_model.OrderStatus, startID uint, limit uint) ([]*Model, error)
+	// 根据订单状态查询更新时间早于 utime 的订单, 按id升序, 返回id大于 startID 的最多 limit 条数据
+	ListByStatusBefore(ctx context.Context, status order_model.OrderStatus, utime time.Time, startID uint, limit uint) ([]*Model, error)
+	// 查询用户的订单, 按id降序
+	ListByUid(ctx context.Context, filter *order_model.UserOrderFilter) ([]*Model, error)
+	// 根据订单状态查询过期时间不晚于 expireAt 的订单, 不包含不过期的订单, 按id升序, 返回id大于 startID 的最多 limit 条数据
+	ListExpired(ctx context.Context, status order_model.OrderStatus, expireAt int64, startID uint, limit uint) ([]*Model, error)
+
+	// 查询待发送的补偿信号, 按id升序, 返回id大于 startID 的最多 limit 条数据
+	ListOutbox(ctx context.Context, startID uint, limit uint) ([]*OutboxModel, error)
+	// 删除已发送的补偿信号
+	DeleteOutbox(ctx context.Context, id uint) error
 }
 
 type Model struct {
@@ -236,8 +823,15 @@ type Model struct {
 	PayStatus       byte   `db:"pay_status"`    // 支付状态
 	PayAmount       uint32 `db:"pay_amount"`    // 支付金额, 单位分
 	ThirdPayOrderID string `db:"third_pay_oid"` // 第三方支付订单id
+	PayLegs         string `db:"pay_legs"`      // 混合支付的支付项
+	RefundAmount    uint32 `db:"refund_amount"` // 已退款金额, 单位分
+	ExpireAt        int64  `db:"expire_at"`     // 过期时间, 秒级时间戳, 为0表示不过期
 
 	Uid    string `db:"uid"`    // 唯一标识一个用户
 	Extend string `db:"extend"` // 和o_type相关的数据
 	Remark string `db:"remark"` // 备注
+
+	UpdateNums  uint32 `db:"update_nums"`  // 更新次数, 用作订单版本号
+	ForwardNums uint32 `db:"forward_nums"` // 当前状态下推进失败次数
+	Ctime       int64  `db:"ctime"`        // 创建时间, 秒级时间戳
 }
@@ -0,0 +1,80 @@
+package dao
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/didi/gendry/builder"
+
+	"github.com/zlyuancn/order/order_model"
+)
+
+func TestCheckExpect(t *testing.T) {
+	version := uint32(3)
+	otherVersion := uint32(4)
+	old := &Model{OrderStatus: byte(order_model.OrderStatus_Forwarding), UpdateNums: version}
+
+	tests := []struct {
+		name   string
+		expect order_model.UpdateExpect
+		want   bool
+	}{
+		{"zero", order_model.UpdateExpect{}, true},
+		{"status match", order_model.UpdateExpect{Status: order_model.OrderStatus_Forwarding}, true},
+		{"status mismatch", order_model.UpdateExpect{Status: order_model.OrderStatus_InsufficientBalance}, false},
+		{"version match", order_model.UpdateExpect{Version: &version}, true},
+		{"version mismatch", order_model.UpdateExpect{Version: &otherVersion}, false},
+		{"both match", order_model.UpdateExpect{Status: order_model.OrderStatus_Forwarding, Version: &version}, true},
+		{"status match version mismatch", order_model.UpdateExpect{Status: order_model.OrderStatus_Forwarding, Version: &otherVersion}, false},
+		{"status mismatch version match", order_model.UpdateExpect{Status: order_model.OrderStatus_Finish, Version: &version}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkExpect(old, tt.expect); got != tt.want {
+				t.Errorf("checkExpect(%+v) = %v, want %v", tt.expect, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListByUidWhere(t *testing.T) {
+	i := Layout{ShardNums: 2}.newImpl("1", "u1")
+
+	cond, vals, err := builder.BuildSelect(i.tabName, i.listByUidWhere(&order_model.UserOrderFilter{Limit: 10}), listSelectField)
+	if err != nil {
+		t.Fatalf("BuildSelect err: %v", err)
+	}
+	if !strings.HasSuffix(cond, "FROM order_1 WHERE (uid=?) ORDER BY id desc LIMIT ?,?") ||
+		!reflect.DeepEqual(vals, []interface{}{"u1", 0, 10}) {
+		t.Errorf("empty filter cond = %s, vals = %v", cond, vals)
+	}
+
+	payStatus := order_model.OrderPayStatus_Success
+	where := i.listByUidWhere(&order_model.UserOrderFilter{
+		OrderTypes:  []order_model.OrderType{1, 2},
+		OrderStatus: []order_model.OrderStatus{order_model.OrderStatus_Finish},
+		PayStatus:   &payStatus,
+		CtimeStart:  100,
+		CtimeEnd:    200,
+		Cursor:      50,
+		Limit:       10,
+	})
+	want := map[string]interface{}{
+		"o_type in":   []interface{}{order_model.OrderType(1), order_model.OrderType(2)},
+		"o_status in": []interface{}{order_model.OrderStatus_Finish},
+		"pay_status":  payStatus,
+		"ctime >=":    time.Unix(100, 0),
+		"ctime <":     time.Unix(200, 0),
+		"id <":        uint(50),
+	}
+	for k, v := range want {
+		if !reflect.DeepEqual(where[k], v) {
+			t.Errorf("where[%q] = %v, want %v", k, where[k], v)
+		}
+	}
+	if _, _, err = builder.BuildSelect(i.tabName, where, listSelectField); err != nil {
+		t.Errorf("BuildSelect full filter err: %v", err)
+	}
+}
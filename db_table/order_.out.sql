@@ -10,6 +10,9 @@ create table order_0
     pay_status    tinyint unsigned  default 0                                             not null comment '支付状态',
     pay_amount    int unsigned      default 0                                             not null comment '付费金额, 单位分',
     third_pay_oid varchar(128)      default ''                                            not null comment '第三方支付订单id',
+    pay_legs      varchar(2048)     default ''                                            not null comment '混合支付的支付项',
+    refund_amount int unsigned      default 0                                             not null comment '已退款金额, 单位分',
+    expire_at     int unsigned      default 0                                             not null comment '过期时间, 秒级时间戳, 为0表示不过期',
 
     uid           varchar(128)      default ''                                            not null comment '用户唯一标识',
     extend        varchar(8192)     default '{}'                                          not null comment '和o_type相关的数据',
@@ -18,6 +21,7 @@ create table order_0
     ctime         datetime          default current_timestamp                             not null comment '创建时间',
     utime         datetime          default current_timestamp ON UPDATE CURRENT_TIMESTAMP not null comment '更新时间',
     update_nums   int unsigned      default 0                                             not null comment '更新次数, 可防止utime相同时的异常',
+    forward_nums  int unsigned      default 0                                             not null comment '当前状态下推进失败次数',
     constraint oid_index
         unique (oid)
 )
@@ -25,6 +29,9 @@ create table order_0
 
 create index uid_index on order_0 (uid);
 create index third_pay_oid_index on order_0 (third_pay_oid);
+create index o_status_index on order_0 (o_status);
+create index o_status_utime_index on order_0 (o_status, utime);
+create index o_status_expire_at_index on order_0 (o_status, expire_at);
 
 
 create table order_1
@@ -39,6 +46,9 @@ create table order_1
     pay_status    tinyint unsigned  default 0                                             not null comment '支付状态',
     pay_amount    int unsigned      default 0                                             not null comment '付费金额, 单位分',
     third_pay_oid varchar(128)      default ''                                            not null comment '第三方支付订单id',
+    pay_legs      varchar(2048)     default ''                                            not null comment '混合支付的支付项',
+    refund_amount int unsigned      default 0                                             not null comment '已退款金额, 单位分',
+    expire_at     int unsigned      default 0                                             not null comment '过期时间, 秒级时间戳, 为0表示不过期',
 
     uid           varchar(128)      default ''                                            not null comment '用户唯一标识',
     extend        varchar(8192)     default '{}'                                          not null comment '和o_type相关的数据',
@@ -47,6 +57,7 @@ create table order_1
     ctime         datetime          default current_timestamp                             not null comment '创建时间',
     utime         datetime          default current_timestamp ON UPDATE CURRENT_TIMESTAMP not null comment '更新时间',
     update_nums   int unsigned      default 0                                             not null comment '更新次数, 可防止utime相同时的异常',
+    forward_nums  int unsigned      default 0                                             not null comment '当前状态下推进失败次数',
     constraint oid_index
         unique (oid)
 )
@@ -54,5 +65,8 @@ create table order_1
 
 create index uid_index on order_1 (uid);
 create index third_pay_oid_index on order_1 (third_pay_oid);
+create index o_status_index on order_1 (o_status);
+create index o_status_utime_index on order_1 (o_status, utime);
+create index o_status_expire_at_index on order_1 (o_status, expire_at);
 
 
@@ -0,0 +1,9 @@
+create table order_lease
+(
+    lease_key varchar(128)    default ''                                            not null comment '租约key'
+        primary key,
+    expire_at bigint unsigned default 0                                             not null comment '过期时间, 秒级时间戳',
+
+    utime     datetime        default current_timestamp ON UPDATE CURRENT_TIMESTAMP not null comment '更新时间'
+)
+    comment 'mysql锁类型的租约, 用于扫表补偿/关闭过期订单在每个扫描间隔内只由一个实例执行, 不分表';
@@ -0,0 +1,48 @@
+create table order_log_0
+(
+    id             int unsigned auto_increment
+        primary key,
+    oid            varchar(128)     default ''                not null comment '订单id',
+    uid            varchar(128)     default ''                not null comment '用户唯一标识',
+    log_type       tinyint unsigned default 0                 not null comment '流水类型, 1=创建订单, 2=订单状态变更, 3=支付状态变更, 4=退款',
+
+    old_o_status   tinyint unsigned default 0                 not null comment '变更前订单状态',
+    new_o_status   tinyint unsigned default 0                 not null comment '变更后订单状态',
+    old_pay_status tinyint unsigned default 0                 not null comment '变更前支付状态',
+    new_pay_status tinyint unsigned default 0                 not null comment '变更后支付状态',
+
+    extend         varchar(8192)    default '{}'              not null comment '变更后的扩展数据快照',
+    remark         varchar(1024)    default ''                not null comment '备注',
+    caller         varchar(128)     default ''                not null comment '调用方',
+
+    ctime          datetime         default current_timestamp not null comment '创建时间'
+)
+    comment '订单变动流水';
+
+create index oid_index on order_log_0 (oid);
+
+
+create table order_log_1
+(
+    id             int unsigned auto_increment
+        primary key,
+    oid            varchar(128)     default ''                not null comment '订单id',
+    uid            varchar(128)     default ''                not null comment '用户唯一标识',
+    log_type       tinyint unsigned default 0                 not null comment '流水类型, 1=创建订单, 2=订单状态变更, 3=支付状态变更, 4=退款',
+
+    old_o_status   tinyint unsigned default 0                 not null comment '变更前订单状态',
+    new_o_status   tinyint unsigned default 0                 not null comment '变更后订单状态',
+    old_pay_status tinyint unsigned default 0                 not null comment '变更前支付状态',
+    new_pay_status tinyint unsigned default 0                 not null comment '变更后支付状态',
+
+    extend         varchar(8192)    default '{}'              not null comment '变更后的扩展数据快照',
+    remark         varchar(1024)    default ''                not null comment '备注',
+    caller         varchar(128)     default ''                not null comment '调用方',
+
+    ctime          datetime         default current_timestamp not null comment '创建时间'
+)
+    comment '订单变动流水';
+
+create index oid_index on order_log_1 (oid);
+
+
@@ -0,0 +1,15 @@
+create table order_migrate_checkpoint
+(
+    id          int unsigned auto_increment
+        primary key,
+    src_tab     varchar(128)     default ''                                            not null comment '源分表名',
+    dst_version varchar(32)      default ''                                            not null comment '迁移的新分表版本',
+    last_id     int unsigned     default 0                                             not null comment '已复制的最大订单记录id',
+    finished    tinyint unsigned default 0                                             not null comment '是否已复制完成',
+
+    ctime       datetime         default current_timestamp                             not null comment '创建时间',
+    utime       datetime         default current_timestamp ON UPDATE CURRENT_TIMESTAMP not null comment '更新时间',
+    constraint src_tab_dst_version_index
+        unique (src_tab, dst_version)
+)
+    comment '扩容迁移复制存量数据的检查点, 不分表';
@@ -0,0 +1,24 @@
+create table order_outbox_0
+(
+    id    int unsigned auto_increment
+        primary key,
+    oid   varchar(128) default ''                not null comment '订单id',
+    uid   varchar(128) default ''                not null comment '用户唯一标识',
+
+    ctime datetime     default current_timestamp not null comment '创建时间'
+)
+    comment '待发送的订单补偿信号, 发送成功后删除';
+
+
+create table order_outbox_1
+(
+    id    int unsigned auto_increment
+        primary key,
+    oid   varchar(128) default ''                not null comment '订单id',
+    uid   varchar(128) default ''                not null comment '用户唯一标识',
+
+    ctime datetime     default current_timestamp not null comment '创建时间'
+)
+    comment '待发送的订单补偿信号, 发送成功后删除';
+
+
@@ -0,0 +1,30 @@
+create table order_third_pay_oid_0
+(
+    id            int unsigned auto_increment
+        primary key,
+    third_pay_oid varchar(128) default ''                not null comment '第三方支付订单id',
+    oid           varchar(128) default ''                not null comment '订单id',
+    uid           varchar(128) default ''                not null comment '用户唯一标识',
+
+    ctime         datetime     default current_timestamp not null comment '创建时间',
+    constraint third_pay_oid_index
+        unique (third_pay_oid)
+)
+    comment '第三方支付订单id到订单的映射, 按第三方支付订单id分表';
+
+
+create table order_third_pay_oid_1
+(
+    id            int unsigned auto_increment
+        primary key,
+    third_pay_oid varchar(128) default ''                not null comment '第三方支付订单id',
+    oid           varchar(128) default ''                not null comment '订单id',
+    uid           varchar(128) default ''                not null comment '用户唯一标识',
+
+    ctime         datetime     default current_timestamp not null comment '创建时间',
+    constraint third_pay_oid_index
+        unique (third_pay_oid)
+)
+    comment '第三方支付订单id到订单的映射, 按第三方支付订单id分表';
+
+
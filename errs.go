@@ -2,11 +2,45 @@ package order
 
 import (
 	"errors"
+
+	"github.com/zlyuancn/order/dao"
 )
 
 var (
 	// 订单不存在
 	OrderNotFoundErr = errors.New("order not found")
+	// 订单号格式不正确, 无法解析出订单类型和分片
+	OrderIDInvalidErr = errors.New("order id invalid")
+	// 订单号不支持编码为客户订单号
+	OrderCodeUnsupportedErr = errors.New("order id unsupported by order code")
+	// 客户订单号格式不正确或校验失败
+	OrderCodeInvalidErr = errors.New("order code invalid")
 	// 订单业务取消推进
 	OrderBusinessCancelForwardErr = errors.New("order business cancel forward")
+	// 订单在等待外部支付完成, 包括单一支付类型和混合支付的支付项
+	OrderPayNotSettledErr = errors.New("order pay not settled")
+	// Deprecated: 使用 OrderPayNotSettledErr
+	OrderPayLegNotSettledErr = OrderPayNotSettledErr
+	// 订单未支付
+	OrderNotPaidErr = errors.New("order not paid")
+	// 退款金额超过了可退款金额
+	OrderRefundAmountErr = errors.New("order refund amount exceeds refundable amount")
+	// 订单无法向前推进, 已转为需要人工介入
+	OrderUnableToAdvanceErr = errors.New("order unable to advance")
+	// 订单状态不符合操作要求
+	OrderStatusNotMatchErr = errors.New("order status not match")
+	// 订单已过期关闭, 关闭后收到的支付会被退款
+	OrderClosedErr = errors.New("order closed")
+	// 订单已是终态, 不能取消. 终态订单收到的支付项付款会被退款
+	OrderTerminalErr = errors.New("order is terminal")
+	// 已完成支付的支付项不能回退为未支付
+	OrderPayStatusBackwardErr = errors.New("order pay status cannot move backward")
+	// 当前不在扩容迁移中
+	OrderNotMigratingErr = errors.New("order table not migrating")
+	// 订单锁被占用, 订单正在被其它操作处理
+	OrderLockedErr = errors.New("order locked")
+	// 订单数据不满足乐观锁条件, 订单已被其它操作更新
+	OrderVersionConflictErr = dao.ErrVersionConflict
+	// 订单状态机不允许这个状态变更
+	OrderStatusTransitionErr = dao.ErrStatusTransition
 )
@@ -7,9 +7,12 @@ import (
 	"github.com/zly-app/zapp/config"
 	"github.com/zly-app/zapp/core"
 	"github.com/zly-app/zapp/handler"
+	"github.com/zly-app/zapp/logger"
 	"go.uber.org/zap"
 
+	"github.com/zlyuancn/order/client"
 	"github.com/zlyuancn/order/conf"
+	"github.com/zlyuancn/order/metrics"
 	"github.com/zlyuancn/order/mq"
 )
 
@@ -23,13 +26,54 @@ func init() {
 		}
 		conf.Conf.Check()
 	})
+	zapp.AddHandler(zapp.AfterInitializeHandler, func(app core.IApp, handlerType handler.HandlerType) {
+		metrics.Init()
+	})
 	zapp.AddHandler(zapp.AfterMakeService, func(app core.IApp, handlerType handler.HandlerType) {
-		mq.Init(app, func(ctx context.Context, oid, uid string) error {
-			_, _, err := orderApi.forwardOrderID(ctx, oid, uid, true)
-			if err == OrderBusinessCancelForwardErr {
+		mq.Init(app, withMqUid(func(ctx context.Context, oid, uid string) error {
+			_, _, err := orderApi.forwardOrderID(ctx, oid, uid, metrics.ForwardMethod_Mq)
+			if err == OrderBusinessCancelForwardErr || err == OrderUnableToAdvanceErr {
 				return nil
 			}
 			return err
-		})
+		}), withMqUid(orderApi.parkExpiredOrder))
+	})
+	zapp.AddHandler(zapp.AfterStartHandler, func(app core.IApp, handlerType handler.HandlerType) {
+		startDBScan()
+		startOutboxRelay()
+		startAutoClose()
+		startMigrateCopy()
+	})
+	zapp.AddHandler(zapp.BeforeExitHandler, func(app core.IApp, handlerType handler.HandlerType) {
+		stopDBScan()
+		stopOutboxRelay()
+		stopAutoClose()
+		stopMigrateCopy()
 	})
+	zapp.AddHandler(zapp.AfterExitHandler, func(app core.IApp, handlerType handler.HandlerType) {
+		if conf.Conf.MQType == conf.MQType_Kafka {
+			_ = client.CloseKafkaWriter()
+		}
+	})
+}
+
+// 补偿mq消息中uid为空时根据订单号中的分片查找uid, 找不到订单时忽略
+func withMqUid(process mq.CompensationProcess) mq.CompensationProcess {
+	return func(ctx context.Context, oid, uid string) error {
+		if uid == "" {
+			var err error
+			uid, err = orderApi.findUidByOID(ctx, oid)
+			if err == OrderNotFoundErr || err == OrderIDInvalidErr {
+				logger.Log.Warn(ctx, "order mq msg order not found by oid",
+					zap.String("orderID", oid),
+					zap.Error(err),
+				)
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return process(ctx, oid, uid)
+	}
 }
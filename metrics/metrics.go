@@ -0,0 +1,152 @@
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	zapp_metrics "github.com/zly-app/zapp/component/metrics"
+
+	"github.com/zlyuancn/order/order_model"
+)
+
+// 结果标签值
+const (
+	Result_OK     = "ok"
+	Result_Err    = "err"
+	Result_Cancel = "cancel"
+	Result_Retry  = "retry"
+
+	Result_Expired = "expired"
+
+	Result_UnableToAdvance = "unable_to_advance"
+)
+
+// 推进方式标签值
+const (
+	ForwardMethod_Forward        = "Forward"
+	ForwardMethod_ForwardOrderID = "ForwardOrderID"
+	ForwardMethod_Mq             = "mq"
+	ForwardMethod_DBScan         = "db_scan"
+)
+
+// 锁失败原因标签值
+const (
+	LockFail_Locked = "locked"
+	LockFail_Err    = "err"
+)
+
+// 业务回调标签值
+const (
+	Callback_CanForward = "CanForward"
+	Callback_Delivery   = "Delivery"
+)
+
+var defBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var (
+	createCounter     zapp_metrics.ICounter
+	forwardCounter    zapp_metrics.ICounter
+	forwardHistogram  zapp_metrics.IHistogram
+	lockFailCounter   zapp_metrics.ICounter
+	mqSendCounter     zapp_metrics.ICounter
+	mqConsumeCounter  zapp_metrics.ICounter
+	callbackHistogram zapp_metrics.IHistogram
+)
+
+func init() {
+	registry() // 在metrics组件初始化前使用空实现
+}
+
+// 初始化, 需要在metrics组件初始化后调用
+func Init() {
+	registry()
+}
+
+func registry() {
+	createCounter = zapp_metrics.RegistryCounter("order_create_total", "创建订单数",
+		nil, "order_type", "result")
+	forwardCounter = zapp_metrics.RegistryCounter("order_forward_total", "推进订单数",
+		nil, "order_type", "method", "status", "result")
+	forwardHistogram = zapp_metrics.RegistryHistogram("order_forward_duration_seconds", "推进订单耗时",
+		defBuckets, nil, "order_type", "method")
+	lockFailCounter = zapp_metrics.RegistryCounter("order_lock_fail_total", "订单加锁失败数",
+		nil, "reason")
+	mqSendCounter = zapp_metrics.RegistryCounter("order_mq_send_total", "补偿mq发送数",
+		nil, "mq_type", "result")
+	mqConsumeCounter = zapp_metrics.RegistryCounter("order_mq_consume_total", "补偿mq消费数",
+		nil, "mq_type", "result")
+	callbackHistogram = zapp_metrics.RegistryHistogram("order_business_callback_duration_seconds", "业务回调耗时",
+		defBuckets, nil, "order_type", "callback", "result")
+}
+
+func errResult(err error) string {
+	if err != nil {
+		return Result_Err
+	}
+	return Result_OK
+}
+
+func orderTypeLabel(t order_model.OrderType) string {
+	return strconv.Itoa(int(t))
+}
+
+// 上报创建订单
+func ReportCreate(orderType order_model.OrderType, err error) {
+	createCounter.Inc(zapp_metrics.Labels{
+		"order_type": orderTypeLabel(orderType),
+		"result":     errResult(err),
+	}, nil)
+}
+
+/*
+上报推进订单
+
+	orderType 订单类型, 未知时为0
+	method 推进方式
+	status 推进后的订单状态, 失败时为0
+	result 结果
+	startTime 开始推进的时间
+*/
+func ReportForward(orderType order_model.OrderType, method string, status order_model.OrderStatus, result string,
+	startTime time.Time) {
+	forwardCounter.Inc(zapp_metrics.Labels{
+		"order_type": orderTypeLabel(orderType),
+		"method":     method,
+		"status":     strconv.Itoa(int(status)),
+		"result":     result,
+	}, nil)
+	forwardHistogram.Observe(time.Since(startTime).Seconds(), zapp_metrics.Labels{
+		"order_type": orderTypeLabel(orderType),
+		"method":     method,
+	}, nil)
+}
+
+// 上报订单加锁失败
+func ReportLockFail(reason string) {
+	lockFailCounter.Inc(zapp_metrics.Labels{"reason": reason}, nil)
+}
+
+// 上报补偿mq发送
+func ReportMqSend(mqType string, err error) {
+	mqSendCounter.Inc(zapp_metrics.Labels{
+		"mq_type": mqType,
+		"result":  errResult(err),
+	}, nil)
+}
+
+// 上报补偿mq消费
+func ReportMqConsume(mqType string, result string) {
+	mqConsumeCounter.Inc(zapp_metrics.Labels{
+		"mq_type": mqType,
+		"result":  result,
+	}, nil)
+}
+
+// 上报业务回调耗时
+func ReportCallback(orderType order_model.OrderType, callback string, startTime time.Time, err error) {
+	callbackHistogram.Observe(time.Since(startTime).Seconds(), zapp_metrics.Labels{
+		"order_type": orderTypeLabel(orderType),
+		"callback":   callback,
+		"result":     errResult(err),
+	}, nil)
+}
@@ -0,0 +1,29 @@
+package metrics
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLabels(t *testing.T) {
+	if got := errResult(nil); got != Result_OK {
+		t.Errorf("errResult(nil) = %q, want %q", got, Result_OK)
+	}
+	if got := errResult(errors.New("x")); got != Result_Err {
+		t.Errorf("errResult(err) = %q, want %q", got, Result_Err)
+	}
+	if got := orderTypeLabel(12); got != "12" {
+		t.Errorf("orderTypeLabel(12) = %q, want 12", got)
+	}
+}
+
+// metrics组件初始化前上报使用空实现, 不会panic
+func TestReportBeforeInit(t *testing.T) {
+	ReportCreate(1, nil)
+	ReportForward(1, ForwardMethod_Forward, 2, Result_OK, time.Now())
+	ReportLockFail(LockFail_Locked)
+	ReportMqSend("redis", errors.New("x"))
+	ReportMqConsume("redis", Result_Retry)
+	ReportCallback(1, Callback_CanForward, time.Now(), nil)
+}
@@ -14,6 +14,7 @@ import (
 
 	"github.com/zlyuancn/order/client"
 	"github.com/zlyuancn/order/conf"
+	"github.com/zlyuancn/order/metrics"
 	"github.com/zlyuancn/order/order_model"
 )
 
@@ -21,21 +22,33 @@ type CompensationProcess func(ctx context.Context, oid, uid string) error
 
 var defCompensationProcess CompensationProcess
 
-func Init(app core.IApp, compensationProcess CompensationProcess) {
+// mq消息存活超过 CompensationMQMsgLifeTime 后补偿失败的处理
+var defExpiredProcess CompensationProcess
+
+func Init(app core.IApp, compensationProcess, expiredProcess CompensationProcess) {
 	if !conf.Conf.AllowMqCompensation {
 		return
 	}
 
 	defCompensationProcess = compensationProcess
+	defExpiredProcess = expiredProcess
 	switch conf.Conf.MQType {
 	case conf.MQType_Pulsar:
 		pulsar_consume.RegistryHandler(conf.Conf.MQConsumeName, func(ctx context.Context, msg pulsar_consume.Message) error {
 			return consumeProcess(ctx, msg.Payload(), msg.PublishTime())
 		})
+	case conf.MQType_Kafka: // 由 KafkaConsumeServiceType 服务消费
+	case conf.MQType_Redis: // 由 RedisConsumeServiceType 服务消费
 	}
 }
 
 func Send(ctx context.Context, msg *order_model.OrderMqMsg) error {
+	err := send(ctx, msg)
+	metrics.ReportMqSend(conf.Conf.MQType, err)
+	return err
+}
+
+func send(ctx context.Context, msg *order_model.OrderMqMsg) error {
 	payload, err := sonic.Marshal(msg)
 	if err != nil {
 		return err
@@ -49,6 +62,10 @@ func Send(ctx context.Context, msg *order_model.OrderMqMsg) error {
 		}
 		_, err = client.GetPulsarProducer().Send(ctx, msg)
 		return err
+	case conf.MQType_Kafka:
+		return sendKafka(ctx, msg.OrderID, payload, time.Now())
+	case conf.MQType_Redis:
+		return sendRedis(ctx, payload, time.Now())
 	}
 
 	logger.Log.Error(ctx, "order config err. Unsupported MQType", zap.String("MQType", conf.Conf.MQType))
@@ -63,6 +80,7 @@ func consumeProcess(ctx context.Context, payload []byte, msgProductionTime time.
 			zap.String("payload", string(payload)),
 			zap.Error(err),
 		)
+		metrics.ReportMqConsume(conf.Conf.MQType, metrics.Result_Err)
 		return nil // 无论如何重试也不可能成功了
 	}
 
@@ -70,18 +88,63 @@ func consumeProcess(ctx context.Context, payload []byte, msgProductionTime time.
 		logger.Log.Error(ctx, "Order consumeProcess OrderID is empty",
 			zap.Any("orderMsg", orderMsg),
 		)
+		metrics.ReportMqConsume(conf.Conf.MQType, metrics.Result_Err)
 		return nil
 	}
 
 	// 开始推进
 	err = defCompensationProcess(ctx, orderMsg.OrderID, orderMsg.Uid)
 	if err == nil {
+		metrics.ReportMqConsume(conf.Conf.MQType, metrics.Result_OK)
+		return nil
+	}
+
+	// 消息存活时间过长, 不再重试
+	lifeTime := time.Since(msgProductionTime)
+	if msgExpired(lifeTime) {
+		logger.Log.Warn(ctx, "Order consumeProcess err and msg expired, stop retry",
+			zap.Any("orderMsg", orderMsg),
+			zap.Time("msgProductionTime", msgProductionTime),
+			zap.Duration("lifeTime", lifeTime),
+			zap.Error(err),
+		)
+		metrics.ReportMqConsume(conf.Conf.MQType, metrics.Result_Expired)
+		err = defExpiredProcess(ctx, orderMsg.OrderID, orderMsg.Uid)
+		if err != nil {
+			logger.Log.Error(ctx, "Order consumeProcess call expiredProcess err",
+				zap.Any("orderMsg", orderMsg),
+				zap.Error(err),
+			)
+			return err
+		}
 		return nil
 	}
 
+	metrics.ReportMqConsume(conf.Conf.MQType, metrics.Result_Retry)
+
 	logger.Log.Error(ctx, "Order consumeProcess err",
 		zap.Any("orderMsg", orderMsg),
 		zap.Error(err),
 	)
 	return err
 }
+
+// 消息存活时间是否超过 CompensationMQMsgLifeTime, 为0时不限制
+func msgExpired(lifeTime time.Duration) bool {
+	return conf.Conf.CompensationMQMsgLifeTime > 0 && lifeTime > time.Duration(conf.Conf.CompensationMQMsgLifeTime)*time.Second
+}
+
+// 等待一段时间, 返回false表示ctx已结束
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
@@ -0,0 +1,23 @@
+package mq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zlyuancn/order/conf"
+)
+
+func TestMsgExpired(t *testing.T) {
+	conf.Conf.CompensationMQMsgLifeTime = 60
+	if msgExpired(time.Minute) {
+		t.Error("msg within life time is expired")
+	}
+	if !msgExpired(time.Minute + time.Second) {
+		t.Error("msg exceeding life time is not expired")
+	}
+
+	conf.Conf.CompensationMQMsgLifeTime = 0
+	if msgExpired(24 * time.Hour * 365) {
+		t.Error("msg expired when life time is unlimited")
+	}
+}
@@ -0,0 +1,179 @@
+package mq
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/zly-app/zapp/core"
+	"github.com/zly-app/zapp/logger"
+	"github.com/zly-app/zapp/service"
+	"go.uber.org/zap"
+
+	"github.com/zlyuancn/order/client"
+	"github.com/zlyuancn/order/conf"
+)
+
+// kafka补偿消费服务类型
+const KafkaConsumeServiceType core.ServiceType = "order-kafka-consume"
+
+const (
+	kafkaHeader_DeliverAt  = "order-deliver-at" // 消息最早可以被消费的时间, 毫秒级时间戳
+	kafkaHeader_ProduceAt  = "order-produce-at" // 消息首次生产的时间, 毫秒级时间戳, 重试时保持不变
+	kafkaRetryProduceDelay = time.Second        // 重新投递失败后的等待时间
+	kafkaFetchErrDelay     = time.Second        // 拉取消息失败后的等待时间
+)
+
+func init() {
+	service.RegisterCreatorFunc(KafkaConsumeServiceType, func(app core.IApp) core.IService {
+		return newKafkaConsumeService(app)
+	})
+}
+
+/*
+发送kafka补偿消息
+
+kafka不支持延迟消息, 这里将消息可被消费的时间写入header, 由消费者等待到这个时间后再处理.
+由于同一个topic的补偿消息延迟时间相同, 分区内消息的可消费时间是递增的, 所以等待队首消息不会耽误后面的消息.
+
+	produceAt 消息首次生产的时间, 用于判断消息存活时间
+*/
+func sendKafka(ctx context.Context, key string, payload []byte, produceAt time.Time) error {
+	deliverAt := time.Now().Add(time.Duration(conf.Conf.CompensationDelayTime) * time.Second)
+	return client.GetKafkaWriter().WriteMessages(ctx, newKafkaMessage(key, payload, deliverAt, produceAt))
+}
+
+// 生成kafka补偿消息, 可被消费的时间和首次生产的时间写入header
+func newKafkaMessage(key string, payload []byte, deliverAt, produceAt time.Time) kafka.Message {
+	return kafka.Message{
+		Key:   []byte(key),
+		Value: payload,
+		Headers: []kafka.Header{
+			{Key: kafkaHeader_DeliverAt, Value: []byte(strconv.FormatInt(deliverAt.UnixMilli(), 10))},
+			{Key: kafkaHeader_ProduceAt, Value: []byte(strconv.FormatInt(produceAt.UnixMilli(), 10))},
+		},
+	}
+}
+
+// 从header中获取毫秒级时间, 不存在或无法解析时返回默认值
+func getKafkaHeaderTime(msg *kafka.Message, key string, def time.Time) time.Time {
+	for _, h := range msg.Headers {
+		if h.Key != key {
+			continue
+		}
+		ms, err := strconv.ParseInt(string(h.Value), 10, 64)
+		if err != nil {
+			return def
+		}
+		return time.UnixMilli(ms)
+	}
+	return def
+}
+
+// kafka补偿消费服务
+type kafkaConsumeService struct {
+	app     core.IApp
+	ctx     context.Context
+	cancel  context.CancelFunc
+	readers []*kafka.Reader
+	wg      sync.WaitGroup
+}
+
+func newKafkaConsumeService(app core.IApp) core.IService {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &kafkaConsumeService{
+		app:    app,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+func (s *kafkaConsumeService) Inject(a ...interface{}) {}
+
+func (s *kafkaConsumeService) Start() error {
+	for i := 0; i < conf.Conf.KafkaConsumeThreadCount; i++ {
+		reader := kafka.NewReader(kafka.ReaderConfig{
+			Brokers: client.GetKafkaBrokers(),
+			GroupID: conf.Conf.KafkaConsumeGroup,
+			Topic:   conf.Conf.KafkaTopic,
+		})
+		s.readers = append(s.readers, reader)
+
+		s.wg.Add(1)
+		go func(reader *kafka.Reader) {
+			defer s.wg.Done()
+			s.consume(reader)
+		}(reader)
+	}
+	return nil
+}
+
+func (s *kafkaConsumeService) Close() error {
+	s.cancel()
+	s.wg.Wait()
+	for _, reader := range s.readers {
+		_ = reader.Close()
+	}
+	return nil
+}
+
+func (s *kafkaConsumeService) consume(reader *kafka.Reader) {
+	for {
+		msg, err := reader.FetchMessage(s.ctx)
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return
+			}
+			logger.Log.Error(s.ctx, "Order kafka FetchMessage err", zap.Error(err))
+			if !sleepCtx(s.ctx, kafkaFetchErrDelay) {
+				return
+			}
+			continue
+		}
+
+		if !s.process(&msg) {
+			return // 服务关闭, 未提交的消息会在重启后重新消费
+		}
+
+		err = reader.CommitMessages(s.ctx, msg)
+		if err != nil && s.ctx.Err() == nil {
+			logger.Log.Error(s.ctx, "Order kafka CommitMessages err",
+				zap.Int("partition", msg.Partition),
+				zap.Int64("offset", msg.Offset),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+// 处理消息, 返回false表示服务已关闭, 消息未处理完毕
+func (s *kafkaConsumeService) process(msg *kafka.Message) bool {
+	deliverAt := getKafkaHeaderTime(msg, kafkaHeader_DeliverAt, msg.Time)
+	if !sleepCtx(s.ctx, time.Until(deliverAt)) {
+		return false
+	}
+
+	ctx := context.Background()
+	produceAt := getKafkaHeaderTime(msg, kafkaHeader_ProduceAt, msg.Time)
+	err := consumeProcess(ctx, msg.Value, produceAt)
+	if err == nil {
+		return true
+	}
+
+	// kafka不支持nack, 重新投递一条延迟消息用于重试
+	for {
+		err = sendKafka(ctx, string(msg.Key), msg.Value, produceAt)
+		if err == nil {
+			return true
+		}
+		logger.Log.Error(ctx, "Order kafka resend msg for retry err",
+			zap.String("payload", string(msg.Value)),
+			zap.Error(err),
+		)
+		if !sleepCtx(s.ctx, kafkaRetryProduceDelay) {
+			return false
+		}
+	}
+}
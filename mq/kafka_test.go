@@ -0,0 +1,53 @@
+package mq
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestKafkaHeaderTime(t *testing.T) {
+	deliverAt := time.UnixMilli(1700000001234)
+	produceAt := time.UnixMilli(1700000000000)
+	msg := newKafkaMessage("o1", []byte("payload"), deliverAt, produceAt)
+	if string(msg.Key) != "o1" || string(msg.Value) != "payload" {
+		t.Errorf("msg key = %q, value = %q", msg.Key, msg.Value)
+	}
+
+	def := time.UnixMilli(1)
+	if got := getKafkaHeaderTime(&msg, kafkaHeader_DeliverAt, def); !got.Equal(deliverAt) {
+		t.Errorf("deliverAt = %v, want %v", got, deliverAt)
+	}
+	if got := getKafkaHeaderTime(&msg, kafkaHeader_ProduceAt, def); !got.Equal(produceAt) {
+		t.Errorf("produceAt = %v, want %v", got, produceAt)
+	}
+
+	// 没有header或无法解析时使用默认值, 如其它生产者写入的消息
+	if got := getKafkaHeaderTime(&kafka.Message{}, kafkaHeader_DeliverAt, def); !got.Equal(def) {
+		t.Errorf("missing header = %v, want default", got)
+	}
+	invalid := &kafka.Message{Headers: []kafka.Header{{Key: kafkaHeader_DeliverAt, Value: []byte("x")}}}
+	if got := getKafkaHeaderTime(invalid, kafkaHeader_DeliverAt, def); !got.Equal(def) {
+		t.Errorf("invalid header = %v, want default", got)
+	}
+}
+
+func TestSleepCtx(t *testing.T) {
+	if !sleepCtx(context.Background(), 0) {
+		t.Error("sleepCtx without wait = false, want true")
+	}
+	if !sleepCtx(context.Background(), time.Millisecond) {
+		t.Error("sleepCtx = false, want true")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if sleepCtx(ctx, time.Hour) {
+		t.Error("sleepCtx with done ctx = true, want false")
+	}
+	if sleepCtx(ctx, 0) {
+		t.Error("sleepCtx without wait with done ctx = true, want false")
+	}
+}
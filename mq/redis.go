@@ -0,0 +1,261 @@
+package mq
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/redis/go-redis/v9"
+	"github.com/zly-app/zapp/core"
+	"github.com/zly-app/zapp/logger"
+	"github.com/zly-app/zapp/service"
+	"go.uber.org/zap"
+
+	"github.com/zlyuancn/order/client"
+	"github.com/zlyuancn/order/conf"
+)
+
+// redis补偿消费服务类型
+const RedisConsumeServiceType core.ServiceType = "order-redis-consume"
+
+const (
+	redisStreamField_Msg = "msg" // stream消息中保存补偿消息的字段
+
+	redisMoveInterval  = time.Second     // 将到期消息从延迟队列移动到stream的间隔
+	redisMoveBatchSize = 100             // 每次从延迟队列移动的消息数
+	redisReadBlock     = time.Second     // 读取stream的阻塞时间
+	redisReadCount     = 10              // 每次读取stream的消息数
+	redisClaimInterval = time.Minute     // 认领其它消费者未确认消息的间隔
+	redisClaimMinIdle  = 5 * time.Minute // 消息超过这个时间未确认才会被认领
+	redisErrDelay      = time.Second     // 操作redis失败后的等待时间
+	redisMoveScript    = `
+local items = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, v in ipairs(items) do
+	redis.call('XADD', KEYS[2], '*', ARGV[3], v)
+	redis.call('ZREM', KEYS[1], v)
+end
+return #items
+`
+)
+
+func init() {
+	service.RegisterCreatorFunc(RedisConsumeServiceType, func(app core.IApp) core.IService {
+		return newRedisConsumeService(app)
+	})
+}
+
+// 延迟队列中的消息, 带上序号避免相同内容的消息在有序集合中被去重
+type redisMQMsg struct {
+	Payload   string `json:"p"`
+	ProduceAt int64  `json:"t"` // 消息首次生产的时间, 毫秒级时间戳, 重试时保持不变
+	Seq       string `json:"s"`
+}
+
+var redisMsgSeq uint64
+
+/*
+发送redis补偿消息
+
+消息先写入延迟有序集合, score为可被消费的时间, 到期后由消费服务原子的移动到stream中, 再通过消费组消费.
+
+	produceAt 消息首次生产的时间, 用于判断消息存活时间
+*/
+func sendRedis(ctx context.Context, payload []byte, produceAt time.Time) error {
+	deliverAt := time.Now().Add(time.Duration(conf.Conf.CompensationDelayTime) * time.Second)
+	seq := strconv.FormatInt(time.Now().UnixNano(), 36) + "." + strconv.FormatUint(atomic.AddUint64(&redisMsgSeq, 1), 36)
+	member, err := sonic.MarshalString(redisMQMsg{
+		Payload:   string(payload),
+		ProduceAt: produceAt.UnixMilli(),
+		Seq:       seq,
+	})
+	if err != nil {
+		return err
+	}
+	return client.GetRedisClient().ZAdd(ctx, conf.Conf.RedisMQDelayKey, redis.Z{
+		Score:  float64(deliverAt.UnixMilli()),
+		Member: member,
+	}).Err()
+}
+
+// redis补偿消费服务
+type redisConsumeService struct {
+	app      core.IApp
+	ctx      context.Context
+	cancel   context.CancelFunc
+	consumer string // 消费者名前缀
+	wg       sync.WaitGroup
+}
+
+func newRedisConsumeService(app core.IApp) core.IService {
+	ctx, cancel := context.WithCancel(context.Background())
+	hostname, _ := os.Hostname()
+	return &redisConsumeService{
+		app:      app,
+		ctx:      ctx,
+		cancel:   cancel,
+		consumer: fmt.Sprintf("%s_%s_%d", app.Name(), hostname, os.Getpid()),
+	}
+}
+
+func (s *redisConsumeService) Inject(a ...interface{}) {}
+
+func (s *redisConsumeService) Start() error {
+	err := client.GetRedisClient().XGroupCreateMkStream(s.ctx, conf.Conf.RedisMQStreamKey,
+		conf.Conf.RedisMQConsumeGroup, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("order redis mq create consume group err: %v", err)
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.move()
+	}()
+	for i := 0; i < conf.Conf.RedisMQConsumeThreadCount; i++ {
+		s.wg.Add(1)
+		go func(consumer string) {
+			defer s.wg.Done()
+			s.consume(consumer)
+		}(s.consumer + "_" + strconv.Itoa(i))
+	}
+	return nil
+}
+
+func (s *redisConsumeService) Close() error {
+	s.cancel()
+	s.wg.Wait()
+	return nil
+}
+
+// 定时将到期的消息从延迟队列移动到stream
+func (s *redisConsumeService) move() {
+	for sleepCtx(s.ctx, redisMoveInterval) {
+		for {
+			n, err := client.GetRedisClient().Eval(s.ctx, redisMoveScript,
+				[]string{conf.Conf.RedisMQDelayKey, conf.Conf.RedisMQStreamKey},
+				time.Now().UnixMilli(), redisMoveBatchSize, redisStreamField_Msg).Int()
+			if err != nil {
+				if s.ctx.Err() == nil {
+					logger.Log.Error(s.ctx, "Order redis mq move delay msg err", zap.Error(err))
+				}
+				break
+			}
+			if n < redisMoveBatchSize {
+				break
+			}
+		}
+	}
+}
+
+func (s *redisConsumeService) consume(consumer string) {
+	var lastClaimTime time.Time
+	for s.ctx.Err() == nil {
+		// 认领其它消费者长时间未确认的消息, 一般是消费者异常退出导致的
+		if time.Since(lastClaimTime) > redisClaimInterval {
+			lastClaimTime = time.Now()
+			s.claim(consumer)
+		}
+
+		streams, err := client.GetRedisClient().XReadGroup(s.ctx, &redis.XReadGroupArgs{
+			Group:    conf.Conf.RedisMQConsumeGroup,
+			Consumer: consumer,
+			Streams:  []string{conf.Conf.RedisMQStreamKey, ">"},
+			Count:    redisReadCount,
+			Block:    redisReadBlock,
+		}).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return
+			}
+			logger.Log.Error(s.ctx, "Order redis mq XReadGroup err", zap.Error(err))
+			sleepCtx(s.ctx, redisErrDelay)
+			continue
+		}
+		for _, stream := range streams {
+			for _, msg := range stream.Messages {
+				s.process(msg)
+			}
+		}
+	}
+}
+
+func (s *redisConsumeService) claim(consumer string) {
+	start := "0-0"
+	for {
+		msgs, next, err := client.GetRedisClient().XAutoClaim(s.ctx, &redis.XAutoClaimArgs{
+			Stream:   conf.Conf.RedisMQStreamKey,
+			Group:    conf.Conf.RedisMQConsumeGroup,
+			MinIdle:  redisClaimMinIdle,
+			Start:    start,
+			Count:    redisReadCount,
+			Consumer: consumer,
+		}).Result()
+		if err != nil {
+			if s.ctx.Err() == nil {
+				logger.Log.Error(s.ctx, "Order redis mq XAutoClaim err", zap.Error(err))
+			}
+			return
+		}
+		for _, msg := range msgs {
+			s.process(msg)
+		}
+		if next == "0-0" || len(msgs) == 0 {
+			return
+		}
+		start = next
+	}
+}
+
+// 处理消息, 处理失败时会重新写入延迟队列用于重试
+func (s *redisConsumeService) process(msg redis.XMessage) {
+	ctx := context.Background()
+	member, _ := msg.Values[redisStreamField_Msg].(string)
+	mqMsg := redisMQMsg{}
+	err := sonic.UnmarshalString(member, &mqMsg)
+	if err != nil {
+		logger.Log.Error(ctx, "Order redis mq unmarshal msg err",
+			zap.String("id", msg.ID),
+			zap.String("msg", member),
+			zap.Error(err),
+		)
+		s.ack(ctx, msg.ID) // 无论如何重试也不可能成功了
+		return
+	}
+
+	err = consumeProcess(ctx, []byte(mqMsg.Payload), time.UnixMilli(mqMsg.ProduceAt))
+	if err != nil {
+		err = sendRedis(ctx, []byte(mqMsg.Payload), time.UnixMilli(mqMsg.ProduceAt))
+		if err != nil {
+			logger.Log.Error(ctx, "Order redis mq resend msg for retry err",
+				zap.String("payload", mqMsg.Payload),
+				zap.Error(err),
+			)
+			return // 不确认消息, 超过 redisClaimMinIdle 后会被重新认领
+		}
+	}
+	s.ack(ctx, msg.ID)
+}
+
+// 确认并删除消息
+func (s *redisConsumeService) ack(ctx context.Context, id string) {
+	rdb := client.GetRedisClient()
+	err := rdb.XAck(ctx, conf.Conf.RedisMQStreamKey, conf.Conf.RedisMQConsumeGroup, id).Err()
+	if err == nil {
+		err = rdb.XDel(ctx, conf.Conf.RedisMQStreamKey, id).Err()
+	}
+	if err != nil {
+		logger.Log.Error(ctx, "Order redis mq ack msg err",
+			zap.String("id", id),
+			zap.Error(err),
+		)
+	}
+}
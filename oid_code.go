@@ -0,0 +1,188 @@
+package order
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/zlyuancn/order/conf"
+	"github.com/zlyuancn/order/order_model"
+)
+
+/*
+客户订单号, 对内部订单号做可逆编码后展示给用户, 避免暴露订单量和分片信息
+
+支持 snowflake 生成器和 redis 生成器生成的订单号. 订单号中的数字部分会被打包为96位整数, 经过以 OrderCodeSecret 为密钥的
+Feistel网络置换后转为29位十进制数, 最后加上一位Luhn校验位, 总长度固定为30位.
+
+96位整数的组成, 从高位到低位依次为 2位生成器标识, 16位订单类型, 14位分片, 64位唯一标识.
+redis生成器的唯一标识为 32位序列号 + 32位秒级时间戳, 序列号超过32位的订单号不支持编码.
+*/
+
+const (
+	orderCodeKind_Snowflake = 0
+	orderCodeKind_Redis     = 1
+
+	orderCodeMaxShard  = 1<<14 - 1
+	orderCodeDigits    = 29 // 不包含校验位
+	orderCodeRounds    = 8
+	orderCodeHalfBits  = 48
+	orderCodeHalfMask  = 1<<orderCodeHalfBits - 1
+	orderCodeMaxUint32 = 1<<32 - 1
+)
+
+// 把订单号编码为客户订单号, 需要配置 OrderCodeSecret. 不支持的订单号返回 OrderCodeUnsupportedErr
+func EncodeOrderCode(orderID string) (string, error) {
+	if conf.Conf.OrderCodeSecret == "" {
+		return "", errors.New("order EncodeOrderCode OrderCodeSecret is empty")
+	}
+
+	hi, lo, err := packOrderCode(orderID)
+	if err != nil {
+		return "", err
+	}
+	// 确认可以还原为相同的订单号, 比如序列号带有前导0时无法还原
+	if decoded, err := unpackOrderCode(hi, lo); err != nil || decoded != orderID {
+		return "", OrderCodeUnsupportedErr
+	}
+
+	l := uint64(hi)<<16 | lo>>orderCodeHalfBits
+	r := lo & orderCodeHalfMask
+	for i := 0; i < orderCodeRounds; i++ {
+		l, r = r, l^orderCodeRound(i, r)
+	}
+
+	v := new(big.Int).Lsh(new(big.Int).SetUint64(l), orderCodeHalfBits)
+	v.Or(v, new(big.Int).SetUint64(r))
+	digits := fmt.Sprintf("%0*s", orderCodeDigits, v.String())
+	return digits + strconv.Itoa(luhnCheckDigit(digits)), nil
+}
+
+// 把客户订单号解码为订单号, 客户订单号格式不正确或校验失败时返回 OrderCodeInvalidErr
+func DecodeOrderCode(code string) (string, error) {
+	if conf.Conf.OrderCodeSecret == "" {
+		return "", errors.New("order DecodeOrderCode OrderCodeSecret is empty")
+	}
+
+	code = strings.TrimSpace(code)
+	if len(code) != orderCodeDigits+1 {
+		return "", OrderCodeInvalidErr
+	}
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return "", OrderCodeInvalidErr
+		}
+	}
+	digits := code[:orderCodeDigits]
+	if strconv.Itoa(luhnCheckDigit(digits)) != code[orderCodeDigits:] {
+		return "", OrderCodeInvalidErr
+	}
+
+	v, ok := new(big.Int).SetString(digits, 10)
+	if !ok || v.BitLen() > orderCodeHalfBits*2 {
+		return "", OrderCodeInvalidErr
+	}
+	r := new(big.Int).And(v, new(big.Int).SetUint64(orderCodeHalfMask)).Uint64()
+	l := new(big.Int).Rsh(v, orderCodeHalfBits).Uint64()
+	for i := orderCodeRounds - 1; i >= 0; i-- {
+		l, r = r^orderCodeRound(i, l), l
+	}
+
+	hi := uint32(l >> 16)
+	lo := l<<orderCodeHalfBits | r
+	orderID, err := unpackOrderCode(hi, lo)
+	if err != nil {
+		return "", OrderCodeInvalidErr
+	}
+	return orderID, nil
+}
+
+// Feistel网络的轮函数, 返回48位
+func orderCodeRound(round int, half uint64) uint64 {
+	var buf [9]byte
+	buf[0] = byte(round)
+	binary.BigEndian.PutUint64(buf[1:], half)
+	mac := hmac.New(sha256.New, []byte(conf.Conf.OrderCodeSecret))
+	mac.Write(buf[:])
+	return binary.BigEndian.Uint64(mac.Sum(nil)) & orderCodeHalfMask
+}
+
+// 把订单号打包为 32位高位(生成器标识/订单类型/分片) 和 64位唯一标识
+func packOrderCode(orderID string) (hi uint32, lo uint64, err error) {
+	info, err := ParseOID(orderID)
+	if err != nil {
+		return 0, 0, err
+	}
+	shard, _ := strconv.ParseUint(info.Shard, 10, 32)
+	if shard > orderCodeMaxShard {
+		return 0, 0, OrderCodeUnsupportedErr
+	}
+
+	var kind uint32
+	parts := strings.Split(orderID, "-")
+	switch info.Kind {
+	case oidKind_Snowflake:
+		if len(parts) != 5 {
+			return 0, 0, OrderCodeUnsupportedErr
+		}
+		id, err := strconv.ParseInt(parts[4], 10, 64)
+		if err != nil || id < 0 {
+			return 0, 0, OrderCodeUnsupportedErr
+		}
+		kind, lo = orderCodeKind_Snowflake, uint64(id)
+	case oidKind_Redis:
+		if len(parts) != 6 {
+			return 0, 0, OrderCodeUnsupportedErr
+		}
+		seq, err1 := strconv.ParseUint(parts[4], 10, 32)
+		ts, err2 := strconv.ParseUint(parts[5], 10, 32)
+		if err1 != nil || err2 != nil {
+			return 0, 0, OrderCodeUnsupportedErr
+		}
+		kind, lo = orderCodeKind_Redis, seq<<32|ts
+	default:
+		return 0, 0, OrderCodeUnsupportedErr
+	}
+
+	hi = kind<<30 | uint32(uint16(info.OrderType))<<14 | uint32(shard)
+	return hi, lo, nil
+}
+
+// 从打包的数据还原订单号
+func unpackOrderCode(hi uint32, lo uint64) (string, error) {
+	orderType := order_model.OrderType(int16(uint16(hi >> 14)))
+	shard := strconv.FormatUint(uint64(hi&orderCodeMaxShard), 10)
+	switch hi >> 30 {
+	case orderCodeKind_Snowflake:
+		if lo > 1<<63-1 {
+			return "", OrderCodeInvalidErr
+		}
+		return formatSnowflakeOID(orderType, shard, int64(lo)), nil
+	case orderCodeKind_Redis:
+		return formatRedisOID(orderType, shard, int64(lo>>32), int64(lo&orderCodeMaxUint32)), nil
+	}
+	return "", OrderCodeInvalidErr
+}
+
+// 计算Luhn校验位
+func luhnCheckDigit(digits string) int {
+	sum := 0
+	double := true // 从右往左, 校验位左边第一位需要乘2
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return (10 - sum%10) % 10
+}
@@ -0,0 +1,122 @@
+package order
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/zlyuancn/order/conf"
+)
+
+func TestOrderCodeRoundTrip(t *testing.T) {
+	conf.Conf.OrderCodeSecret = "test secret"
+	for _, orderID := range []string{
+		formatSnowflakeOID(1, "0", 1),
+		formatSnowflakeOID(32767, "16383", 1<<63-1),
+		formatSnowflakeOID(500, "7", 123456789),
+		formatRedisOID(1, "0", 1, 1700000000),
+		formatRedisOID(200, "15", 1<<32-1, 1<<32-1),
+	} {
+		code, err := EncodeOrderCode(orderID)
+		if err != nil {
+			t.Errorf("EncodeOrderCode(%q) err: %v", orderID, err)
+			continue
+		}
+		if len(code) != orderCodeDigits+1 {
+			t.Errorf("EncodeOrderCode(%q) = %q, want %d digits", orderID, code, orderCodeDigits+1)
+		}
+		decoded, err := DecodeOrderCode(code)
+		if err != nil || decoded != orderID {
+			t.Errorf("DecodeOrderCode(%q) = %q, %v, want %q", code, decoded, err, orderID)
+		}
+	}
+}
+
+func TestOrderCodeSecret(t *testing.T) {
+	orderID := formatSnowflakeOID(1, "0", 1)
+	conf.Conf.OrderCodeSecret = "secret a"
+	codeA, _ := EncodeOrderCode(orderID)
+	conf.Conf.OrderCodeSecret = "secret b"
+	codeB, _ := EncodeOrderCode(orderID)
+	if codeA == codeB {
+		t.Errorf("different secrets generate the same code %q", codeA)
+	}
+	if decoded, err := DecodeOrderCode(codeA); err == nil && decoded == orderID {
+		t.Error("code decoded with another secret")
+	}
+
+	conf.Conf.OrderCodeSecret = ""
+	if _, err := EncodeOrderCode(orderID); err == nil {
+		t.Error("EncodeOrderCode without secret should fail")
+	}
+	if _, err := DecodeOrderCode(codeA); err == nil {
+		t.Error("DecodeOrderCode without secret should fail")
+	}
+}
+
+func TestOrderCodeUnsupported(t *testing.T) {
+	conf.Conf.OrderCodeSecret = "test secret"
+	for _, orderID := range []string{
+		"order-uoid-1-0-u1-abc",
+		"order-snow-1-16384-1",                 // 分片超过14位
+		"order-snow-1-0-01",                    // 前导0无法还原
+		"order-sgen-1-0-4294967296-1700000000", // 序列号超过32位
+		"order-sgen-1-0-1",
+	} {
+		if _, err := EncodeOrderCode(orderID); err != OrderCodeUnsupportedErr {
+			t.Errorf("EncodeOrderCode(%q) err = %v, want OrderCodeUnsupportedErr", orderID, err)
+		}
+	}
+	if _, err := EncodeOrderCode("bad"); err != OrderIDInvalidErr {
+		t.Errorf("EncodeOrderCode(bad) err = %v, want OrderIDInvalidErr", err)
+	}
+}
+
+func TestDecodeOrderCodeInvalid(t *testing.T) {
+	conf.Conf.OrderCodeSecret = "test secret"
+	code, err := EncodeOrderCode(formatRedisOID(3, "1", 42, 1700000000))
+	if err != nil {
+		t.Fatalf("EncodeOrderCode err: %v", err)
+	}
+
+	invalid := []string{"", "123", code[:len(code)-1], code + "0", "a" + code[1:]}
+	// 改动任意一位数字都会被Luhn校验拒绝
+	for i := 0; i < len(code); i++ {
+		d := int(code[i] - '0')
+		invalid = append(invalid, code[:i]+strconv.Itoa((d+1)%10)+code[i+1:])
+	}
+	// 交换相邻的不同数字也会被拒绝, 09和90除外
+	for i := 0; i+1 < len(code); i++ {
+		a, b := code[i], code[i+1]
+		if a == b || a == '0' && b == '9' || a == '9' && b == '0' {
+			continue
+		}
+		invalid = append(invalid, code[:i]+string(b)+string(a)+code[i+2:])
+	}
+	for _, c := range invalid {
+		if _, err := DecodeOrderCode(c); err != OrderCodeInvalidErr {
+			t.Errorf("DecodeOrderCode(%q) err = %v, want OrderCodeInvalidErr", c, err)
+		}
+	}
+
+	// 首尾空白会被忽略
+	if _, err := DecodeOrderCode(" " + code + "\n"); err != nil {
+		t.Errorf("DecodeOrderCode with spaces err: %v", err)
+	}
+}
+
+func TestLuhnCheckDigit(t *testing.T) {
+	tests := []struct {
+		digits string
+		want   int
+	}{
+		{"7992739871", 3},
+		{"0", 0},
+		{"1", 8},
+		{"12345678901234567890123456789", 1},
+	}
+	for _, tt := range tests {
+		if got := luhnCheckDigit(tt.digits); got != tt.want {
+			t.Errorf("luhnCheckDigit(%q) = %d, want %d", tt.digits, got, tt.want)
+		}
+	}
+}
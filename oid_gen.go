@@ -0,0 +1,235 @@
+package order
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zly-app/zapp/logger"
+	"go.uber.org/zap"
+
+	"github.com/zlyuancn/order/conf"
+	"github.com/zlyuancn/order/dao"
+	"github.com/zlyuancn/order/order_model"
+)
+
+// 订单号中的生成器标识
+const (
+	oidKind_Redis       = "sgen"
+	oidKind_Snowflake   = "snow"
+	oidKind_UserOID     = "uoid"
+	oidKind_ThirdPayOID = "third"
+)
+
+/*
+redis自增序列号生成器, 生成的订单号为 order-sgen-<订单类型>-<分片>-<序列号>-<秒级时间戳>
+
+OIDSegmentSize 大于1时每次从redis预留一个号段的序列号, 在进程内存中分配, 进程退出时未分配的序列号会被丢弃.
+*/
+type redisOIDGenerator struct {
+	mx       sync.Mutex
+	segments map[string]*oidSegment
+	incrBy   func(ctx context.Context, key string, n int64) (int64, error) // 自增序列号并返回自增后的值
+}
+
+// 号段, 序列号范围为 [cur, max]
+type oidSegment struct {
+	mx      sync.Mutex
+	cur     int64
+	max     int64         // 为0表示没有可用的号段
+	nextCur int64         // 预取的下一个号段
+	nextMax int64         // 为0表示没有预取的号段
+	loading chan struct{} // 不为nil表示正在预取下一个号段, 预取完成后关闭
+}
+
+func newRedisOIDGenerator() *redisOIDGenerator {
+	return &redisOIDGenerator{segments: make(map[string]*oidSegment), incrBy: dao.RedisIncrBy}
+}
+
+func (g *redisOIDGenerator) GenOID(ctx context.Context, orderType order_model.OrderType, shard string) (string, error) {
+	key := g.genOrderSeqNoKey(orderType, shard)
+	seq, err := g.nextSeq(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	return formatRedisOID(orderType, shard, seq, time.Now().Unix()), nil
+}
+
+func formatRedisOID(orderType order_model.OrderType, shard string, seq, ts int64) string {
+	return fmt.Sprintf("order-%s-%d-%s-%d-%d", oidKind_Redis, orderType, shard, seq, ts)
+}
+
+func (g *redisOIDGenerator) nextSeq(ctx context.Context, key string) (int64, error) {
+	size := conf.Conf.OIDSegmentSize
+	if size <= 1 {
+		return g.incrBy(ctx, key, 1)
+	}
+
+	seg := g.getSegment(key)
+	seg.mx.Lock()
+	defer seg.mx.Unlock()
+	for {
+		if seg.max > 0 && seg.cur <= seg.max {
+			seq := seg.cur
+			seg.cur++
+			g.prefetch(seg, key, size)
+			return seq, nil
+		}
+		if seg.nextMax > 0 {
+			seg.cur, seg.max = seg.nextCur, seg.nextMax
+			seg.nextMax = 0
+			continue
+		}
+		if seg.loading != nil { // 等待预取完成
+			loading := seg.loading
+			seg.mx.Unlock()
+			select {
+			case <-loading:
+				seg.mx.Lock()
+			case <-ctx.Done():
+				seg.mx.Lock()
+				return 0, ctx.Err()
+			}
+			continue
+		}
+
+		end, err := g.incrBy(ctx, key, size)
+		if err != nil {
+			return 0, err
+		}
+		seg.cur, seg.max = end-size+1, end
+	}
+}
+
+// 当前号段剩余数量低于 OIDSegmentPrefetchPercent 时在后台预取下一个号段, 调用前需要持有号段锁
+func (g *redisOIDGenerator) prefetch(seg *oidSegment, key string, size int64) {
+	remaining := seg.max - seg.cur + 1
+	if seg.nextMax > 0 || seg.loading != nil || remaining*100 >= size*int64(conf.Conf.OIDSegmentPrefetchPercent) {
+		return
+	}
+
+	loading := make(chan struct{})
+	seg.loading = loading
+	go func() {
+		ctx := context.Background()
+		end, err := g.incrBy(ctx, key, size)
+
+		seg.mx.Lock()
+		defer seg.mx.Unlock()
+		if err != nil {
+			logger.Log.Error(ctx, "order redisOIDGenerator prefetch segment err",
+				zap.String("key", key),
+				zap.Error(err),
+			)
+		} else {
+			seg.nextCur, seg.nextMax = end-size+1, end
+		}
+		seg.loading = nil
+		close(loading)
+	}()
+}
+
+func (g *redisOIDGenerator) getSegment(key string) *oidSegment {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+	seg, ok := g.segments[key]
+	if !ok {
+		seg = &oidSegment{}
+		g.segments[key] = seg
+	}
+	return seg
+}
+
+func (*redisOIDGenerator) genOrderSeqNoKey(orderType order_model.OrderType, shardNum string) string {
+	text := conf.Conf.OrderSeqNoKeyFormat
+	text = strings.ReplaceAll(text, templateString_OrderType, strconv.Itoa(int(orderType)))
+	text = strings.ReplaceAll(text, templateString_ShardNum, shardNum)
+	return text
+}
+
+// snowflake id 的组成, 从高位到低位依次为 41位毫秒时间戳, 10位实例id, 12位序列号
+const (
+	snowflakeWorkerBits = 10
+	snowflakeSeqBits    = 12
+	snowflakeMaxSeq     = 1<<snowflakeSeqBits - 1
+)
+
+// snowflake id 时间戳的起始时间, 2024-01-01 00:00:00 UTC
+var snowflakeEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixMilli()
+
+/*
+snowflake生成器, 不依赖redis, 生成的订单号为 order-snow-<订单类型>-<分片>-<snowflake id>
+
+同时运行的实例需要配置不同的 OIDWorkerID. 时钟回拨时会沿用上次的时间戳, 保证同一个实例生成的id单调递增.
+*/
+type snowflakeOIDGenerator struct {
+	mx     sync.Mutex
+	lastMs int64
+	seq    int64
+}
+
+func (g *snowflakeOIDGenerator) GenOID(ctx context.Context, orderType order_model.OrderType, shard string) (string, error) {
+	return formatSnowflakeOID(orderType, shard, g.nextID()), nil
+}
+
+func formatSnowflakeOID(orderType order_model.OrderType, shard string, id int64) string {
+	return fmt.Sprintf("order-%s-%d-%s-%d", oidKind_Snowflake, orderType, shard, id)
+}
+
+func (g *snowflakeOIDGenerator) nextID() int64 {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	ms := time.Now().UnixMilli() - snowflakeEpoch
+	if ms < g.lastMs {
+		ms = g.lastMs
+	}
+	if ms == g.lastMs {
+		g.seq++
+		if g.seq > snowflakeMaxSeq { // 当前毫秒的序列号用完了, 借用下一毫秒
+			ms++
+			g.seq = 0
+		}
+	} else {
+		g.seq = 0
+	}
+	g.lastMs = ms
+
+	workerID := int64(conf.Conf.OIDWorkerID)
+	return ms<<(snowflakeWorkerBits+snowflakeSeqBits) | workerID<<snowflakeSeqBits | g.seq
+}
+
+/*
+从订单号中解析出订单类型和分片, 订单号格式为 order-<生成器标识>-<订单类型>-<分片>-<唯一标识>.
+内置生成器和 GenOIDByUserOID/GenOIDByThirdPayOID 生成的订单号都满足这个格式, 订单号格式不正确时返回 OrderIDInvalidErr
+*/
+func ParseOID(orderID string) (*order_model.OIDInfo, error) {
+	parts := strings.SplitN(orderID, "-", 5)
+	if len(parts) != 5 || parts[0] != "order" || parts[1] == "" || parts[4] == "" {
+		return nil, OrderIDInvalidErr
+	}
+	orderType, err := strconv.ParseInt(parts[2], 10, 16)
+	if err != nil {
+		return nil, OrderIDInvalidErr
+	}
+	shard, err := strconv.ParseUint(parts[3], 10, 32)
+	if err != nil || parts[3] != strconv.FormatUint(shard, 10) {
+		return nil, OrderIDInvalidErr
+	}
+
+	info := &order_model.OIDInfo{
+		Kind:      parts[1],
+		OrderType: order_model.OrderType(orderType),
+		Shard:     parts[3],
+	}
+	// uid和用户订单号/第三方支付订单id都不包含'-'时才能确定uid
+	if info.Kind == oidKind_UserOID || info.Kind == oidKind_ThirdPayOID {
+		if ss := strings.Split(parts[4], "-"); len(ss) == 2 && ss[0] != "" {
+			info.Uid = ss[0]
+		}
+	}
+	return info, nil
+}
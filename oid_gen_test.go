@@ -0,0 +1,267 @@
+package order
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zlyuancn/order/conf"
+	"github.com/zlyuancn/order/order_model"
+)
+
+func TestParseOID(t *testing.T) {
+	conf.Conf.OIDWorkerID = 7
+	snowOID, _ := (&snowflakeOIDGenerator{}).GenOID(context.Background(), 12, "3")
+	redisOID := "order-sgen-5-0-1001-1700000000"
+
+	tests := []struct {
+		orderID string
+		want    order_model.OIDInfo
+	}{
+		{snowOID, order_model.OIDInfo{Kind: oidKind_Snowflake, OrderType: 12, Shard: "3"}},
+		{redisOID, order_model.OIDInfo{Kind: oidKind_Redis, OrderType: 5, Shard: "0"}},
+		{"order-uoid-1-2-u100-abc", order_model.OIDInfo{Kind: oidKind_UserOID, OrderType: 1, Shard: "2", Uid: "u100"}},
+		{"order-third-1-2-u-100-abc", order_model.OIDInfo{Kind: oidKind_ThirdPayOID, OrderType: 1, Shard: "2"}},
+	}
+	for _, tt := range tests {
+		info, err := ParseOID(tt.orderID)
+		if err != nil {
+			t.Errorf("ParseOID(%q) err: %v", tt.orderID, err)
+			continue
+		}
+		if *info != tt.want {
+			t.Errorf("ParseOID(%q) = %+v, want %+v", tt.orderID, *info, tt.want)
+		}
+	}
+
+	for _, orderID := range []string{
+		"",
+		"order-snow-1-2",
+		"bill-snow-1-2-3",
+		"order--1-2-3",
+		"order-snow-x-2-3",
+		"order-snow-1--3",
+		"order-snow-1-02-3",
+		"order-snow-1-2-",
+		"order-snow-40000-2-3",
+	} {
+		if _, err := ParseOID(orderID); err != OrderIDInvalidErr {
+			t.Errorf("ParseOID(%q) err = %v, want OrderIDInvalidErr", orderID, err)
+		}
+	}
+}
+
+func TestSnowflakeOIDGenerator(t *testing.T) {
+	conf.Conf.OIDWorkerID = 7
+	g := &snowflakeOIDGenerator{}
+	var last int64
+	for i := 0; i < 10000; i++ { // 超过单毫秒的序列号上限
+		orderID, _ := g.GenOID(context.Background(), 1, "0")
+		id, err := strconv.ParseInt(orderID[strings.LastIndex(orderID, "-")+1:], 10, 64)
+		if err != nil {
+			t.Fatalf("invalid snowflake oid %q", orderID)
+		}
+		if id <= last {
+			t.Fatalf("snowflake id not increasing: %d after %d", id, last)
+		}
+		if worker := id >> snowflakeSeqBits & (1<<snowflakeWorkerBits - 1); worker != 7 {
+			t.Fatalf("snowflake worker id = %d, want 7", worker)
+		}
+		last = id
+	}
+}
+
+// 模拟redis自增, 可以让下一次自增阻塞或失败
+type fakeIncr struct {
+	mx    sync.Mutex
+	vals  map[string]int64
+	calls []int64 // 每次自增的数量
+	block chan struct{}
+	err   error
+}
+
+func (f *fakeIncr) incrBy(ctx context.Context, key string, n int64) (int64, error) {
+	f.mx.Lock()
+	block, err := f.block, f.err
+	f.mx.Unlock()
+	if block != nil {
+		<-block
+	}
+
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	f.calls = append(f.calls, n)
+	if err != nil {
+		return 0, err
+	}
+	if f.vals == nil {
+		f.vals = make(map[string]int64)
+	}
+	f.vals[key] += n
+	return f.vals[key], nil
+}
+
+func (f *fakeIncr) callNums() int {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	return len(f.calls)
+}
+
+func newTestRedisOIDGenerator(segmentSize int64, prefetchPercent int) (*redisOIDGenerator, *fakeIncr) {
+	conf.Conf.OIDSegmentSize = segmentSize
+	conf.Conf.OIDSegmentPrefetchPercent = prefetchPercent
+	f := &fakeIncr{}
+	g := newRedisOIDGenerator()
+	g.incrBy = f.incrBy
+	return g, f
+}
+
+// 等待号段的后台预取完成
+func waitPrefetch(t *testing.T, g *redisOIDGenerator, key string) {
+	seg := g.getSegment(key)
+	seg.mx.Lock()
+	loading := seg.loading
+	seg.mx.Unlock()
+	if loading == nil {
+		return
+	}
+	select {
+	case <-loading:
+	case <-time.After(time.Second):
+		t.Fatal("prefetch not finished")
+	}
+}
+
+func mustNextSeq(t *testing.T, g *redisOIDGenerator, key string) int64 {
+	seq, err := g.nextSeq(context.Background(), key)
+	if err != nil {
+		t.Fatalf("nextSeq err: %v", err)
+	}
+	return seq
+}
+
+func TestRedisOIDGeneratorWithoutSegment(t *testing.T) {
+	g, f := newTestRedisOIDGenerator(1, 20)
+	for want := int64(1); want <= 3; want++ {
+		if seq := mustNextSeq(t, g, "k"); seq != want {
+			t.Fatalf("seq = %d, want %d", seq, want)
+		}
+	}
+	if f.callNums() != 3 {
+		t.Fatalf("incr calls = %d, want 3", f.callNums())
+	}
+}
+
+func TestRedisOIDGeneratorSegment(t *testing.T) {
+	g, f := newTestRedisOIDGenerator(10, 0) // 不预取
+	for want := int64(1); want <= 25; want++ {
+		if seq := mustNextSeq(t, g, "k"); seq != want {
+			t.Fatalf("seq = %d, want %d", seq, want)
+		}
+	}
+	if f.callNums() != 3 {
+		t.Fatalf("incr calls = %d, want 3", f.callNums())
+	}
+
+	// 不同的key使用各自的号段
+	if seq := mustNextSeq(t, g, "k2"); seq != 1 {
+		t.Fatalf("seq of another key = %d, want 1", seq)
+	}
+}
+
+func TestRedisOIDGeneratorPrefetch(t *testing.T) {
+	g, f := newTestRedisOIDGenerator(10, 20)
+
+	// 剩余数量低于号段大小的20%即少于2个时才预取
+	for want := int64(1); want <= 8; want++ {
+		if seq := mustNextSeq(t, g, "k"); seq != want {
+			t.Fatalf("seq = %d, want %d", seq, want)
+		}
+	}
+	if f.callNums() != 1 {
+		t.Fatalf("incr calls before prefetch boundary = %d, want 1", f.callNums())
+	}
+	if seq := mustNextSeq(t, g, "k"); seq != 9 {
+		t.Fatalf("seq = %d, want 9", seq)
+	}
+	waitPrefetch(t, g, "k")
+	if f.callNums() != 2 {
+		t.Fatalf("incr calls after prefetch boundary = %d, want 2", f.callNums())
+	}
+
+	// 用完当前号段后切换到预取的号段, 不会再访问redis
+	for want := int64(10); want <= 18; want++ {
+		if seq := mustNextSeq(t, g, "k"); seq != want {
+			t.Fatalf("seq = %d, want %d", seq, want)
+		}
+	}
+	if f.callNums() != 2 {
+		t.Fatalf("incr calls after switching segment = %d, want 2", f.callNums())
+	}
+}
+
+func TestRedisOIDGeneratorWaitPrefetch(t *testing.T) {
+	g, f := newTestRedisOIDGenerator(2, 100) // 每次分配后都会预取
+
+	if seq := mustNextSeq(t, g, "k"); seq != 1 {
+		t.Fatalf("seq = %d, want 1", seq)
+	}
+	waitPrefetch(t, g, "k") // 预取了 [3, 4]
+
+	// 阻塞下一次预取, 用完已有号段后需要等待预取完成而不是重复预留号段
+	block := make(chan struct{})
+	f.mx.Lock()
+	f.block = block
+	f.mx.Unlock()
+	for want := int64(2); want <= 4; want++ {
+		if seq := mustNextSeq(t, g, "k"); seq != want {
+			t.Fatalf("seq = %d, want %d", seq, want)
+		}
+	}
+
+	done := make(chan int64)
+	go func() {
+		seq, _ := g.nextSeq(context.Background(), "k")
+		done <- seq
+	}()
+	select {
+	case seq := <-done:
+		t.Fatalf("nextSeq returned %d before prefetch finished", seq)
+	case <-time.After(50 * time.Millisecond):
+	}
+	f.mx.Lock()
+	f.block = nil
+	f.mx.Unlock()
+	close(block)
+	if seq := <-done; seq != 5 {
+		t.Fatalf("seq = %d, want 5", seq)
+	}
+}
+
+func TestRedisOIDGeneratorPrefetchErr(t *testing.T) {
+	g, f := newTestRedisOIDGenerator(10, 20)
+	for i := 0; i < 9; i++ {
+		f.mx.Lock()
+		if i == 8 { // 预取失败
+			f.err = errors.New("redis down")
+		}
+		f.mx.Unlock()
+		mustNextSeq(t, g, "k")
+	}
+	waitPrefetch(t, g, "k")
+
+	f.mx.Lock()
+	f.err = nil
+	f.mx.Unlock()
+	if seq := mustNextSeq(t, g, "k"); seq != 10 {
+		t.Fatalf("seq = %d, want 10", seq)
+	}
+	// 预取失败后用完当前号段时同步预留号段
+	if seq := mustNextSeq(t, g, "k"); seq != 11 {
+		t.Fatalf("seq = %d, want 11", seq)
+	}
+}
@@ -2,7 +2,9 @@ package order
 
 import (
 	"fmt"
+	"strings"
 
+	"github.com/zlyuancn/order/conf"
 	"github.com/zlyuancn/order/order_model"
 )
 
@@ -32,3 +34,94 @@ func RegistryOrderBusiness(t order_model.OrderType, ob order_model.OrderBusiness
 func GetOrderBusiness(t order_model.OrderType) (order_model.OrderBusiness, bool) {
 	return orderApi.GetOrderBusiness(t)
 }
+
+var orderStateMachines = map[order_model.OrderType]*order_model.OrderStateMachine{}
+
+// 未注册状态机的订单类型使用的状态机
+var defOrderStateMachine = order_model.NewDefaultOrderStateMachine()
+
+// 注册订单类型的状态机, 未注册时使用内置状态机, 重复注册会panic
+func (orderCli) RegistryOrderStateMachine(t order_model.OrderType, sm *order_model.OrderStateMachine) {
+	_, ok := orderStateMachines[t]
+	if ok {
+		panic(fmt.Errorf("RegistryOrderStateMachine repetition OrderType=%v", t))
+	}
+	orderStateMachines[t] = sm
+}
+
+// 获取订单类型的状态机
+func (orderCli) GetOrderStateMachine(t order_model.OrderType) *order_model.OrderStateMachine {
+	sm, ok := orderStateMachines[t]
+	if !ok {
+		return defOrderStateMachine
+	}
+	return sm
+}
+
+// 注册订单类型的状态机, 未注册时使用内置状态机, 重复注册会panic
+func RegistryOrderStateMachine(t order_model.OrderType, sm *order_model.OrderStateMachine) {
+	orderApi.RegistryOrderStateMachine(t, sm)
+}
+
+// 获取订单类型的状态机
+func GetOrderStateMachine(t order_model.OrderType) *order_model.OrderStateMachine {
+	return orderApi.GetOrderStateMachine(t)
+}
+
+var payProviders = map[order_model.OrderPayType]order_model.PayProvider{}
+
+// 注册支付提供者, 重复注册会panic
+func (orderCli) RegistryPayProvider(t order_model.OrderPayType, p order_model.PayProvider) {
+	_, ok := payProviders[t]
+	if ok {
+		panic(fmt.Errorf("RegistryPayProvider repetition OrderPayType=%v", t))
+	}
+	payProviders[t] = p
+}
+
+// 获取支付提供者
+func (orderCli) GetPayProvider(t order_model.OrderPayType) (order_model.PayProvider, bool) {
+	p, ok := payProviders[t]
+	return p, ok
+}
+
+// 注册支付提供者, 重复注册会panic
+func RegistryPayProvider(t order_model.OrderPayType, p order_model.PayProvider) {
+	orderApi.RegistryPayProvider(t, p)
+}
+
+// 获取支付提供者
+func GetPayProvider(t order_model.OrderPayType) (order_model.PayProvider, bool) {
+	return orderApi.GetPayProvider(t)
+}
+
+var oidGenerators = map[string]order_model.OIDGenerator{
+	conf.OIDGeneratorType_Redis:     newRedisOIDGenerator(),
+	conf.OIDGeneratorType_Snowflake: &snowflakeOIDGenerator{},
+}
+
+// 注册订单号生成器, 通过配置 OIDGeneratorType 选择使用的生成器, 重复注册会panic
+func (orderCli) RegistryOIDGenerator(name string, g order_model.OIDGenerator) {
+	name = strings.ToLower(name)
+	_, ok := oidGenerators[name]
+	if ok {
+		panic(fmt.Errorf("RegistryOIDGenerator repetition name=%v", name))
+	}
+	oidGenerators[name] = g
+}
+
+// 获取订单号生成器
+func (orderCli) GetOIDGenerator(name string) (order_model.OIDGenerator, bool) {
+	g, ok := oidGenerators[strings.ToLower(name)]
+	return g, ok
+}
+
+// 注册订单号生成器, 通过配置 OIDGeneratorType 选择使用的生成器, 重复注册会panic
+func RegistryOIDGenerator(name string, g order_model.OIDGenerator) {
+	orderApi.RegistryOIDGenerator(name, g)
+}
+
+// 获取订单号生成器
+func GetOIDGenerator(name string) (order_model.OIDGenerator, bool) {
+	return orderApi.GetOIDGenerator(name)
+}
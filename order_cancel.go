@@ -0,0 +1,131 @@
+package order
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/bytedance/sonic"
+	"github.com/zly-app/zapp/logger"
+	"go.uber.org/zap"
+
+	"github.com/zlyuancn/order/dao"
+	"github.com/zlyuancn/order/order_model"
+)
+
+/*
+用户主动取消订单
+
+	reason 取消原因, 会记录到备注中
+
+终态订单不能取消, 返回 OrderTerminalErr. 业务层实现了 order_model.OrderCanceler 时会先调用 CancelCallback, 返回err时不会取消订单.
+已支付的金额(包括混合支付中已支付的支付项)会在订单状态变为 OrderStatus_BusinessCancelForward 之前全额退款, 这次退款不会再调用 RefundCallback.
+退款失败时订单会转为需要人工介入, 不会再被补偿推进, 可以再次调用 CancelOrder 重试退款, 这时会再次调用 CancelCallback, 业务层需要保证幂等.
+*/
+func (o orderCli) CancelOrder(ctx context.Context, orderID, uid, reason string) error {
+	unlock, err := o.lockOrder(ctx, orderID, uid, "CancelOrder")
+	if err != nil {
+		return err
+	}
+	defer unlock(ctx)
+
+	order, extendText, status, err := o.GetOrder(ctx, orderID, uid)
+	if err != nil {
+		return err
+	}
+
+	sm := o.GetOrderStateMachine(order.OrderType)
+	if sm.IsTerminal(status) {
+		logger.Log.Warn(ctx, "orderApi CancelOrder order is terminal",
+			zap.Any("order", order),
+			zap.Int("status", int(status)),
+		)
+		return OrderTerminalErr
+	}
+	newStatus := order_model.OrderStatus_BusinessCancelForward
+	if !sm.CanTransition(status, newStatus) {
+		logger.Log.Warn(ctx, "orderApi CancelOrder transition not allowed",
+			zap.Any("order", order),
+			zap.Int("status", int(status)),
+		)
+		return OrderStatusTransitionErr
+	}
+
+	ob, ok := o.GetOrderBusiness(order.OrderType)
+	if !ok {
+		return fmt.Errorf("orderApi CancelOrder OrderType %v not found OrderBusiness", order.OrderType)
+	}
+	extend, err := o.parseExtend(ctx, ob, extendText)
+	if err != nil {
+		return fmt.Errorf("orderApi CancelOrder Unmarshal extend err. orderID=%v, err=%v", orderID, err)
+	}
+
+	// 业务层检查并撤回订单相关的数据
+	if canceler, ok := order_model.AsOrderCanceler(ob); ok {
+		err = canceler.CancelCallback(ctx, order, extend, reason)
+		if err != nil {
+			logger.Log.Error(ctx, "orderApi CancelOrder call CancelCallback err",
+				zap.Any("order", order),
+				zap.Any("extend", extend),
+				zap.String("reason", reason),
+				zap.Error(err),
+			)
+			return err
+		}
+	}
+
+	// 在取消前退款, CancelCallback 已经撤回了交付内容
+	var refunded uint32
+	var refundErr error
+	if refundable := order.PaidAmount() - order.RefundAmount; refundable > 0 {
+		refunded, refundErr = o.refundPaid(ctx, order, refundable)
+	}
+	remark := reason
+	if refundErr != nil {
+		logger.Log.Error(ctx, "orderApi CancelOrder refund err",
+			zap.Any("order", order),
+			zap.Uint32("refunded", refunded),
+			zap.String("reason", reason),
+			zap.Error(refundErr),
+		)
+		// 退款失败时转为需要人工介入, 避免订单被补偿推进后交付
+		newStatus = order_model.OrderStatus_UnableToAdvance
+		remark = fmt.Sprintf("cancel refund err: %v. reason: %s", refundErr, reason)
+	}
+
+	expect := order_model.UpdateExpect{Status: status, Version: &order.Version}
+	if refunded > 0 {
+		err = o.setCancelRefund(ctx, order, refunded, newStatus, remark, expect)
+	} else {
+		err = o.CompareAndUpdateOrderStatus(ctx, orderID, uid, nil, newStatus, remark, expect)
+	}
+	if err != nil {
+		return err
+	}
+	return refundErr
+}
+
+// 记录取消订单时的退款并变更订单状态
+func (o orderCli) setCancelRefund(ctx context.Context, order *order_model.Order, refunded uint32,
+	status order_model.OrderStatus, remark string, expect order_model.UpdateExpect) error {
+	var payLegs string
+	if len(order.PayLegs) > 0 {
+		var err error
+		payLegs, err = sonic.MarshalString(order.PayLegs)
+		if err != nil {
+			return err
+		}
+	}
+	order.RefundAmount += refunded
+	err := dao.Dao(order.Uid).SetRefund(ctx, order.OrderID, order.RefundAmount, payLegs, status, remark, expect, o.canTransition)
+	if err != nil {
+		logger.Log.Error(ctx, "orderApi CancelOrder refund finish but call SetRefund err",
+			zap.Any("order", order),
+			zap.Uint32("refunded", refunded),
+			zap.Int("status", int(status)),
+			zap.String("remark", remark),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
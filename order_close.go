@@ -0,0 +1,184 @@
+package order
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/zly-app/zapp/logger"
+	"go.uber.org/zap"
+
+	"github.com/zlyuancn/order/conf"
+	"github.com/zlyuancn/order/dao"
+	"github.com/zlyuancn/order/order_model"
+)
+
+/*
+关闭过期订单
+
+定时扫描各分表中已过期的推进中订单, 未支付的订单会被关闭. 用于先下单后付款时用户一直不付款的订单.
+混合支付中存在已支付的支付项时不会关闭, 而是转为需要人工介入, 避免已支付的金额被静默扣留.
+每个分表在每个扫描间隔内只会有一个实例在扫描.
+*/
+type orderCloser struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+var defOrderCloser *orderCloser
+
+// 开始关闭过期订单
+func startAutoClose() {
+	if !conf.Conf.AllowAutoClose {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defOrderCloser = &orderCloser{ctx: ctx, cancel: cancel}
+	defOrderCloser.wg.Add(1)
+	go func() {
+		defer defOrderCloser.wg.Done()
+		defOrderCloser.run()
+	}()
+}
+
+// 停止关闭过期订单, 会等待正在关闭的订单完成
+func stopAutoClose() {
+	if defOrderCloser == nil {
+		return
+	}
+	defOrderCloser.cancel()
+	defOrderCloser.wg.Wait()
+}
+
+func (c *orderCloser) run() {
+	t := time.NewTicker(time.Duration(conf.Conf.AutoCloseInterval) * time.Second)
+	defer t.Stop()
+	for {
+		for shard := uint32(0); shard < dao.ShardNums() && c.ctx.Err() == nil; shard++ {
+			c.scanShard(cast.ToString(shard))
+		}
+
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (c *orderCloser) scanShard(shard string) {
+	// 租约会在扫描间隔后过期, 避免其它实例在同一个间隔内重复扫描
+	key := c.genLockKey(shard)
+	ok, err := dao.GetLocker().Lease(c.ctx, key, int(conf.Conf.AutoCloseInterval))
+	if err != nil || !ok {
+		return
+	}
+
+	now := time.Now().Unix()
+	limit := uint(conf.Conf.AutoCloseBatchSize)
+	startID := uint(0)
+	for c.ctx.Err() == nil {
+		models, err := dao.DaoByShard(shard).ListExpired(c.ctx, order_model.OrderStatus_Forwarding, now, startID, limit)
+		if err != nil {
+			if c.ctx.Err() == nil {
+				logger.Log.Error(c.ctx, "orderApi autoClose ListExpired err",
+					zap.String("shard", shard),
+					zap.Uint("startID", startID),
+					zap.Error(err),
+				)
+			}
+			return
+		}
+
+		for _, model := range models {
+			if c.ctx.Err() != nil {
+				return
+			}
+			c.close(model.OrderID, model.Uid)
+		}
+
+		if len(models) < int(limit) {
+			return
+		}
+		startID = models[len(models)-1].ID
+	}
+}
+
+func (c *orderCloser) close(orderID, uid string) {
+	ctx := context.Background() // 服务退出时也需要完成正在关闭的订单
+	err := orderApi.closeExpiredOrder(ctx, orderID, uid)
+	if err == nil || err == OrderLockedErr || err == OrderVersionConflictErr {
+		return // 订单正在被处理, 等待下次扫描
+	}
+	logger.Log.Warn(ctx, "orderApi autoClose closeExpiredOrder err",
+		zap.String("orderID", orderID),
+		zap.String("uid", uid),
+		zap.Error(err),
+	)
+}
+
+func (c *orderCloser) genLockKey(shard string) string {
+	return strings.ReplaceAll(conf.Conf.AutoCloseLockKeyFormat, templateString_ShardNum, shard)
+}
+
+// 关闭已过期且未支付的推进中订单, 订单不满足条件时忽略
+func (o orderCli) closeExpiredOrder(ctx context.Context, orderID, uid string) error {
+	unlock, err := o.lockOrder(ctx, orderID, uid, "closeExpiredOrder")
+	if err != nil {
+		return err
+	}
+	defer unlock(ctx)
+
+	order, extendText, status, err := o.GetOrder(ctx, orderID, uid)
+	if err != nil {
+		return err
+	}
+	if !o.isExpiredUnpaid(order, status, time.Now().Unix()) {
+		return nil
+	}
+
+	ob, ok := o.GetOrderBusiness(order.OrderType)
+	if !ok {
+		return fmt.Errorf("orderApi closeExpiredOrder OrderType %v not found OrderBusiness", order.OrderType)
+	}
+	extend, err := o.parseExtend(ctx, ob, extendText)
+	if err != nil {
+		return fmt.Errorf("orderApi closeExpiredOrder Unmarshal extend err. orderID=%v, err=%v", order.OrderID, err)
+	}
+
+	// 部分支付项已支付, 关闭后这部分金额不会被退回
+	if order.HasCapturedPayLeg() {
+		return o.parkOrder(ctx, ob, order, extend, "order expired but some pay legs are captured")
+	}
+
+	// 带上版本号, 读取订单后写入了支付状态时不会关闭
+	status = order_model.OrderStatus_Closed
+	expect := order_model.UpdateExpect{Status: order_model.OrderStatus_Forwarding, Version: &order.Version}
+	err = o.CompareAndUpdateOrderStatus(ctx, orderID, uid, nil, status, "order expired", expect)
+	if err != nil {
+		return err
+	}
+
+	err = ob.ForwardAbnormalCallback(ctx, order, extend, status)
+	if err != nil {
+		logger.Log.Error(ctx, "orderApi closeExpiredOrder call ForwardAbnormalCallback err",
+			zap.Any("order", order),
+			zap.Any("extend", extend),
+			zap.Int("status", int(status)),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
+
+// 是否为已过期且未支付的推进中订单
+func (orderCli) isExpiredUnpaid(order *order_model.Order, status order_model.OrderStatus, now int64) bool {
+	return status == order_model.OrderStatus_Forwarding && order.PayStatus != order_model.OrderPayStatus_Success &&
+		order.ExpireAt > 0 && order.ExpireAt <= now
+}
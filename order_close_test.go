@@ -0,0 +1,50 @@
+package order
+
+import (
+	"testing"
+
+	"github.com/zlyuancn/order/order_model"
+)
+
+func TestIsExpiredUnpaid(t *testing.T) {
+	const now = 1700000000
+	tests := []struct {
+		name   string
+		order  *order_model.Order
+		status order_model.OrderStatus
+		want   bool
+	}{
+		{"expired", &order_model.Order{ExpireAt: now}, order_model.OrderStatus_Forwarding, true},
+		{"not expired", &order_model.Order{ExpireAt: now + 1}, order_model.OrderStatus_Forwarding, false},
+		{"never expire", &order_model.Order{}, order_model.OrderStatus_Forwarding, false},
+		{"paid", &order_model.Order{ExpireAt: now, PayStatus: order_model.OrderPayStatus_Success}, order_model.OrderStatus_Forwarding, false},
+		{"not forwarding", &order_model.Order{ExpireAt: now}, order_model.OrderStatus_UnableToAdvance, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := orderApi.isExpiredUnpaid(tt.order, tt.status, now); got != tt.want {
+				t.Errorf("isExpiredUnpaid = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpiredOrderWithCapturedPayLeg(t *testing.T) {
+	const now = 1700000000
+	// 外部支付的支付项已支付, 余额支付项还未扣款, 订单整体仍是未支付
+	order := &order_model.Order{ExpireAt: now, PayLegs: []*order_model.OrderPayLeg{
+		{PayType: testPayType_External, PayStatus: order_model.OrderPayStatus_Success, PayAmount: 100},
+		{PayType: testPayType_Balance, PayAmount: 100},
+	}}
+	if !orderApi.isExpiredUnpaid(order, order_model.OrderStatus_Forwarding, now) {
+		t.Fatal("partly paid order should be expired unpaid")
+	}
+	if !order.HasCapturedPayLeg() {
+		t.Fatal("partly paid order should be parked instead of closed")
+	}
+
+	order.PayLegs[0].RefundAmount = 100
+	if order.HasCapturedPayLeg() {
+		t.Fatal("refunded pay leg should not block closing")
+	}
+}
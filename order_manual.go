@@ -0,0 +1,299 @@
+package order
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/zly-app/zapp/logger"
+	"go.uber.org/zap"
+
+	"github.com/zlyuancn/order/conf"
+	"github.com/zlyuancn/order/dao"
+	"github.com/zlyuancn/order/order_model"
+)
+
+/*
+推进失败处理, 推进失败次数或订单存活时间超过配置的阈值后会将订单转为需要人工介入
+
+	cause 推进失败的原因
+
+返回值为推进的最终错误, 转为需要人工介入后返回 OrderUnableToAdvanceErr
+*/
+func (o orderCli) forwardFailed(ctx context.Context, ob order_model.OrderBusiness, order *order_model.Order,
+	extend interface{}, cause error) error {
+	if cause == OrderPayNotSettledErr { // 等待用户支付不算推进失败
+		return cause
+	}
+	if cause == OrderUnableToAdvanceErr { // 已转为需要人工介入
+		return cause
+	}
+	if conf.Conf.ForwardMaxAttempts == 0 && conf.Conf.ForwardMaxAge == 0 {
+		return cause
+	}
+
+	forwardNums, ctime, err := dao.Dao(order.Uid).IncrForwardNums(ctx, order.OrderID)
+	if err != nil {
+		logger.Log.Error(ctx, "orderApi forwardFailed IncrForwardNums err",
+			zap.Any("order", order),
+			zap.Error(err),
+		)
+		return cause
+	}
+	if !o.forwardExceeded(forwardNums, ctime, time.Now().Unix()) {
+		return cause
+	}
+
+	remark := fmt.Sprintf("unable to advance after %d attempts: %v", forwardNums, cause)
+	err = o.parkOrder(ctx, ob, order, extend, remark)
+	if err != nil {
+		return err
+	}
+	return OrderUnableToAdvanceErr
+}
+
+// 推进失败次数或订单存活时间是否超过配置的阈值
+func (orderCli) forwardExceeded(forwardNums uint32, ctime, now int64) bool {
+	if conf.Conf.ForwardMaxAttempts > 0 && int(forwardNums) >= conf.Conf.ForwardMaxAttempts {
+		return true
+	}
+	return conf.Conf.ForwardMaxAge > 0 && now-ctime >= conf.Conf.ForwardMaxAge
+}
+
+// 将订单转为需要人工介入
+func (o orderCli) parkOrder(ctx context.Context, ob order_model.OrderBusiness, order *order_model.Order,
+	extend interface{}, remark string) error {
+	status := order_model.OrderStatus_UnableToAdvance
+	logger.Log.Warn(ctx, "orderApi parkOrder order unable to advance",
+		zap.Any("order", order),
+		zap.String("remark", remark),
+	)
+	err := o.CompareAndUpdateOrderStatus(ctx, order.OrderID, order.Uid, nil, status, remark, expectForwarding)
+	if err != nil {
+		logger.Log.Error(ctx, "orderApi parkOrder call UpdateOrderStatus err",
+			zap.Any("order", order),
+			zap.String("remark", remark),
+			zap.Error(err),
+		)
+		return err
+	}
+	err = ob.ForwardAbnormalCallback(ctx, order, extend, status)
+	if err != nil {
+		logger.Log.Error(ctx, "orderApi parkOrder call ForwardAbnormalCallback err",
+			zap.Any("order", order),
+			zap.Any("extend", extend),
+			zap.Int("status", int(status)),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
+
+// 补偿mq消息存活超过 CompensationMQMsgLifeTime 后补偿失败, 不再重试, 将仍在推进中的订单转为需要人工介入
+func (o orderCli) parkExpiredOrder(ctx context.Context, orderID, uid string) error {
+	unlock, err := o.lockOrder(ctx, orderID, uid, "parkExpiredOrder")
+	if err != nil {
+		return err
+	}
+	defer unlock(ctx)
+
+	order, extendText, status, err := o.GetOrder(ctx, orderID, uid)
+	if err != nil {
+		if err == OrderNotFoundErr {
+			return nil
+		}
+		return err
+	}
+	if status != order_model.OrderStatus_Forwarding {
+		return nil
+	}
+	if o.payNotSettled(order) { // 等待用户支付不算推进失败
+		return nil
+	}
+
+	ob, ok := o.GetOrderBusiness(order.OrderType)
+	if !ok {
+		return fmt.Errorf("orderApi parkExpiredOrder OrderType %v not found OrderBusiness", order.OrderType)
+	}
+	extend, err := o.parseExtend(ctx, ob, extendText)
+	if err != nil {
+		return fmt.Errorf("orderApi parkExpiredOrder Unmarshal extend err. orderID=%v, err=%v", orderID, err)
+	}
+	return o.parkOrder(ctx, ob, order, extend, "compensation mq msg expired")
+}
+
+/*
+跨分片查询需要人工介入的订单
+
+	cursor 分页游标, 零值表示从头开始
+	limit 最多返回多少条数据
+
+返回下一页的游标, 为nil表示没有更多数据了
+*/
+func (o orderCli) ListUnableToAdvanceOrders(ctx context.Context, cursor order_model.ShardCursor, limit int) (
+	[]*order_model.OrderDetail, *order_model.ShardCursor, error) {
+	if limit < 1 {
+		return nil, nil, fmt.Errorf("orderApi ListUnableToAdvanceOrders limit must be greater than 0")
+	}
+
+	var ret []*order_model.OrderDetail
+	for shard := cursor.Shard; shard < dao.ShardNums(); shard++ {
+		startID := uint(0)
+		if shard == cursor.Shard {
+			startID = cursor.ID
+		}
+
+		models, err := dao.DaoByShard(cast.ToString(shard)).ListByStatus(ctx, order_model.OrderStatus_UnableToAdvance,
+			startID, uint(limit-len(ret)))
+		if err != nil {
+			logger.Log.Error(ctx, "orderApi ListUnableToAdvanceOrders ListByStatus err",
+				zap.Uint32("shard", shard),
+				zap.Uint("startID", startID),
+				zap.Error(err),
+			)
+			return nil, nil, err
+		}
+		for _, model := range models {
+			order, err := o.model2Order(model)
+			if err != nil {
+				return nil, nil, err
+			}
+			ret = append(ret, &order_model.OrderDetail{
+				Order:  order,
+				Extend: model.Extend,
+				Status: order_model.OrderStatus(model.OrderStatus),
+				Remark: model.Remark,
+			})
+		}
+		if len(ret) >= limit {
+			next := &order_model.ShardCursor{Shard: shard, ID: models[len(models)-1].ID}
+			return ret, next, nil
+		}
+	}
+	return ret, nil, nil
+}
+
+// 需要人工介入订单状态变更的乐观锁条件
+var expectUnableToAdvance = order_model.UpdateExpect{Status: order_model.OrderStatus_UnableToAdvance}
+
+// 生成人工操作的备注
+func (orderCli) operatorRemark(operator, remark string) string {
+	return fmt.Sprintf("operator=%s: %s", operator, remark)
+}
+
+// 加锁并获取需要人工介入的订单
+func (o orderCli) lockUnableToAdvanceOrder(ctx context.Context, orderID, uid, method string) (
+	order *order_model.Order, ob order_model.OrderBusiness, extend interface{}, unlock func(ctx context.Context), err error) {
+	unlock, err = o.lockOrder(ctx, orderID, uid, method)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	order, extendText, status, err := o.GetOrder(ctx, orderID, uid)
+	if err != nil {
+		unlock(ctx)
+		return nil, nil, nil, nil, err
+	}
+	if status != order_model.OrderStatus_UnableToAdvance {
+		unlock(ctx)
+		logger.Log.Warn(ctx, "orderApi "+method+" order not is UnableToAdvance status",
+			zap.Any("order", order),
+			zap.Int("status", int(status)),
+		)
+		return nil, nil, nil, nil, OrderStatusNotMatchErr
+	}
+
+	ob, ok := o.GetOrderBusiness(order.OrderType)
+	if !ok {
+		unlock(ctx)
+		return nil, nil, nil, nil, fmt.Errorf("orderApi %s OrderType %v not found OrderBusiness", method, order.OrderType)
+	}
+	extend, err = o.parseExtend(ctx, ob, extendText)
+	if err != nil {
+		unlock(ctx)
+		return nil, nil, nil, nil, fmt.Errorf("orderApi %s Unmarshal extend err. orderID=%v, err=%v", method, orderID, err)
+	}
+	return order, ob, extend, unlock, nil
+}
+
+/*
+人工重试需要人工介入的订单, 订单会重新转为推进中状态并立即推进
+
+	operator 操作人, 会记录到备注中
+*/
+func (o orderCli) ForceRetry(ctx context.Context, orderID, uid, operator string) (
+	*order_model.Order, order_model.OrderStatus, error) {
+	order, ob, extend, unlock, err := o.lockUnableToAdvanceOrder(ctx, orderID, uid, "ForceRetry")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer unlock(ctx)
+
+	status := order_model.OrderStatus_Forwarding
+	err = o.CompareAndUpdateOrderStatus(ctx, orderID, uid, nil, status, o.operatorRemark(operator, "force retry"), expectUnableToAdvance)
+	if err != nil {
+		return nil, 0, err
+	}
+	return o.forwardOrder(ctx, ob, order, extend, status)
+}
+
+/*
+人工完成需要人工介入的订单, 一般用于人工补发后结束订单, 会调用业务层的 ForwardFinishCallback
+
+	operator 操作人, 会记录到备注中
+*/
+func (o orderCli) ForceFinish(ctx context.Context, orderID, uid, operator, remark string) error {
+	order, ob, extend, unlock, err := o.lockUnableToAdvanceOrder(ctx, orderID, uid, "ForceFinish")
+	if err != nil {
+		return err
+	}
+	defer unlock(ctx)
+
+	status := order_model.OrderStatus_Finish
+	err = o.CompareAndUpdateOrderStatus(ctx, orderID, uid, nil, status, o.operatorRemark(operator, remark), expectUnableToAdvance)
+	if err != nil {
+		return err
+	}
+	err = ob.ForwardFinishCallback(ctx, order, extend)
+	if err != nil {
+		logger.Log.Error(ctx, "orderApi ForceFinish call ForwardFinishCallback err",
+			zap.Any("order", order),
+			zap.Any("extend", extend),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
+
+/*
+人工取消需要人工介入的订单, 会调用业务层的 ForwardAbnormalCallback. 不会自动退款, 如有需要请调用 RefundOrder
+
+	operator 操作人, 会记录到备注中
+*/
+func (o orderCli) ForceCancel(ctx context.Context, orderID, uid, operator, remark string) error {
+	order, ob, extend, unlock, err := o.lockUnableToAdvanceOrder(ctx, orderID, uid, "ForceCancel")
+	if err != nil {
+		return err
+	}
+	defer unlock(ctx)
+
+	status := order_model.OrderStatus_BusinessCancelForward
+	err = o.CompareAndUpdateOrderStatus(ctx, orderID, uid, nil, status, o.operatorRemark(operator, remark), expectUnableToAdvance)
+	if err != nil {
+		return err
+	}
+	err = ob.ForwardAbnormalCallback(ctx, order, extend, status)
+	if err != nil {
+		logger.Log.Error(ctx, "orderApi ForceCancel call ForwardAbnormalCallback err",
+			zap.Any("order", order),
+			zap.Any("extend", extend),
+			zap.Int("status", int(status)),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
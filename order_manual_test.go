@@ -0,0 +1,68 @@
+package order
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/zlyuancn/order/conf"
+	"github.com/zlyuancn/order/order_model"
+)
+
+func TestForwardExceeded(t *testing.T) {
+	old := conf.Conf
+	defer func() { conf.Conf = old }()
+
+	const ctime = 1700000000
+	tests := []struct {
+		name        string
+		maxAttempts int
+		maxAge      int64
+		forwardNums uint32
+		now         int64
+		want        bool
+	}{
+		{"unlimited", 0, 0, 100, ctime + 1000000, false},
+		{"attempts below", 3, 0, 2, ctime, false},
+		{"attempts reached", 3, 0, 3, ctime, true},
+		{"age below", 0, 60, 100, ctime + 59, false},
+		{"age reached", 0, 60, 1, ctime + 60, true},
+		{"either reached", 3, 60, 1, ctime + 60, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf.Conf.ForwardMaxAttempts = tt.maxAttempts
+			conf.Conf.ForwardMaxAge = tt.maxAge
+			if got := orderApi.forwardExceeded(tt.forwardNums, ctime, tt.now); got != tt.want {
+				t.Errorf("forwardExceeded = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardFailedUnlimited(t *testing.T) {
+	old := conf.Conf
+	defer func() { conf.Conf = old }()
+	conf.Conf.ForwardMaxAttempts = 0
+	conf.Conf.ForwardMaxAge = 0
+
+	// 不限制时直接返回推进失败的原因, 不会访问数据库
+	cause := errors.New("deliver failed")
+	order := &order_model.Order{OrderID: "o1", Uid: "u1"}
+	if err := orderApi.forwardFailed(context.Background(), nil, order, nil, cause); err != cause {
+		t.Errorf("forwardFailed = %v, want cause", err)
+	}
+
+	// 已转为需要人工介入时不会重复计数
+	conf.Conf.ForwardMaxAttempts = 1
+	err := orderApi.forwardFailed(context.Background(), nil, order, nil, OrderUnableToAdvanceErr)
+	if err != OrderUnableToAdvanceErr {
+		t.Errorf("forwardFailed = %v, want OrderUnableToAdvanceErr", err)
+	}
+}
+
+func TestOperatorRemark(t *testing.T) {
+	if got := orderApi.operatorRemark("op1", "force retry"); got != "operator=op1: force retry" {
+		t.Errorf("operatorRemark = %q", got)
+	}
+}
@@ -0,0 +1,148 @@
+package order
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/zly-app/zapp/logger"
+	"go.uber.org/zap"
+
+	"github.com/zlyuancn/order/conf"
+	"github.com/zlyuancn/order/dao"
+	"github.com/zlyuancn/order/order_model"
+)
+
+// 有分表被其它实例复制或复制失败时的重试间隔
+const migrateCopyRetryInterval = time.Minute
+
+/*
+扩容迁移复制存量数据
+
+在 copy 阶段把当前布局各分表中的订单按迁移布局重新分片后复制过去, 包括流水和第三方支付订单id映射.
+每批复制和检查点在同一个事务中提交, 中断后从检查点继续. 同一个分表同时只会有一个实例在复制, 所有分表复制完成后退出.
+复制期间的订单变更由同步写入保证一致, 所以需要在所有实例都进入 dual_write 阶段后再进入 copy 阶段.
+*/
+type migrateCopier struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+var defMigrateCopier *migrateCopier
+
+// 开始复制存量数据
+func startMigrateCopy() {
+	if conf.Conf.MigrateStage != conf.MigrateStage_Copy {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defMigrateCopier = &migrateCopier{ctx: ctx, cancel: cancel}
+	defMigrateCopier.wg.Add(1)
+	go func() {
+		defer defMigrateCopier.wg.Done()
+		defMigrateCopier.run()
+	}()
+}
+
+// 停止复制存量数据, 未提交的一批会回滚
+func stopMigrateCopy() {
+	if defMigrateCopier == nil {
+		return
+	}
+	defMigrateCopier.cancel()
+	defMigrateCopier.wg.Wait()
+}
+
+func (c *migrateCopier) run() {
+	src := dao.CurrentLayout()
+	dst, _ := dao.MigrateLayout()
+
+	t := time.NewTicker(migrateCopyRetryInterval)
+	defer t.Stop()
+	for {
+		finished := true
+		for shard := uint32(0); shard < src.ShardNums && c.ctx.Err() == nil; shard++ {
+			if !c.copyShard(src, dst, cast.ToString(shard)) {
+				finished = false
+			}
+		}
+		if finished && c.ctx.Err() == nil {
+			logger.Log.Info(c.ctx, "orderApi migrateCopy all shards finished",
+				zap.String("version", src.Version),
+				zap.String("migrateVersion", dst.Version),
+			)
+			return
+		}
+
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// 复制一个分表, 返回是否已复制完成
+func (c *migrateCopier) copyShard(src, dst dao.Layout, shard string) bool {
+	key := c.genLockKey(src.TableSuffix(shard))
+	unlock, ok, err := dao.GetLocker().Lock(c.ctx, key, conf.Conf.OrderLockDBExpire, true)
+	if err != nil || !ok {
+		return false
+	}
+	defer unlock(context.Background())
+
+	limit := uint(conf.Conf.MigrateCopyBatchSize)
+	for c.ctx.Err() == nil {
+		cp, err := dao.MigrateCopyBatch(c.ctx, src, shard, dst, limit)
+		if err != nil {
+			if c.ctx.Err() == nil {
+				logger.Log.Error(c.ctx, "orderApi migrateCopy MigrateCopyBatch err",
+					zap.String("shard", shard),
+					zap.Error(err),
+				)
+			}
+			return false
+		}
+		if cp.Finished == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *migrateCopier) genLockKey(shard string) string {
+	return strings.ReplaceAll(conf.Conf.MigrateCopyLockKeyFormat, templateString_ShardNum, shard)
+}
+
+// 获取扩容迁移复制存量数据的进度, 按当前布局的分片排列. 不在扩容迁移时返回 OrderNotMigratingErr
+func (o orderCli) GetMigrateProgress(ctx context.Context) ([]*order_model.MigrateProgress, error) {
+	dst, ok := dao.MigrateLayout()
+	if !ok {
+		return nil, OrderNotMigratingErr
+	}
+
+	src := dao.CurrentLayout()
+	ret := make([]*order_model.MigrateProgress, 0, src.ShardNums)
+	for shard := uint32(0); shard < src.ShardNums; shard++ {
+		srcTab := dao.TableName + src.TableSuffix(cast.ToString(shard))
+		cp, err := dao.GetMigrateCheckpoint(ctx, srcTab, dst.Version)
+		if err != nil {
+			return nil, err
+		}
+		maxID, err := dao.GetMaxOrderRecordID(ctx, src, cast.ToString(shard))
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, &order_model.MigrateProgress{
+			Shard:    shard,
+			LastID:   cp.LastID,
+			MaxID:    maxID,
+			Finished: cp.Finished == 1,
+		})
+	}
+	return ret, nil
+}
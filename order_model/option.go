@@ -0,0 +1,19 @@
+package order_model
+
+import (
+	"context"
+	"time"
+)
+
+type lockWaitKey struct{}
+
+// 设置本次调用在订单锁被占用时最多等待多少时间, 会覆盖配置的 OrderLockWaitTime, 0表示不等待
+func WithLockWait(ctx context.Context, wait time.Duration) context.Context {
+	return context.WithValue(ctx, lockWaitKey{}, wait)
+}
+
+// 获取本次调用设置的订单锁等待时间
+func GetLockWait(ctx context.Context) (time.Duration, bool) {
+	wait, ok := ctx.Value(lockWaitKey{}).(time.Duration)
+	return wait, ok
+}
@@ -0,0 +1,45 @@
+package order_model
+
+import (
+	"context"
+)
+
+// 订单流水类型
+type OrderLogType byte
+
+const (
+	OrderLogType_Create    OrderLogType = 1 // 创建订单
+	OrderLogType_Status    OrderLogType = 2 // 订单状态变更
+	OrderLogType_PayStatus OrderLogType = 3 // 支付状态变更
+	OrderLogType_Refund    OrderLogType = 4 // 退款
+)
+
+// 订单变动流水
+type OrderLog struct {
+	OrderID string       // 订单id
+	Uid     string       // 用户唯一标识
+	LogType OrderLogType // 流水类型
+
+	OldStatus    OrderStatus    // 变更前订单状态
+	NewStatus    OrderStatus    // 变更后订单状态
+	OldPayStatus OrderPayStatus // 变更前支付状态
+	NewPayStatus OrderPayStatus // 变更后支付状态
+
+	Extend string // 变更后的扩展数据快照
+	Remark string // 备注
+	Caller string // 调用方
+	Ctime  int64  // 创建时间, 秒级时间戳
+}
+
+type callerKey struct{}
+
+// 设置调用方, 会记录到订单变动流水中. 未设置时使用app名
+func WithCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// 获取调用方
+func GetCaller(ctx context.Context) string {
+	caller, _ := ctx.Value(callerKey{}).(string)
+	return caller
+}
@@ -2,6 +2,7 @@ package order_model
 
 import (
 	"context"
+	"errors"
 )
 
 // 订单类型
@@ -18,6 +19,7 @@ const (
 	OrderStatus_InsufficientBalance   OrderStatus = 4 // 余额不足
 	OrderStatus_ReturnedBalance       OrderStatus = 5 // 已退回余额
 	OrderStatus_UnableToAdvance       OrderStatus = 6 // 无法向前推进业务, 需要人工介入
+	OrderStatus_Closed                OrderStatus = 7 // 超过过期时间未支付, 已关闭
 )
 
 // 订单使用的支付类型
@@ -46,14 +48,117 @@ type Order struct {
 	PayStatus       OrderPayStatus // 支付状态
 	PayAmount       uint32         // 付费金额, 单位分
 	ThirdPayOrderID string         // 第三方支付订单id
+	PayLegs         []*OrderPayLeg // 混合支付的支付项, 不为空时表示混合支付, 付费金额为所有支付项之和, 所有支付项都完成支付后订单才算支付完成
+	RefundAmount    uint32         // 已退款金额, 单位分
 
-	Uid string // 用户唯一标识
+	Uid      string // 用户唯一标识
+	Ctime    int64  // 创建时间, 秒级时间戳. 创建订单时无需设置
+	Version  uint32 // 订单版本号, 订单数据每次更新后加1, 可用于 UpdateExpect. 创建订单时无需设置
+	ExpireAt int64  // 过期时间, 秒级时间戳, 为0表示不过期. 过期后仍未支付的推进中订单会被关闭, 需要开启 AllowAutoClose
+}
+
+// 更新订单状态时的乐观锁条件, 零值表示不检查. 条件不满足时更新失败并返回 OrderVersionConflictErr
+type UpdateExpect struct {
+	Status  OrderStatus // 期望的当前订单状态, 为0表示不检查
+	Version *uint32     // 期望的当前订单版本号, 为nil表示不检查
+}
+
+// 订单详情
+type OrderDetail struct {
+	Order  *Order      // 订单数据
+	Extend string      // 扩展数据
+	Status OrderStatus // 订单状态
+	Remark string      // 备注
+}
+
+// 用户订单, 扩展数据已解析
+type UserOrder struct {
+	Order  *Order      // 订单数据
+	Extend interface{} // 扩展数据, 由订单类型的业务层 NewExtendStruct 解析. 订单类型未注册业务时为原始json字符串
+	Status OrderStatus // 订单状态
+	Remark string      // 备注
+}
+
+// 用户订单查询条件, 零值字段表示不过滤
+type UserOrderFilter struct {
+	OrderTypes  []OrderType     // 订单类型
+	OrderStatus []OrderStatus   // 订单状态
+	PayStatus   *OrderPayStatus // 支付状态, 为nil表示不过滤
+	CtimeStart  int64           // 创建时间不早于, 秒级时间戳
+	CtimeEnd    int64           // 创建时间早于, 秒级时间戳
+	Cursor      uint            // 分页游标, 返回比游标更早创建的订单, 为0表示从最新的订单开始
+	Limit       int             // 最多返回多少条数据
+}
+
+// 扩容迁移复制存量数据的进度
+type MigrateProgress struct {
+	Shard    uint32 // 源分片
+	LastID   uint   // 已复制的最大订单记录id
+	MaxID    uint   // 源分表当前最大的订单记录id
+	Finished bool   // 是否已复制完成
+}
+
+// 分片游标, 用于跨分片分页查询, 零值表示从头开始
+type ShardCursor struct {
+	Shard uint32 // 分片
+	ID    uint   // 分片中的记录id, 下一页从大于这个id的记录开始
+}
+
+// 支付项
+type OrderPayLeg struct {
+	PayType         OrderPayType   // 支付类型
+	PayStatus       OrderPayStatus // 支付状态
+	PayAmount       uint32         // 付费金额, 单位分
+	ThirdPayOrderID string         `json:",omitempty"` // 第三方支付订单id
+	RefundAmount    uint32         `json:",omitempty"` // 已退款金额, 单位分
+}
+
+// 是否所有支付项都已完成支付
+func (o *Order) PayLegsSettled() bool {
+	for _, leg := range o.PayLegs {
+		if leg.PayStatus != OrderPayStatus_Success {
+			return false
+		}
+	}
+	return true
+}
+
+// 已支付金额, 混合支付未全部完成支付时为已支付的支付项金额之和
+func (o *Order) PaidAmount() uint32 {
+	if o.PayStatus == OrderPayStatus_Success {
+		return o.PayAmount
+	}
+	var amount uint32
+	for _, leg := range o.PayLegs {
+		if leg.PayStatus == OrderPayStatus_Success {
+			amount += leg.PayAmount
+		}
+	}
+	return amount
+}
+
+// 是否存在已支付且未全额退款的支付项, 无需支付的支付项不计算在内
+func (o *Order) HasCapturedPayLeg() bool {
+	for _, leg := range o.PayLegs {
+		if leg.PayStatus == OrderPayStatus_Success && leg.PayType != OrderPayType_None && leg.RefundAmount < leg.PayAmount {
+			return true
+		}
+	}
+	return false
 }
 
 // 订单在mq中的数据
 type OrderMqMsg struct {
 	OrderID string // 订单id
-	Uid     string // uid, 主要用于确定订单数据在db哪个表上
+	Uid     string `json:",omitempty"` // uid, 主要用于确定订单数据在db哪个表上. 为空时从订单号中解析分片
+}
+
+// 从订单号中解析出的信息
+type OIDInfo struct {
+	Kind      string    // 生成器标识
+	OrderType OrderType // 订单类型
+	Shard     string    // 分片
+	Uid       string    // uid, 只有 GenOIDByUserOID/GenOIDByThirdPayOID 生成且uid和后面的部分不包含'-'时才能解析出来, 否则为空
 }
 
 // -----------------
@@ -61,6 +166,8 @@ type OrderMqMsg struct {
 // -----------------
 
 var _ OrderBusiness = (*OrderBusinessWrap)(nil)
+var _ OrderRefunder = (*OrderBusinessWrap)(nil)
+var _ OrderCanceler = (*OrderBusinessWrap)(nil)
 
 type OrderBusinessWrap struct {
 	// 返回扩展数据的结构
@@ -73,6 +180,10 @@ type OrderBusinessWrap struct {
 	OrderForwardAbnormalCallback func(ctx context.Context, order *Order, extend interface{}, status OrderStatus) error
 	// 推进订单完成回调
 	OrderForwardFinishCallback func(ctx context.Context, order *Order, extend interface{}) error
+	// 退款回调, 订单系统会在退款成功并记录后调用这个方法, 业务层应该在这里撤回已退款部分对应的交付内容. 为nil表示不需要退款回调
+	OrderRefundCallback func(ctx context.Context, order *Order, extend interface{}, amount uint32, reason string) error
+	// 取消订单回调, 用户主动取消订单时会在变更订单状态前调用这个方法, 返回err会取消这次取消操作. 为nil表示不需要取消回调
+	OrderCancelCallback func(ctx context.Context, order *Order, extend interface{}, reason string) error
 }
 
 func (o *OrderBusinessWrap) NewExtendStruct(ctx context.Context) interface{} {
@@ -105,6 +216,18 @@ func (o *OrderBusinessWrap) ForwardFinishCallback(ctx context.Context, order *Or
 	}
 	return nil
 }
+func (o *OrderBusinessWrap) RefundCallback(ctx context.Context, order *Order, extend interface{}, amount uint32, reason string) error {
+	if o.OrderRefundCallback != nil {
+		return o.OrderRefundCallback(ctx, order, extend, amount, reason)
+	}
+	return nil
+}
+func (o *OrderBusinessWrap) CancelCallback(ctx context.Context, order *Order, extend interface{}, reason string) error {
+	if o.OrderCancelCallback != nil {
+		return o.OrderCancelCallback(ctx, order, extend, reason)
+	}
+	return nil
+}
 
 // 订单业务层
 type OrderBusiness interface {
@@ -119,3 +242,106 @@ type OrderBusiness interface {
 	// 推进订单完成回调
 	ForwardFinishCallback(ctx context.Context, order *Order, extend interface{}) error
 }
+
+// 订单退款回调, OrderBusiness 可以选择实现
+type OrderRefunder interface {
+	/*退款回调, 订单系统会在退款成功并记录后调用这个方法, 业务层应该在这里撤回已退款部分对应的交付内容
+	  amount 本次实际退款金额
+	  返回err时退款已经完成, 不会重复调用, 需要业务层自行处理撤回失败
+	*/
+	RefundCallback(ctx context.Context, order *Order, extend interface{}, amount uint32, reason string) error
+}
+
+// 取消订单回调, OrderBusiness 可以选择实现
+type OrderCanceler interface {
+	/*取消订单回调, 用户主动取消订单时会在变更订单状态前调用这个方法, 业务层应该在这里检查并撤回订单相关的数据
+	  返回err会取消这次取消操作. 取消后的退款不会再调用 RefundCallback
+	*/
+	CancelCallback(ctx context.Context, order *Order, extend interface{}, reason string) error
+}
+
+// 获取业务层的退款回调, 未实现 OrderRefunder 或 OrderBusinessWrap 未设置 OrderRefundCallback 时返回false
+func AsOrderRefunder(ob OrderBusiness) (OrderRefunder, bool) {
+	if w, ok := ob.(*OrderBusinessWrap); ok {
+		return w, w.OrderRefundCallback != nil
+	}
+	r, ok := ob.(OrderRefunder)
+	return r, ok
+}
+
+// 获取业务层的取消订单回调, 未实现 OrderCanceler 或 OrderBusinessWrap 未设置 OrderCancelCallback 时返回false
+func AsOrderCanceler(ob OrderBusiness) (OrderCanceler, bool) {
+	if w, ok := ob.(*OrderBusinessWrap); ok {
+		return w, w.OrderCancelCallback != nil
+	}
+	c, ok := ob.(OrderCanceler)
+	return c, ok
+}
+
+// -----------------
+//   pay provider
+// -----------------
+
+var _ PayProvider = (*PayProviderWrap)(nil)
+
+type PayProviderWrap struct {
+	// 扣款, payID 唯一标识一次扣款, 同一个 payID 重复扣款应该只扣一次. 余额不足时返回 ok=false, 返回err会让mq重试
+	PayDeduct func(ctx context.Context, order *Order, payID string, amount uint32) (ok bool, err error)
+	// 退款, payID 为扣款时的 payID, order.RefundAmount 为本次退款前的已退款金额, 可以和 payID 组合保证退款幂等
+	PayRefund func(ctx context.Context, order *Order, payID string, amount uint32) error
+	// 查询扣款状态, 订单系统会在扣款前调用这个方法, 防止扣款成功但更新订单失败后重试导致重复扣款
+	PayQuery func(ctx context.Context, order *Order, payID string) (OrderPayStatus, error)
+}
+
+func (p *PayProviderWrap) Deduct(ctx context.Context, order *Order, payID string, amount uint32) (ok bool, err error) {
+	if p.PayDeduct != nil {
+		return p.PayDeduct(ctx, order, payID, amount)
+	}
+	return false, errors.New("PayProviderWrap PayDeduct is nil")
+}
+func (p *PayProviderWrap) Refund(ctx context.Context, order *Order, payID string, amount uint32) error {
+	if p.PayRefund != nil {
+		return p.PayRefund(ctx, order, payID, amount)
+	}
+	return errors.New("PayProviderWrap PayRefund is nil")
+}
+func (p *PayProviderWrap) Query(ctx context.Context, order *Order, payID string) (OrderPayStatus, error) {
+	if p.PayQuery != nil {
+		return p.PayQuery(ctx, order, payID)
+	}
+	return OrderPayStatus_None, nil
+}
+
+// 支付提供者, 用于订单系统主动扣除/退回内部货币
+type PayProvider interface {
+	// 扣款, payID 唯一标识一次扣款, 同一个 payID 重复扣款应该只扣一次. 余额不足时返回 ok=false, 返回err会让mq重试
+	Deduct(ctx context.Context, order *Order, payID string, amount uint32) (ok bool, err error)
+	// 退款, payID 为扣款时的 payID, order.RefundAmount 为本次退款前的已退款金额, 可以和 payID 组合保证退款幂等
+	Refund(ctx context.Context, order *Order, payID string, amount uint32) error
+	// 查询扣款状态, 订单系统会在扣款前调用这个方法, 防止扣款成功但更新订单失败后重试导致重复扣款
+	Query(ctx context.Context, order *Order, payID string) (OrderPayStatus, error)
+}
+
+// -----------------
+//   oid generator
+// -----------------
+
+var _ OIDGenerator = (*OIDGeneratorWrap)(nil)
+
+type OIDGeneratorWrap struct {
+	// 生成订单号, 格式应该为 order-<生成器标识>-<订单类型>-<分片>-<唯一标识>, 以便从订单号中解析出订单类型和分片
+	GeneratorGenOID func(ctx context.Context, orderType OrderType, shard string) (string, error)
+}
+
+func (g *OIDGeneratorWrap) GenOID(ctx context.Context, orderType OrderType, shard string) (string, error) {
+	if g.GeneratorGenOID != nil {
+		return g.GeneratorGenOID(ctx, orderType, shard)
+	}
+	return "", errors.New("OIDGeneratorWrap GeneratorGenOID is nil")
+}
+
+// 订单号生成器
+type OIDGenerator interface {
+	// 生成订单号, 格式应该为 order-<生成器标识>-<订单类型>-<分片>-<唯一标识>, 以便从订单号中解析出订单类型和分片
+	GenOID(ctx context.Context, orderType OrderType, shard string) (string, error)
+}
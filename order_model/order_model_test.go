@@ -0,0 +1,110 @@
+package order_model
+
+import (
+	"context"
+	"testing"
+)
+
+// 只实现了 OrderBusiness 的业务层
+type plainBusiness struct{}
+
+func (plainBusiness) NewExtendStruct(ctx context.Context) interface{} { return nil }
+func (plainBusiness) CanForward(ctx context.Context, order *Order, extend interface{}) (string, error) {
+	return "", nil
+}
+func (plainBusiness) Delivery(ctx context.Context, order *Order, extend interface{}) error {
+	return nil
+}
+func (plainBusiness) ForwardAbnormalCallback(ctx context.Context, order *Order, extend interface{}, status OrderStatus) error {
+	return nil
+}
+func (plainBusiness) ForwardFinishCallback(ctx context.Context, order *Order, extend interface{}) error {
+	return nil
+}
+
+// 实现了可选回调的业务层
+type fullBusiness struct{ plainBusiness }
+
+func (fullBusiness) RefundCallback(ctx context.Context, order *Order, extend interface{}, amount uint32, reason string) error {
+	return nil
+}
+func (fullBusiness) CancelCallback(ctx context.Context, order *Order, extend interface{}, reason string) error {
+	return nil
+}
+
+func TestAsOptionalCallback(t *testing.T) {
+	noop := func(ctx context.Context, order *Order, extend interface{}, reason string) error { return nil }
+	noopRefund := func(ctx context.Context, order *Order, extend interface{}, amount uint32, reason string) error {
+		return nil
+	}
+
+	tests := []struct {
+		name       string
+		ob         OrderBusiness
+		wantRefund bool
+		wantCancel bool
+	}{
+		{"empty wrap", &OrderBusinessWrap{}, false, false},
+		{"wrap with refund", &OrderBusinessWrap{OrderRefundCallback: noopRefund}, true, false},
+		{"wrap with cancel", &OrderBusinessWrap{OrderCancelCallback: noop}, false, true},
+		{"custom without callbacks", plainBusiness{}, false, false},
+		{"custom with callbacks", fullBusiness{}, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := AsOrderRefunder(tt.ob); ok != tt.wantRefund {
+				t.Errorf("AsOrderRefunder ok = %v, want %v", ok, tt.wantRefund)
+			}
+			if _, ok := AsOrderCanceler(tt.ob); ok != tt.wantCancel {
+				t.Errorf("AsOrderCanceler ok = %v, want %v", ok, tt.wantCancel)
+			}
+		})
+	}
+}
+
+func TestPaidAmount(t *testing.T) {
+	tests := []struct {
+		name  string
+		order *Order
+		want  uint32
+	}{
+		{"unpaid", &Order{PayAmount: 100}, 0},
+		{"paid", &Order{PayAmount: 100, PayStatus: OrderPayStatus_Success}, 100},
+		{"legs partly paid", &Order{PayAmount: 300, PayLegs: []*OrderPayLeg{
+			{PayType: 1, PayAmount: 100, PayStatus: OrderPayStatus_Success},
+			{PayType: 2, PayAmount: 200},
+		}}, 100},
+		{"legs paid", &Order{PayAmount: 300, PayStatus: OrderPayStatus_Success, PayLegs: []*OrderPayLeg{
+			{PayType: 1, PayAmount: 100, PayStatus: OrderPayStatus_Success},
+			{PayType: 2, PayAmount: 200, PayStatus: OrderPayStatus_Success},
+		}}, 300},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.order.PaidAmount(); got != tt.want {
+				t.Errorf("PaidAmount = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPayLegsSettled(t *testing.T) {
+	order := &Order{PayLegs: []*OrderPayLeg{
+		{PayType: OrderPayType_None, PayAmount: 0, PayStatus: OrderPayStatus_Success},
+		{PayType: 1, PayAmount: 100},
+	}}
+	if order.PayLegsSettled() || order.HasCapturedPayLeg() {
+		t.Error("unpaid leg: PayLegsSettled and HasCapturedPayLeg should be false")
+	}
+
+	order.PayLegs[1].PayStatus = OrderPayStatus_Success
+	if !order.PayLegsSettled() || !order.HasCapturedPayLeg() {
+		t.Error("paid leg: PayLegsSettled and HasCapturedPayLeg should be true")
+	}
+
+	// 全额退款后不再算作已支付
+	order.PayLegs[1].RefundAmount = 100
+	if order.HasCapturedPayLeg() {
+		t.Error("refunded leg should not be captured")
+	}
+}
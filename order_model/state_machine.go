@@ -0,0 +1,98 @@
+package order_model
+
+// 自定义订单状态的起始值, 业务自定义的状态应该不小于这个值
+const OrderStatus_Custom OrderStatus = 100
+
+/*
+订单状态机, 定义一个订单类型有哪些状态, 允许哪些状态变更, 以及哪些状态是终态.
+
+终态表示订单不会再被推进, 终态仍然可以定义状态变更, 比如完成后退款.
+*/
+type OrderStateMachine struct {
+	states      map[OrderStatus]string               // 状态及其名称
+	terminal    map[OrderStatus]bool                 // 终态
+	transitions map[OrderStatus]map[OrderStatus]bool // 允许的状态变更, key为变更前状态
+}
+
+// 创建一个空的状态机
+func NewOrderStateMachine() *OrderStateMachine {
+	return &OrderStateMachine{
+		states:      make(map[OrderStatus]string),
+		terminal:    make(map[OrderStatus]bool),
+		transitions: make(map[OrderStatus]map[OrderStatus]bool),
+	}
+}
+
+// 创建内置状态机, 可以在此基础上添加自定义状态
+func NewDefaultOrderStateMachine() *OrderStateMachine {
+	return NewOrderStateMachine().
+		AddState(OrderStatus_Forwarding, "Forwarding", false).
+		AddState(OrderStatus_Finish, "Finish", true).
+		AddState(OrderStatus_BusinessCancelForward, "BusinessCancelForward", true).
+		AddState(OrderStatus_InsufficientBalance, "InsufficientBalance", true).
+		AddState(OrderStatus_ReturnedBalance, "ReturnedBalance", true).
+		AddState(OrderStatus_UnableToAdvance, "UnableToAdvance", false).
+		AddState(OrderStatus_Closed, "Closed", true).
+		AddTransition(OrderStatus_Forwarding, OrderStatus_Finish, OrderStatus_BusinessCancelForward,
+			OrderStatus_InsufficientBalance, OrderStatus_ReturnedBalance, OrderStatus_UnableToAdvance, OrderStatus_Closed).
+		AddTransition(OrderStatus_UnableToAdvance, OrderStatus_Forwarding, OrderStatus_Finish,
+			OrderStatus_BusinessCancelForward, OrderStatus_ReturnedBalance).
+		AddTransition(OrderStatus_Finish, OrderStatus_ReturnedBalance).
+		AddTransition(OrderStatus_BusinessCancelForward, OrderStatus_ReturnedBalance).
+		AddTransition(OrderStatus_Closed, OrderStatus_ReturnedBalance)
+}
+
+/*
+添加状态, 重复添加会覆盖
+
+	name 状态名称
+	terminal 是否为终态
+*/
+func (m *OrderStateMachine) AddState(status OrderStatus, name string, terminal bool) *OrderStateMachine {
+	m.states[status] = name
+	m.terminal[status] = terminal
+	return m
+}
+
+// 添加允许的状态变更, 变更前后的状态需要先通过 AddState 添加
+func (m *OrderStateMachine) AddTransition(from OrderStatus, to ...OrderStatus) *OrderStateMachine {
+	if m.transitions[from] == nil {
+		m.transitions[from] = make(map[OrderStatus]bool)
+	}
+	for _, s := range to {
+		m.transitions[from][s] = true
+	}
+	return m
+}
+
+// 移除状态变更
+func (m *OrderStateMachine) RemoveTransition(from OrderStatus, to ...OrderStatus) *OrderStateMachine {
+	for _, s := range to {
+		delete(m.transitions[from], s)
+	}
+	return m
+}
+
+// 是否存在状态
+func (m *OrderStateMachine) HasState(status OrderStatus) bool {
+	_, ok := m.states[status]
+	return ok
+}
+
+// 获取状态名称
+func (m *OrderStateMachine) StateName(status OrderStatus) string {
+	return m.states[status]
+}
+
+// 是否为终态
+func (m *OrderStateMachine) IsTerminal(status OrderStatus) bool {
+	return m.terminal[status]
+}
+
+// 是否允许状态变更, 状态不变时总是允许
+func (m *OrderStateMachine) CanTransition(from, to OrderStatus) bool {
+	if !m.HasState(from) || !m.HasState(to) {
+		return false
+	}
+	return from == to || m.transitions[from][to]
+}
@@ -0,0 +1,73 @@
+package order_model
+
+import (
+	"testing"
+)
+
+func TestDefaultOrderStateMachine(t *testing.T) {
+	sm := NewDefaultOrderStateMachine()
+
+	tests := []struct {
+		from, to OrderStatus
+		want     bool
+	}{
+		{OrderStatus_Forwarding, OrderStatus_Finish, true},
+		{OrderStatus_Forwarding, OrderStatus_Closed, true},
+		{OrderStatus_UnableToAdvance, OrderStatus_Forwarding, true},
+		{OrderStatus_Finish, OrderStatus_ReturnedBalance, true},
+		{OrderStatus_Closed, OrderStatus_ReturnedBalance, true},
+		{OrderStatus_Finish, OrderStatus_Forwarding, false},
+		{OrderStatus_Closed, OrderStatus_Forwarding, false},
+		{OrderStatus_ReturnedBalance, OrderStatus_Finish, false},
+		{OrderStatus_InsufficientBalance, OrderStatus_ReturnedBalance, false},
+		{OrderStatus_Finish, OrderStatus_Finish, true}, // 状态不变
+		{OrderStatus_Forwarding, OrderStatus_Custom, false},
+		{OrderStatus_Custom, OrderStatus_Custom, false}, // 不存在的状态
+	}
+	for _, tt := range tests {
+		if got := sm.CanTransition(tt.from, tt.to); got != tt.want {
+			t.Errorf("CanTransition(%d, %d) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+
+	for _, s := range []OrderStatus{OrderStatus_Finish, OrderStatus_BusinessCancelForward, OrderStatus_InsufficientBalance,
+		OrderStatus_ReturnedBalance, OrderStatus_Closed} {
+		if !sm.IsTerminal(s) {
+			t.Errorf("IsTerminal(%d) = false, want true", s)
+		}
+	}
+	for _, s := range []OrderStatus{OrderStatus_Forwarding, OrderStatus_UnableToAdvance} {
+		if sm.IsTerminal(s) {
+			t.Errorf("IsTerminal(%d) = true, want false", s)
+		}
+	}
+}
+
+func TestOrderStateMachineCustom(t *testing.T) {
+	const (
+		reviewing = OrderStatus_Custom + 1
+		rejected  = OrderStatus_Custom + 2
+	)
+	sm := NewDefaultOrderStateMachine().
+		AddState(reviewing, "Reviewing", false).
+		AddState(rejected, "Rejected", true).
+		AddTransition(OrderStatus_Forwarding, reviewing).
+		AddTransition(reviewing, OrderStatus_Forwarding, rejected).
+		RemoveTransition(OrderStatus_Forwarding, OrderStatus_InsufficientBalance)
+
+	if !sm.CanTransition(OrderStatus_Forwarding, reviewing) || !sm.CanTransition(reviewing, rejected) {
+		t.Error("custom transitions not allowed")
+	}
+	if sm.CanTransition(rejected, reviewing) {
+		t.Error("undeclared transition allowed")
+	}
+	if sm.CanTransition(OrderStatus_Forwarding, OrderStatus_InsufficientBalance) {
+		t.Error("removed transition still allowed")
+	}
+	if !sm.IsTerminal(rejected) || sm.IsTerminal(reviewing) {
+		t.Error("custom terminal states mismatch")
+	}
+	if sm.StateName(reviewing) != "Reviewing" {
+		t.Errorf("StateName = %q, want Reviewing", sm.StateName(reviewing))
+	}
+}
@@ -5,17 +5,19 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"strconv"
+	"math/rand"
 	"strings"
 	"time"
 
 	"github.com/bytedance/sonic"
+	"github.com/spf13/cast"
 	"go.uber.org/zap"
 
 	"github.com/zly-app/zapp/logger"
 
 	"github.com/zlyuancn/order/conf"
 	"github.com/zlyuancn/order/dao"
+	"github.com/zlyuancn/order/metrics"
 	"github.com/zlyuancn/order/mq"
 	"github.com/zlyuancn/order/order_model"
 )
@@ -27,6 +29,18 @@ const (
 	templateString_ShardNum  = "<shard_num>"
 )
 
+// 推进中订单状态变更的乐观锁条件
+var expectForwarding = order_model.UpdateExpect{Status: order_model.OrderStatus_Forwarding}
+
+// 更新支付完成时订单状态发生变化的最大重试次数
+const updatePayMaxAttempts = 3
+
+// 等待订单锁的退避时间
+const (
+	lockWaitMinBackoff = 20 * time.Millisecond
+	lockWaitMaxBackoff = 500 * time.Millisecond
+)
+
 var orderApi = orderCli{}
 
 type orderCli struct{}
@@ -36,17 +50,25 @@ type orderCli struct{}
 
 	order 订单相关数据
 	extend 扩展数据
-	enableCompensation 是否启用后置补偿, 会提交一个mq消息到队列中
+	enableCompensation 是否启用后置补偿, 会提交一个mq消息到队列中. 启用 AllowOutbox 时会和订单在同一个事务中写入发件箱, 由后台发送
 	compensationDelayTime 开始补偿延迟时间. 秒
 */
 func (o orderCli) CreateOrder(ctx context.Context, order *order_model.Order, extend interface{},
 	enableCompensation bool) error {
-	if enableCompensation {
+	err := o.createOrder(ctx, order, extend, enableCompensation)
+	metrics.ReportCreate(order.OrderType, err)
+	return err
+}
+
+func (o orderCli) createOrder(ctx context.Context, order *order_model.Order, extend interface{},
+	enableCompensation bool) error {
+	withOutbox := enableCompensation && conf.Conf.AllowOutbox
+	if enableCompensation && !withOutbox {
 		err := o.SendCompensationSignal(ctx, order.OrderID, order.Uid)
 		if err != nil {
 			return err
 		}
-	} else {
+	} else if !enableCompensation {
 		logger.Log.Warn(ctx, "order create no send mq",
 			zap.String("orderID", order.OrderID),
 			zap.String("uid", order.Uid),
@@ -63,7 +85,7 @@ func (o orderCli) CreateOrder(ctx context.Context, order *order_model.Order, ext
 	}
 	v.Remark = "Created"
 
-	_, err = dao.Dao(order.Uid).CreateOneModel(ctx, v)
+	_, err = dao.Dao(order.Uid).CreateOneModel(ctx, v, withOutbox)
 	if err != nil {
 		logger.Log.Error(ctx, "CreateOrder dao.CreateOneModel err",
 			zap.Any("v", v),
@@ -83,8 +105,24 @@ func (orderCli) order2DBModel(order *order_model.Order, extend interface{}, stat
 		PayStatus:       byte(order.PayStatus),
 		PayAmount:       order.PayAmount,
 		ThirdPayOrderID: order.ThirdPayOrderID,
+		ExpireAt:        order.ExpireAt,
 		Uid:             order.Uid,
 	}
+	if len(order.PayLegs) > 0 {
+		payLegs, err := sonic.MarshalString(order.PayLegs)
+		if err != nil {
+			return nil, err
+		}
+		v.PayLegs = payLegs
+		v.PayAmount = 0
+		for _, leg := range order.PayLegs {
+			v.PayAmount += leg.PayAmount
+		}
+		v.PayStatus = byte(order_model.OrderPayStatus_None)
+		if order.PayLegsSettled() {
+			v.PayStatus = byte(order_model.OrderPayStatus_Success)
+		}
+	}
 	if extend != nil {
 		extendText, err := sonic.MarshalString(extend)
 		if err != nil {
@@ -110,6 +148,11 @@ func (o orderCli) SendCompensationSignal(ctx context.Context, orderID, uid strin
 		OrderID: orderID,
 		Uid:     uid,
 	}
+	if conf.Conf.MQMsgOmitUid {
+		if _, err := o.daoByOID(orderID); err == nil { // 能从订单号中解析分片时省略uid
+			orderMsg.Uid = ""
+		}
+	}
 
 	err := mq.Send(ctx, orderMsg)
 	if err != nil {
@@ -123,19 +166,98 @@ func (o orderCli) SendCompensationSignal(ctx context.Context, orderID, uid strin
 	return nil
 }
 
-// 订单操作锁, 用于防止多线程操作订单, 比如mq重复同时消费
+// 订单操作锁, 用于防止多线程操作订单, 比如mq重复同时消费. 锁被占用时会按 lockWaitDeadline 等待
 func (o orderCli) orderDBLock(ctx context.Context, orderID string) (
 	unlock func(ctx context.Context), ok bool, err error) {
 	key := o.genOrderLockKey(orderID)
 	expireTime := conf.Conf.OrderLockDBExpire
-	un, ok, err := dao.SetRedisLock(ctx, key, expireTime)
-	if !ok || err != nil {
-		return nil, ok, err
+	deadline, wait := o.lockWaitDeadline(ctx)
+	backoff := lockWaitMinBackoff
+	var un func(ctx context.Context) (bool, error)
+	for {
+		un, ok, err = dao.GetLocker().Lock(ctx, key, expireTime, true)
+		if err != nil {
+			metrics.ReportLockFail(metrics.LockFail_Err)
+			return nil, ok, err
+		}
+		if ok {
+			break
+		}
+
+		remaining := time.Until(deadline)
+		if !wait || remaining <= 0 {
+			metrics.ReportLockFail(metrics.LockFail_Locked)
+			return nil, false, nil
+		}
+		// 退避时间加上随机抖动, 避免多个等待者同时重试
+		sleep := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		if sleep > remaining {
+			sleep = remaining
+		}
+		t := time.NewTimer(sleep)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			metrics.ReportLockFail(metrics.LockFail_Locked)
+			return nil, false, nil
+		case <-t.C:
+		}
+		if backoff *= 2; backoff > lockWaitMaxBackoff {
+			backoff = lockWaitMaxBackoff
+		}
 	}
 	return func(ctx context.Context) {
-		_, _ = un(ctx, conf.Conf.OrderUnlockDBLimitProcessTime)
+		deleted, err := un(ctx)
+		if err == nil && !deleted {
+			logger.Log.Warn(ctx, "orderApi orderDBLock lock lost before unlock",
+				zap.String("orderID", orderID),
+			)
+		}
 	}, ok, err
 }
+
+// 获取等待订单锁的截止时间, 优先使用 order_model.WithLockWait 设置的等待时间, 不会超过ctx的截止时间
+func (o orderCli) lockWaitDeadline(ctx context.Context) (deadline time.Time, wait bool) {
+	waitTime, ok := order_model.GetLockWait(ctx)
+	if !ok {
+		waitTime = time.Duration(conf.Conf.OrderLockWaitTime) * time.Millisecond
+	}
+	if waitTime <= 0 {
+		return time.Time{}, false
+	}
+
+	deadline = time.Now().Add(waitTime)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	return deadline, true
+}
+
+/*
+加订单锁, 加锁失败时返回错误, 锁被占用时返回 OrderLockedErr
+
+	method 调用方法名, 用于日志
+*/
+func (o orderCli) lockOrder(ctx context.Context, orderID, uid, method string) (unlock func(ctx context.Context), err error) {
+	unlock, ok, err := o.orderDBLock(ctx, orderID)
+	if err != nil {
+		logger.Log.Error(ctx, "orderApi "+method+" orderDBLock err",
+			zap.String("orderID", orderID),
+			zap.String("uid", uid),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+	if !ok {
+		logger.Log.Warn(ctx, "orderApi "+method+" orderDBLock is failed",
+			zap.String("orderID", orderID),
+			zap.String("uid", uid),
+		)
+		return nil, OrderLockedErr
+	}
+	return unlock, nil
+}
+
 func (o orderCli) genOrderLockKey(orderID string) string {
 	text := conf.Conf.OrderLockKeyFormat
 	text = strings.ReplaceAll(text, templateString_OrderID, orderID)
@@ -143,9 +265,82 @@ func (o orderCli) genOrderLockKey(orderID string) string {
 }
 
 // 获取订单
-func (orderCli) GetOrder(ctx context.Context, orderID, uid string) (
+func (o orderCli) GetOrder(ctx context.Context, orderID, uid string) (
 	*order_model.Order, string, order_model.OrderStatus, error) {
-	model, err := dao.Dao(uid).GetOne(ctx, orderID)
+	return o.getOrder(ctx, dao.Dao(uid), orderID, uid)
+}
+
+/*
+不传uid获取订单, 根据订单号中的分片查询, 订单号需要能被 ParseOID 解析
+
+扩容迁移切换主布局后, 扩容前生成的订单号中的分片不再是订单所在的分片. 在 cutover 阶段或配置了 LegacyShardNums 时,
+在分片中找不到订单会扫描主布局的所有分表, 否则返回 OrderNotFoundErr
+*/
+func (o orderCli) GetOrderWithoutUid(ctx context.Context, orderID string) (
+	*order_model.Order, string, order_model.OrderStatus, error) {
+	info, err := ParseOID(orderID)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	shards, err := o.oidShards(info)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	for _, shard := range shards {
+		order, extend, status, err := o.getOrder(ctx, dao.DaoByShard(shard), orderID, "")
+		if err != OrderNotFoundErr {
+			return order, extend, status, err
+		}
+	}
+	return nil, "", 0, OrderNotFoundErr
+}
+
+// 不传uid时需要依次查询的主布局分片, 优先查询订单号中的分片, 布局变更后会查询所有分片
+func (orderCli) oidShards(info *order_model.OIDInfo) ([]string, error) {
+	changed := dao.LayoutChanged()
+	inRange := cast.ToUint32(info.Shard) < dao.ShardNums()
+	if !inRange && !changed {
+		return nil, OrderIDInvalidErr
+	}
+
+	var shards []string
+	if inRange {
+		shards = append(shards, info.Shard)
+	}
+	if changed {
+		for shard := uint32(0); shard < dao.ShardNums(); shard++ {
+			if cast.ToString(shard) != info.Shard {
+				shards = append(shards, cast.ToString(shard))
+			}
+		}
+	}
+	return shards, nil
+}
+
+// 根据订单号中的分片获取dao
+func (o orderCli) daoByOID(orderID string) (dao.RPC, error) {
+	info, err := ParseOID(orderID)
+	if err != nil {
+		return nil, err
+	}
+	if cast.ToUint32(info.Shard) >= dao.ShardNums() {
+		return nil, OrderIDInvalidErr
+	}
+	return dao.DaoByShard(info.Shard), nil
+}
+
+// 根据订单号中的分片查找订单的uid
+func (o orderCli) findUidByOID(ctx context.Context, orderID string) (string, error) {
+	order, _, _, err := o.GetOrderWithoutUid(ctx, orderID)
+	if err != nil {
+		return "", err
+	}
+	return order.Uid, nil
+}
+
+func (o orderCli) getOrder(ctx context.Context, d dao.RPC, orderID, uid string) (
+	*order_model.Order, string, order_model.OrderStatus, error) {
+	model, err := d.GetOne(ctx, orderID)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, "", 0, OrderNotFoundErr
@@ -158,19 +353,135 @@ func (orderCli) GetOrder(ctx context.Context, orderID, uid string) (
 		return nil, "", 0, err
 	}
 
+	order, err := o.model2Order(model)
+	if err != nil {
+		logger.Log.Error(ctx, "GetOrder Unmarshal PayLegs err",
+			zap.String("orderID", orderID),
+			zap.String("uid", uid),
+			zap.String("payLegs", model.PayLegs),
+			zap.Error(err),
+		)
+		return nil, "", 0, err
+	}
+	status := order_model.OrderStatus(model.OrderStatus)
+	return order, model.Extend, status, nil
+}
+
+func (orderCli) model2Order(model *dao.Model) (*order_model.Order, error) {
 	order := &order_model.Order{
-		OrderID:   orderID,
+		OrderID:   model.OrderID,
 		OrderType: order_model.OrderType(model.OrderType),
 
 		PayType:         order_model.OrderPayType(model.PayType),
 		PayStatus:       order_model.OrderPayStatus(model.PayStatus),
 		PayAmount:       model.PayAmount,
 		ThirdPayOrderID: model.ThirdPayOrderID,
+		RefundAmount:    model.RefundAmount,
 
-		Uid: uid,
+		Uid:      model.Uid,
+		Ctime:    model.Ctime,
+		Version:  model.UpdateNums,
+		ExpireAt: model.ExpireAt,
+	}
+	if model.PayLegs != "" {
+		err := sonic.UnmarshalString(model.PayLegs, &order.PayLegs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// 获取订单变动流水, 按变动顺序排列
+func (o orderCli) GetOrderHistory(ctx context.Context, orderID, uid string) ([]*order_model.OrderLog, error) {
+	models, err := dao.Dao(uid).GetLogs(ctx, orderID)
+	if err != nil {
+		logger.Log.Error(ctx, "GetOrderHistory dao.GetLogs err",
+			zap.String("orderID", orderID),
+			zap.String("uid", uid),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+
+	logs := make([]*order_model.OrderLog, len(models))
+	for i, m := range models {
+		logs[i] = o.logModel2OrderLog(m)
+	}
+	return logs, nil
+}
+
+func (orderCli) logModel2OrderLog(m *dao.LogModel) *order_model.OrderLog {
+	return &order_model.OrderLog{
+		OrderID: m.OrderID,
+		Uid:     m.Uid,
+		LogType: order_model.OrderLogType(m.LogType),
+
+		OldStatus:    order_model.OrderStatus(m.OldOrderStatus),
+		NewStatus:    order_model.OrderStatus(m.NewOrderStatus),
+		OldPayStatus: order_model.OrderPayStatus(m.OldPayStatus),
+		NewPayStatus: order_model.OrderPayStatus(m.NewPayStatus),
+
+		Extend: m.Extend,
+		Remark: m.Remark,
+		Caller: m.Caller,
+		Ctime:  m.Ctime,
 	}
-	status := order_model.OrderStatus(model.OrderStatus)
-	return order, model.Extend, status, nil
+}
+
+/*
+查询用户的订单, 按创建顺序从新到旧排列
+
+	filter 查询条件, filter.Limit 必须大于0
+
+返回下一页的游标, 为0表示没有更多数据了
+*/
+func (o orderCli) ListUserOrders(ctx context.Context, uid string, filter *order_model.UserOrderFilter) (
+	[]*order_model.UserOrder, uint, error) {
+	if filter == nil || filter.Limit < 1 {
+		return nil, 0, fmt.Errorf("orderApi ListUserOrders limit must be greater than 0")
+	}
+
+	models, err := dao.Dao(uid).ListByUid(ctx, filter)
+	if err != nil {
+		logger.Log.Error(ctx, "orderApi ListUserOrders ListByUid err",
+			zap.String("uid", uid),
+			zap.Any("filter", filter),
+			zap.Error(err),
+		)
+		return nil, 0, err
+	}
+
+	ret := make([]*order_model.UserOrder, len(models))
+	for i, model := range models {
+		order, err := o.model2Order(model)
+		if err != nil {
+			return nil, 0, err
+		}
+		var extend interface{} = model.Extend
+		if ob, ok := o.GetOrderBusiness(order.OrderType); ok {
+			extend, err = o.parseExtend(ctx, ob, model.Extend)
+			if err != nil {
+				return nil, 0, fmt.Errorf("orderApi ListUserOrders Unmarshal extend err. orderID=%v, err=%v", order.OrderID, err)
+			}
+		}
+		ret[i] = &order_model.UserOrder{
+			Order:  order,
+			Extend: extend,
+			Status: order_model.OrderStatus(model.OrderStatus),
+			Remark: model.Remark,
+		}
+	}
+
+	return ret, o.userOrdersCursor(models, filter.Limit), nil
+}
+
+// 用户订单下一页的游标, 返回的数据不足一页时为0
+func (orderCli) userOrdersCursor(models []*dao.Model, limit int) uint {
+	if len(models) < limit || len(models) == 0 {
+		return 0
+	}
+	return models[len(models)-1].ID
 }
 
 /*
@@ -182,22 +493,18 @@ func (orderCli) GetOrder(ctx context.Context, orderID, uid string) (
 */
 func (o orderCli) Forward(ctx context.Context, order *order_model.Order, extend interface{}) (
 	*order_model.Order, order_model.OrderStatus, error) {
-	unlock, ok, err := o.orderDBLock(ctx, order.OrderID)
+	startTime := time.Now()
+	retOrder, status, err := o.forward(ctx, order, extend)
+	o.reportForward(order.OrderType, metrics.ForwardMethod_Forward, status, err, startTime)
+	return retOrder, status, err
+}
+
+func (o orderCli) forward(ctx context.Context, order *order_model.Order, extend interface{}) (
+	*order_model.Order, order_model.OrderStatus, error) {
+	unlock, err := o.lockOrder(ctx, order.OrderID, order.Uid, "ForwardOrder")
 	if err != nil {
-		logger.Log.Error(ctx, "orderApi ForwardOrder orderDBLock err",
-			zap.String("orderID", order.OrderID),
-			zap.String("uid", order.Uid),
-			zap.Error(err),
-		)
 		return nil, 0, err
 	}
-	if !ok {
-		logger.Log.Warn(ctx, "orderApi ForwardOrder orderDBLock is failed",
-			zap.String("orderID", order.OrderID),
-			zap.String("uid", order.Uid),
-		)
-		return nil, 0, fmt.Errorf("orderApi Forward orderDBLock is failed")
-	}
 	defer unlock(ctx)
 
 	// 获取业务
@@ -215,26 +522,39 @@ func (o orderCli) Forward(ctx context.Context, order *order_model.Order, extend
 */
 func (o orderCli) ForwardOrderID(ctx context.Context, orderID, uid string) (
 	*order_model.Order, order_model.OrderStatus, error) {
-	return o.forwardOrderID(ctx, orderID, uid, false)
+	return o.forwardOrderID(ctx, orderID, uid, metrics.ForwardMethod_ForwardOrderID)
 }
 
-func (o orderCli) forwardOrderID(ctx context.Context, orderID, uid string, isMq bool) (
+// 不传uid推进, 根据订单号中的分片查找订单, 订单号需要能被 ParseOID 解析
+func (o orderCli) ForwardOrderIDWithoutUid(ctx context.Context, orderID string) (
 	*order_model.Order, order_model.OrderStatus, error) {
-	unlock, ok, err := o.orderDBLock(ctx, orderID)
+	uid, err := o.findUidByOID(ctx, orderID)
 	if err != nil {
-		logger.Log.Error(ctx, "orderApi Forward orderDBLock err",
-			zap.String("orderID", orderID),
-			zap.String("uid", uid),
-			zap.Error(err),
-		)
 		return nil, 0, err
 	}
-	if !ok {
-		logger.Log.Warn(ctx, "orderApi Forward orderDBLock is failed",
-			zap.String("orderID", orderID),
-			zap.String("uid", uid),
-		)
-		return nil, 0, fmt.Errorf("orderApi Forward orderDBLock is failed")
+	return o.ForwardOrderID(ctx, orderID, uid)
+}
+
+// 根据订单id推进, method 为推进方式, 非 ForwardMethod_ForwardOrderID 时表示补偿推进
+func (o orderCli) forwardOrderID(ctx context.Context, orderID, uid string, method string) (
+	*order_model.Order, order_model.OrderStatus, error) {
+	startTime := time.Now()
+	isCompensation := method != metrics.ForwardMethod_ForwardOrderID
+	order, status, err := o.doForwardOrderID(ctx, orderID, uid, isCompensation)
+
+	var orderType order_model.OrderType
+	if order != nil {
+		orderType = order.OrderType
+	}
+	o.reportForward(orderType, method, status, err, startTime)
+	return order, status, err
+}
+
+func (o orderCli) doForwardOrderID(ctx context.Context, orderID, uid string, isCompensation bool) (
+	*order_model.Order, order_model.OrderStatus, error) {
+	unlock, err := o.lockOrder(ctx, orderID, uid, "Forward")
+	if err != nil {
+		return nil, 0, err
 	}
 	defer unlock(ctx)
 
@@ -246,7 +566,7 @@ func (o orderCli) forwardOrderID(ctx context.Context, orderID, uid string, isMq
 			zap.String("uid", uid),
 			zap.Error(err),
 		)
-		if err == OrderNotFoundErr && isMq { // mq重试发现订单不存在则忽略消息
+		if err == OrderNotFoundErr && isCompensation { // 补偿时发现订单不存在则忽略
 			return nil, 0, nil
 		}
 		return nil, 0, err
@@ -259,18 +579,52 @@ func (o orderCli) forwardOrderID(ctx context.Context, orderID, uid string, isMq
 	}
 
 	// 解析业务扩展数据
+	extend, err := o.parseExtend(ctx, ob, extendText)
+	if err != nil {
+		return nil, 0, fmt.Errorf("orderApi forward Unmarshal extend err. orderID=%v, err=%v", order.OrderID, err)
+	}
+	return o.forwardOrder(ctx, ob, order, extend, status)
+}
+
+// 解析业务扩展数据
+func (orderCli) parseExtend(ctx context.Context, ob order_model.OrderBusiness, extendText string) (interface{}, error) {
 	extend := ob.NewExtendStruct(ctx)
 	if extend != nil && extendText != "" {
 		err := sonic.UnmarshalString(extendText, extend)
 		if err != nil {
-			return nil, 0, fmt.Errorf("orderApi forward Unmarshal extend err. orderID=%v, err=%v", order.OrderID, err)
+			return nil, err
 		}
 	}
-	return o.forwardOrder(ctx, ob, order, extend, status)
+	return extend, nil
+}
+
+// 上报推进结果
+func (o orderCli) reportForward(orderType order_model.OrderType, method string, status order_model.OrderStatus,
+	err error, startTime time.Time) {
+	result, status := o.forwardResult(status, err)
+	metrics.ReportForward(orderType, method, status, result, startTime)
+}
+
+// 推进结果标签值和推进后的订单状态
+func (orderCli) forwardResult(status order_model.OrderStatus, err error) (string, order_model.OrderStatus) {
+	switch err {
+	case nil:
+		return metrics.Result_OK, status
+	case OrderBusinessCancelForwardErr:
+		return metrics.Result_Cancel, order_model.OrderStatus_BusinessCancelForward
+	case OrderUnableToAdvanceErr:
+		return metrics.Result_UnableToAdvance, order_model.OrderStatus_UnableToAdvance
+	}
+	return metrics.Result_Err, status
 }
 
 func (o orderCli) forwardOrder(ctx context.Context, ob order_model.OrderBusiness, order *order_model.Order, extend interface{}, status order_model.OrderStatus) (
 	*order_model.Order, order_model.OrderStatus, error) {
+	// 自定义状态由业务自行推进
+	if status >= order_model.OrderStatus_Custom {
+		return order, status, nil
+	}
+
 	// 检查状态
 	if status != order_model.OrderStatus_Forwarding {
 		if status == order_model.OrderStatus_Finish {
@@ -304,7 +658,9 @@ func (o orderCli) forwardOrder(ctx context.Context, ob order_model.OrderBusiness
 	}
 
 	// 业务检查是否允许推进
+	callbackStartTime := time.Now()
 	cancelCause, err := ob.CanForward(ctx, order, extend)
+	metrics.ReportCallback(order.OrderType, metrics.Callback_CanForward, callbackStartTime, err)
 	if err != nil {
 		logger.Log.Error(ctx, "orderApi forward call CanForward err",
 			zap.Any("order", order),
@@ -312,7 +668,7 @@ func (o orderCli) forwardOrder(ctx context.Context, ob order_model.OrderBusiness
 			zap.Any("status", status),
 			zap.Error(err),
 		)
-		return nil, 0, err
+		return nil, 0, o.forwardFailed(ctx, ob, order, extend, err)
 	}
 	if cancelCause != "" {
 		logger.Log.Warn(ctx, "orderApi forward call CanForward got cancel forward",
@@ -322,7 +678,7 @@ func (o orderCli) forwardOrder(ctx context.Context, ob order_model.OrderBusiness
 			zap.String("cancelCause", cancelCause),
 		)
 		status = order_model.OrderStatus_BusinessCancelForward
-		err = o.UpdateOrderStatus(ctx, order.OrderID, order.Uid, extend, status, cancelCause)
+		err = o.CompareAndUpdateOrderStatus(ctx, order.OrderID, order.Uid, extend, status, cancelCause, expectForwarding)
 		if err != nil {
 			logger.Log.Error(ctx, "orderApi forward cancel set UpdateOrderStatus err",
 				zap.Any("order", order),
@@ -348,14 +704,14 @@ func (o orderCli) forwardOrder(ctx context.Context, ob order_model.OrderBusiness
 	}
 
 	// 扣款
-	ok, err := o.deductBalance(ctx, order, extend)
+	ok, err := o.deductBalance(ctx, ob, order, extend)
 	if err != nil {
 		logger.Log.Error(ctx, "orderApi forward DeductBalance err",
 			zap.Any("order", order),
 			zap.Any("extend", extend),
 			zap.Error(err),
 		)
-		return nil, 0, err
+		return nil, 0, o.forwardFailed(ctx, ob, order, extend, err)
 	}
 	if !ok {
 		status = order_model.OrderStatus_InsufficientBalance
@@ -379,18 +735,20 @@ func (o orderCli) forwardOrder(ctx context.Context, ob order_model.OrderBusiness
 	}
 
 	// 发货
+	callbackStartTime = time.Now()
 	err = ob.Delivery(ctx, order, extend)
+	metrics.ReportCallback(order.OrderType, metrics.Callback_Delivery, callbackStartTime, err)
 	if err != nil {
 		logger.Log.Error(ctx, "orderApi forward Delivery err",
 			zap.Any("order", order),
 			zap.Error(err),
 		)
-		return nil, 0, err
+		return nil, 0, o.forwardFailed(ctx, ob, order, extend, err)
 	}
 
 	status = order_model.OrderStatus_Finish
 	// 更新订单状态
-	err = o.UpdateOrderStatus(ctx, order.OrderID, order.Uid, extend, status, "forward finish")
+	err = o.CompareAndUpdateOrderStatus(ctx, order.OrderID, order.Uid, extend, status, "forward finish", expectForwarding)
 	if err != nil {
 		logger.Log.Error(ctx, "orderApi forward finish but set updateOrderStatus err",
 			zap.Any("order", order),
@@ -422,39 +780,49 @@ func (o orderCli) forwardOrder(ctx context.Context, ob order_model.OrderBusiness
 
 return 扣除余额是否成功, false一般为余额不足
 
-如果是扣款发生余额不足, 会打上余额不足状态.
+如果是扣款发生余额不足, 会打上余额不足状态. 混合支付中存在已支付且无法自动退回的支付项(如外部支付)时,
+会转为需要人工介入并返回 OrderUnableToAdvanceErr, 避免已支付的金额被静默扣留.
 */
-func (o orderCli) deductBalance(ctx context.Context, order *order_model.Order, extend interface{}) (bool, error) {
+func (o orderCli) deductBalance(ctx context.Context, ob order_model.OrderBusiness, order *order_model.Order,
+	extend interface{}) (bool, error) {
 	if order.PayStatus == order_model.OrderPayStatus_Success {
 		return true, nil
 	}
 
-	deductOK := false
-	switch order.PayType {
-	case order_model.OrderPayType_None: // 无需支付
+	// 混合支付
+	if len(order.PayLegs) > 0 {
+		ok, err := o.deductPayLegs(ctx, order)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			if order.HasCapturedPayLeg() {
+				err = o.parkOrder(ctx, ob, order, extend, "insufficient balance but some pay legs are captured")
+				if err != nil {
+					return false, err
+				}
+				return false, OrderUnableToAdvanceErr
+			}
+			return false, o.setInsufficientBalance(ctx, order, extend)
+		}
+		order.PayStatus = order_model.OrderPayStatus_Success
 		return true, nil
-	default:
-		return false, fmt.Errorf("order deductBalance unrealized payType=%v", order.PayType)
 	}
 
+	if order.PayType == order_model.OrderPayType_None { // 无需支付
+		return true, nil
+	}
+	deductOK, err := o.deductPay(ctx, order, order.PayType, o.genPayID(order.OrderID, -1), order.PayAmount)
+	if err != nil {
+		return false, err
+	}
 	if !deductOK {
-		status := order_model.OrderStatus_InsufficientBalance
-		err := o.UpdateOrderStatus(ctx, order.OrderID, order.Uid, extend, status, "InsufficientBalance")
-		if err != nil {
-			logger.Log.Error(ctx, "orderApi deductBalance fail and set UpdateOrderStatus err",
-				zap.Any("order", order),
-				zap.Any("extend", extend),
-				zap.Int("status", int(status)),
-				zap.Error(err),
-			)
-			return false, err
-		}
-		return false, nil
+		return false, o.setInsufficientBalance(ctx, order, extend)
 	}
 
 	order.PayStatus = order_model.OrderPayStatus_Success
 	status := order_model.OrderStatus_Forwarding
-	err := dao.Dao(order.Uid).SetPayStatus(ctx, order.OrderID, "", byte(order.PayStatus), "Auto Pay")
+	err = dao.Dao(order.Uid).SetPayStatus(ctx, order.OrderID, "", byte(order.PayStatus), "Auto Pay", order_model.UpdateExpect{})
 	if err != nil {
 		logger.Log.Error(ctx, "orderApi deductBalance finish but set PayStatus err",
 			zap.Any("order", order),
@@ -467,9 +835,105 @@ func (o orderCli) deductBalance(ctx context.Context, order *order_model.Order, e
 	return true, nil
 }
 
-// 更新付费状态
+// 扣款余额不足时打上余额不足状态
+func (o orderCli) setInsufficientBalance(ctx context.Context, order *order_model.Order, extend interface{}) error {
+	status := order_model.OrderStatus_InsufficientBalance
+	err := o.CompareAndUpdateOrderStatus(ctx, order.OrderID, order.Uid, extend, status, "InsufficientBalance", expectForwarding)
+	if err != nil {
+		logger.Log.Error(ctx, "orderApi deductBalance fail and set UpdateOrderStatus err",
+			zap.Any("order", order),
+			zap.Any("extend", extend),
+			zap.Int("status", int(status)),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
+
+/*
+更新付费状态
+
+订单已过期关闭时收到支付完成会记录支付并全额退款, 然后返回 OrderClosedErr
+*/
 func (o orderCli) UpdatePayStatus(ctx context.Context, orderID, uid string, payStatus order_model.OrderPayStatus, remark string) error {
-	err := dao.Dao(uid).SetPayStatus(ctx, orderID, "", byte(payStatus), remark)
+	if payStatus == order_model.OrderPayStatus_Success {
+		return o.updatePaySuccess(ctx, orderID, uid, remark)
+	}
+	return o.setPayStatus(ctx, orderID, uid, payStatus, remark, order_model.UpdateExpect{})
+}
+
+/*
+更新为支付完成
+
+以读取到的订单状态作为乐观锁条件写入支付状态, 期间订单被关闭时重新读取订单并按已关闭处理.
+关闭订单时以订单版本号作为乐观锁条件, 所以已写入支付状态的订单不会被关闭.
+*/
+func (o orderCli) updatePaySuccess(ctx context.Context, orderID, uid string, remark string) error {
+	for i := 0; ; i++ {
+		_, _, status, err := o.GetOrder(ctx, orderID, uid)
+		if err != nil {
+			return err
+		}
+		if status == order_model.OrderStatus_Closed {
+			return o.refundClosedOrder(ctx, orderID, uid, remark)
+		}
+
+		expect := order_model.UpdateExpect{Status: status}
+		err = o.setPayStatus(ctx, orderID, uid, order_model.OrderPayStatus_Success, remark, expect)
+		if err != OrderVersionConflictErr || i+1 >= updatePayMaxAttempts {
+			return err
+		}
+	}
+}
+
+// 已关闭的订单收到支付完成, 记录支付并全额退款, 然后返回 OrderClosedErr
+func (o orderCli) refundClosedOrder(ctx context.Context, orderID, uid string, remark string) error {
+	unlock, err := o.lockOrder(ctx, orderID, uid, "UpdatePayStatus")
+	if err != nil {
+		return err
+	}
+	defer unlock(ctx)
+
+	order, extendText, status, err := o.GetOrder(ctx, orderID, uid)
+	if err != nil {
+		return err
+	}
+	logger.Log.Warn(ctx, "orderApi UpdatePayStatus order is closed, refund it",
+		zap.Any("order", order),
+		zap.String("remark", remark),
+	)
+	if order.PayStatus != order_model.OrderPayStatus_Success {
+		err = o.setPayStatus(ctx, orderID, uid, order_model.OrderPayStatus_Success, remark, order_model.UpdateExpect{Status: status})
+		if err != nil {
+			return err
+		}
+		order.PayStatus = order_model.OrderPayStatus_Success
+	}
+	if order.RefundAmount < order.PayAmount { // 重复通知时可能已经退款
+		err = o.refundOrder(ctx, order, extendText, status, 0, "order closed", true)
+		if err != nil {
+			return err
+		}
+	}
+	return OrderClosedErr
+}
+
+// 不传uid更新付费状态, 根据订单号中的分片查找订单, 订单号需要能被 ParseOID 解析
+func (o orderCli) UpdatePayStatusWithoutUid(ctx context.Context, orderID string, payStatus order_model.OrderPayStatus, remark string) error {
+	uid, err := o.findUidByOID(ctx, orderID)
+	if err != nil {
+		return err
+	}
+	return o.UpdatePayStatus(ctx, orderID, uid, payStatus, remark)
+}
+
+func (o orderCli) setPayStatus(ctx context.Context, orderID, uid string, payStatus order_model.OrderPayStatus, remark string,
+	expect order_model.UpdateExpect) error {
+	err := dao.Dao(uid).SetPayStatus(ctx, orderID, "", byte(payStatus), remark, expect)
+	if err == OrderVersionConflictErr {
+		return err
+	}
 	if err != nil {
 		logger.Log.Error(ctx, "orderApi UpdatePayStatus call set PayStatus err",
 			zap.Any("orderID", orderID),
@@ -486,6 +950,16 @@ func (o orderCli) UpdatePayStatus(ctx context.Context, orderID, uid string, payS
 // 更新订单状态和扩展数据
 func (o orderCli) UpdateOrderStatus(ctx context.Context, orderID, uid string, extend interface{}, status order_model.OrderStatus,
 	remark string) error {
+	return o.CompareAndUpdateOrderStatus(ctx, orderID, uid, extend, status, remark, order_model.UpdateExpect{})
+}
+
+/*
+满足乐观锁条件时才更新订单状态和扩展数据
+
+	expect 乐观锁条件, 不满足时返回 OrderVersionConflictErr
+*/
+func (o orderCli) CompareAndUpdateOrderStatus(ctx context.Context, orderID, uid string, extend interface{},
+	status order_model.OrderStatus, remark string, expect order_model.UpdateExpect) error {
 	var extendText string
 	if extend != nil {
 		v, err := sonic.MarshalString(extend)
@@ -502,7 +976,10 @@ func (o orderCli) UpdateOrderStatus(ctx context.Context, orderID, uid string, ex
 		extendText = v
 	}
 	// 更新状态
-	err := dao.Dao(uid).UpdateOrderStatus(ctx, orderID, extendText, status, remark)
+	err := dao.Dao(uid).UpdateOrderStatus(ctx, orderID, extendText, status, remark, expect, o.canTransition)
+	if err == OrderVersionConflictErr || err == OrderStatusTransitionErr {
+		return err
+	}
 	if err != nil {
 		logger.Log.Error(ctx, "order UpdateOrderStatus err",
 			zap.Any("orderID", orderID),
@@ -516,35 +993,37 @@ func (o orderCli) UpdateOrderStatus(ctx context.Context, orderID, uid string, ex
 	return nil
 }
 
+// 根据订单类型的状态机检查是否允许状态变更
+func (o orderCli) canTransition(orderType order_model.OrderType, from, to order_model.OrderStatus) bool {
+	return o.GetOrderStateMachine(orderType).CanTransition(from, to)
+}
+
 // 根据用户订单号生成单号
 func (o orderCli) GenOIDByUserOID(ctx context.Context, orderType order_model.OrderType, uid, userOrderID string) (string, error) {
 	shard := dao.GenShard(uid)
-	return fmt.Sprintf("order-uoid-%d-%s-%s-%s", orderType, shard, uid, userOrderID), nil
+	return fmt.Sprintf("order-%s-%d-%s-%s-%s", oidKind_UserOID, orderType, shard, uid, userOrderID), nil
 }
 
 // 根据第三方订单号生成单号
 func (o orderCli) GenOIDByThirdPayOID(ctx context.Context, orderType order_model.OrderType, uid, thirdPayOid string) (string, error) {
 	shard := dao.GenShard(uid)
-	return fmt.Sprintf("order-third-%d-%s-%s-%s", orderType, shard, uid, thirdPayOid), nil
+	return fmt.Sprintf("order-%s-%d-%s-%s-%s", oidKind_ThirdPayOID, orderType, shard, uid, thirdPayOid), nil
 }
 
-// 生成订单号
+// 生成订单号, 使用配置 OIDGeneratorType 选择的生成器
 func (o orderCli) GenOID(ctx context.Context, orderType order_model.OrderType, uid string) (string, error) {
+	g, ok := o.GetOIDGenerator(conf.Conf.OIDGeneratorType)
+	if !ok {
+		return "", fmt.Errorf("order GenOID unsupported OIDGeneratorType %v", conf.Conf.OIDGeneratorType)
+	}
 	shard := dao.GenShard(uid)
-	key := o.genOrderSeqNoKey(orderType, shard)
-	incrV, err := dao.RedisIncrBy(ctx, key, 1)
+	orderID, err := g.GenOID(ctx, orderType, shard)
 	if err != nil {
 		logger.Log.Error(ctx, "order GenOrderID err",
+			zap.String("OIDGeneratorType", conf.Conf.OIDGeneratorType),
 			zap.Error(err),
 		)
 		return "", err
 	}
-	orderID := fmt.Sprintf("order-sgen-%d-%s-%d-%d", orderType, shard, incrV, time.Now().Unix())
 	return orderID, nil
 }
-func (o orderCli) genOrderSeqNoKey(orderType order_model.OrderType, shardNum string) string {
-	text := conf.Conf.OrderSeqNoKeyFormat
-	text = strings.ReplaceAll(text, templateString_OrderType, strconv.Itoa(int(orderType)))
-	text = strings.ReplaceAll(text, templateString_ShardNum, shardNum)
-	return text
-}
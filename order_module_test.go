@@ -0,0 +1,287 @@
+package order
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/zlyuancn/order/conf"
+	"github.com/zlyuancn/order/dao"
+	"github.com/zlyuancn/order/metrics"
+	"github.com/zlyuancn/order/order_model"
+)
+
+func TestCanTransition(t *testing.T) {
+	const customType order_model.OrderType = 9901
+	const reviewing = order_model.OrderStatus_Custom + 1
+	RegistryOrderStateMachine(customType, order_model.NewDefaultOrderStateMachine().
+		AddState(reviewing, "Reviewing", false).
+		AddTransition(order_model.OrderStatus_Forwarding, reviewing).
+		RemoveTransition(order_model.OrderStatus_Forwarding, order_model.OrderStatus_Finish))
+
+	tests := []struct {
+		name      string
+		orderType order_model.OrderType
+		from, to  order_model.OrderStatus
+		want      bool
+	}{
+		{"default allowed", 1, order_model.OrderStatus_Forwarding, order_model.OrderStatus_Finish, true},
+		{"default denied", 1, order_model.OrderStatus_Finish, order_model.OrderStatus_Forwarding, false},
+		{"default unknown status", 1, order_model.OrderStatus_Forwarding, reviewing, false},
+		{"custom added", customType, order_model.OrderStatus_Forwarding, reviewing, true},
+		{"custom removed", customType, order_model.OrderStatus_Forwarding, order_model.OrderStatus_Finish, false},
+		{"custom inherited", customType, order_model.OrderStatus_Finish, order_model.OrderStatus_ReturnedBalance, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := orderApi.canTransition(tt.orderType, tt.from, tt.to); got != tt.want {
+				t.Errorf("canTransition(%d, %d, %d) = %v, want %v", tt.orderType, tt.from, tt.to, got, tt.want)
+			}
+		})
+	}
+
+	if !orderApi.canRefundTransition(order_model.OrderType(1), order_model.OrderStatus_ReturnedBalance) {
+		t.Error("canRefundTransition from ReturnedBalance = false, want true")
+	}
+	if orderApi.canRefundTransition(order_model.OrderType(1), order_model.OrderStatus_InsufficientBalance) {
+		t.Error("canRefundTransition from InsufficientBalance = true, want false")
+	}
+}
+
+func TestLogModel2OrderLog(t *testing.T) {
+	m := &dao.LogModel{
+		OrderID:        "o1",
+		Uid:            "u1",
+		LogType:        byte(order_model.OrderLogType_Status),
+		OldOrderStatus: byte(order_model.OrderStatus_Forwarding),
+		NewOrderStatus: byte(order_model.OrderStatus_Finish),
+		OldPayStatus:   byte(order_model.OrderPayStatus_None),
+		NewPayStatus:   byte(order_model.OrderPayStatus_Success),
+		Extend:         `{"a":1}`,
+		Remark:         "done",
+		Caller:         "svc",
+		Ctime:          1700000000,
+	}
+	want := order_model.OrderLog{
+		OrderID:      "o1",
+		Uid:          "u1",
+		LogType:      order_model.OrderLogType_Status,
+		OldStatus:    order_model.OrderStatus_Forwarding,
+		NewStatus:    order_model.OrderStatus_Finish,
+		OldPayStatus: order_model.OrderPayStatus_None,
+		NewPayStatus: order_model.OrderPayStatus_Success,
+		Extend:       `{"a":1}`,
+		Remark:       "done",
+		Caller:       "svc",
+		Ctime:        1700000000,
+	}
+	if got := orderApi.logModel2OrderLog(m); *got != want {
+		t.Errorf("logModel2OrderLog = %+v, want %+v", *got, want)
+	}
+}
+
+func TestForwardResult(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     order_model.OrderStatus
+		err        error
+		wantResult string
+		wantStatus order_model.OrderStatus
+	}{
+		{"ok", order_model.OrderStatus_Finish, nil, metrics.Result_OK, order_model.OrderStatus_Finish},
+		{"cancel", 0, OrderBusinessCancelForwardErr, metrics.Result_Cancel, order_model.OrderStatus_BusinessCancelForward},
+		{"unable to advance", 0, OrderUnableToAdvanceErr, metrics.Result_UnableToAdvance, order_model.OrderStatus_UnableToAdvance},
+		{"err", 0, errors.New("x"), metrics.Result_Err, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, status := orderApi.forwardResult(tt.status, tt.err)
+			if result != tt.wantResult || status != tt.wantStatus {
+				t.Errorf("forwardResult = %q, %d, want %q, %d", result, status, tt.wantResult, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestOrder2DBModelPayLegs(t *testing.T) {
+	order := &order_model.Order{OrderID: "o1", Uid: "u1", PayAmount: 1, PayStatus: order_model.OrderPayStatus_Success,
+		PayLegs: []*order_model.OrderPayLeg{
+			{PayType: 9001, PayAmount: 100},
+			{PayType: 9002, PayAmount: 200, PayStatus: order_model.OrderPayStatus_Success},
+		}}
+	// 付费金额为支付项之和, 有未支付的支付项时订单未支付
+	v, err := orderApi.order2DBModel(order, nil, order_model.OrderStatus_Forwarding)
+	if err != nil {
+		t.Fatalf("order2DBModel err: %v", err)
+	}
+	if v.PayAmount != 300 || v.PayStatus != byte(order_model.OrderPayStatus_None) {
+		t.Errorf("PayAmount = %d, PayStatus = %d, want 300, None", v.PayAmount, v.PayStatus)
+	}
+
+	got, err := orderApi.model2Order(v)
+	if err != nil {
+		t.Fatalf("model2Order err: %v", err)
+	}
+	if len(got.PayLegs) != 2 || *got.PayLegs[0] != *order.PayLegs[0] || *got.PayLegs[1] != *order.PayLegs[1] {
+		t.Errorf("PayLegs round trip = %+v", got.PayLegs)
+	}
+
+	order.PayLegs[0].PayStatus = order_model.OrderPayStatus_Success
+	v, _ = orderApi.order2DBModel(order, nil, order_model.OrderStatus_Forwarding)
+	if v.PayStatus != byte(order_model.OrderPayStatus_Success) {
+		t.Errorf("PayStatus = %d, want Success when all legs are paid", v.PayStatus)
+	}
+}
+
+func TestLockWaitDeadline(t *testing.T) {
+	old := conf.Conf
+	defer func() { conf.Conf = old }()
+
+	conf.Conf.OrderLockWaitTime = 0
+	if _, wait := orderApi.lockWaitDeadline(context.Background()); wait {
+		t.Error("lockWaitDeadline wait = true with OrderLockWaitTime=0")
+	}
+
+	conf.Conf.OrderLockWaitTime = 1000
+	deadline, wait := orderApi.lockWaitDeadline(context.Background())
+	if !wait || time.Until(deadline) > time.Second || time.Until(deadline) < 900*time.Millisecond {
+		t.Errorf("lockWaitDeadline = %v, %v, want about 1s", time.Until(deadline), wait)
+	}
+
+	// WithLockWait 覆盖配置
+	if _, wait := orderApi.lockWaitDeadline(order_model.WithLockWait(context.Background(), 0)); wait {
+		t.Error("lockWaitDeadline wait = true with WithLockWait(0)")
+	}
+
+	// 不超过ctx的截止时间
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	deadline, wait = orderApi.lockWaitDeadline(ctx)
+	if ctxDeadline, _ := ctx.Deadline(); !wait || !deadline.Equal(ctxDeadline) {
+		t.Errorf("lockWaitDeadline = %v, want ctx deadline %v", deadline, ctxDeadline)
+	}
+}
+
+func TestLockOrderWait(t *testing.T) {
+	old := conf.Conf
+	defer func() { conf.Conf = old }()
+	conf.Conf.LockType = conf.LockType_Local
+	conf.Conf.OrderLockWaitTime = 0
+
+	ctx := context.Background()
+	unlock, err := orderApi.lockOrder(ctx, "lock_wait_oid", "u1", "test")
+	if err != nil {
+		t.Fatalf("lockOrder err: %v", err)
+	}
+
+	// 不等待时立即返回锁被占用
+	if _, err := orderApi.lockOrder(ctx, "lock_wait_oid", "u1", "test"); err != OrderLockedErr {
+		t.Fatalf("lockOrder without wait err = %v, want OrderLockedErr", err)
+	}
+
+	// 等待超时后返回锁被占用
+	start := time.Now()
+	_, err = orderApi.lockOrder(order_model.WithLockWait(ctx, 100*time.Millisecond), "lock_wait_oid", "u1", "test")
+	if err != OrderLockedErr {
+		t.Fatalf("lockOrder wait timeout err = %v, want OrderLockedErr", err)
+	}
+	if cost := time.Since(start); cost < 100*time.Millisecond {
+		t.Errorf("lockOrder returned after %v, want to wait 100ms", cost)
+	}
+
+	// 等待期间锁被释放后获取成功
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		unlock(ctx)
+	}()
+	unlock, err = orderApi.lockOrder(order_model.WithLockWait(ctx, time.Second), "lock_wait_oid", "u1", "test")
+	if err != nil {
+		t.Fatalf("lockOrder wait err: %v", err)
+	}
+	unlock(ctx)
+}
+
+func TestUserOrdersCursor(t *testing.T) {
+	models := []*dao.Model{{ID: 30}, {ID: 20}, {ID: 10}}
+	tests := []struct {
+		name   string
+		models []*dao.Model
+		limit  int
+		want   uint
+	}{
+		{"full page", models, 3, 10},
+		{"last page", models, 5, 0},
+		{"empty", nil, 3, 0},
+	}
+	for _, tt := range tests {
+		if got := orderApi.userOrdersCursor(tt.models, tt.limit); got != tt.want {
+			t.Errorf("%s: userOrdersCursor = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestListUserOrdersLimit(t *testing.T) {
+	ctx := context.Background()
+	if _, _, err := orderApi.ListUserOrders(ctx, "u1", nil); err == nil {
+		t.Error("ListUserOrders with nil filter err = nil")
+	}
+	if _, _, err := orderApi.ListUserOrders(ctx, "u1", &order_model.UserOrderFilter{}); err == nil {
+		t.Error("ListUserOrders with zero limit err = nil")
+	}
+}
+
+func TestOIDShards(t *testing.T) {
+	old := conf.Conf
+	defer func() { conf.Conf = old }()
+	conf.Conf.TableShardNums = 2
+	conf.Conf.TableVersion = ""
+	conf.Conf.MigrateTableShardNums = 4
+	conf.Conf.MigrateTableVersion = "v2"
+
+	tests := []struct {
+		name            string
+		stage           string
+		legacyShardNums uint32
+		shard           string
+		want            []string
+		wantErr         error
+	}{
+		{"no migrate", "", 0, "1", []string{"1"}, nil},
+		{"no migrate out of range", "", 0, "3", nil, OrderIDInvalidErr},
+		{"dual write", conf.MigrateStage_DualWrite, 0, "1", []string{"1"}, nil},
+		{"cutover", conf.MigrateStage_Cutover, 0, "1", []string{"1", "0", "2", "3"}, nil},
+		{"cutover out of range", conf.MigrateStage_Cutover, 0, "5", []string{"0", "1", "2", "3"}, nil},
+		{"legacy", "", 2, "0", []string{"0", "1"}, nil},
+	}
+	for _, tt := range tests {
+		conf.Conf.MigrateStage = tt.stage
+		conf.Conf.LegacyShardNums = tt.legacyShardNums
+		got, err := orderApi.oidShards(&order_model.OIDInfo{Shard: tt.shard})
+		if err != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: oidShards = %v, %v, want %v, %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestDaoByOID(t *testing.T) {
+	old := conf.Conf
+	defer func() { conf.Conf = old }()
+	conf.Conf.TableShardNums = 2
+	conf.Conf.MigrateStage = ""
+	conf.Conf.LegacyShardNums = 0
+
+	if _, err := orderApi.daoByOID("order-uoid-1-1-u100-abc"); err != nil {
+		t.Errorf("daoByOID err: %v", err)
+	}
+	if _, err := orderApi.daoByOID("order-uoid-1-2-u100-abc"); err != OrderIDInvalidErr {
+		t.Errorf("daoByOID out of range err = %v, want OrderIDInvalidErr", err)
+	}
+	if _, err := orderApi.daoByOID("bad"); err != OrderIDInvalidErr {
+		t.Errorf("daoByOID invalid err = %v, want OrderIDInvalidErr", err)
+	}
+	if _, err := orderApi.findUidByOID(context.Background(), "bad"); err != OrderIDInvalidErr {
+		t.Errorf("findUidByOID invalid err = %v, want OrderIDInvalidErr", err)
+	}
+}
@@ -0,0 +1,127 @@
+package order
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/zly-app/zapp/logger"
+	"go.uber.org/zap"
+
+	"github.com/zlyuancn/order/conf"
+	"github.com/zlyuancn/order/dao"
+)
+
+/*
+补偿信号发件箱
+
+创建订单时补偿信号和订单在同一个事务中写入发件箱表, 由这里定时发送到mq, 发送成功后删除.
+订单提交成功则一定会有补偿信号, 订单提交失败则不会有补偿信号. 发送成功但删除失败时会重复发送, 推进订单是可重入的.
+补偿信号只写入主布局, 扩容迁移期间也会发送镜像布局中的信号, 避免切换主布局后遗漏切换前写入的信号.
+*/
+type outboxRelay struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+var defOutboxRelay *outboxRelay
+
+// 开始发送发件箱中的补偿信号
+func startOutboxRelay() {
+	if !conf.Conf.AllowOutbox {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defOutboxRelay = &outboxRelay{ctx: ctx, cancel: cancel}
+	defOutboxRelay.wg.Add(1)
+	go func() {
+		defer defOutboxRelay.wg.Done()
+		defOutboxRelay.run()
+	}()
+}
+
+// 停止发送发件箱中的补偿信号
+func stopOutboxRelay() {
+	if defOutboxRelay == nil {
+		return
+	}
+	defOutboxRelay.cancel()
+	defOutboxRelay.wg.Wait()
+}
+
+func (r *outboxRelay) run() {
+	t := time.NewTicker(time.Duration(conf.Conf.OutboxRelayInterval) * time.Second)
+	defer t.Stop()
+	for {
+		for _, l := range r.relayLayouts() {
+			for shard := uint32(0); shard < l.ShardNums && r.ctx.Err() == nil; shard++ {
+				r.relayShard(l, cast.ToString(shard))
+			}
+		}
+
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// 需要发送补偿信号的布局, 扩容迁移期间包含镜像布局
+func (r *outboxRelay) relayLayouts() []dao.Layout {
+	layouts := []dao.Layout{dao.PrimaryLayout()}
+	if l, ok := dao.MirrorLayout(); ok {
+		layouts = append(layouts, l)
+	}
+	return layouts
+}
+
+func (r *outboxRelay) relayShard(l dao.Layout, shard string) {
+	ctx := context.Background() // 服务退出时也需要完成正在发送的信号
+	key := r.genLockKey(l.TableSuffix(shard))
+	unlock, ok, err := dao.GetLocker().Lock(ctx, key, conf.Conf.OrderLockDBExpire, false)
+	if err != nil || !ok {
+		return
+	}
+	defer unlock(ctx)
+
+	// 在锁有效时间内发送完毕
+	deadline := time.Now().Add(time.Duration(conf.Conf.OrderLockDBExpire) * time.Second / 2)
+	limit := uint(conf.Conf.OutboxRelayBatchSize)
+	startID := uint(0)
+	for r.ctx.Err() == nil && time.Now().Before(deadline) {
+		models, err := l.DaoByShard(shard).ListOutbox(ctx, startID, limit)
+		if err != nil {
+			logger.Log.Error(ctx, "orderApi outboxRelay ListOutbox err",
+				zap.String("version", l.Version),
+				zap.String("shard", shard),
+				zap.Error(err),
+			)
+			return
+		}
+
+		for _, model := range models {
+			err = orderApi.SendCompensationSignal(ctx, model.OrderID, model.Uid)
+			if err != nil {
+				return // mq异常, 等待下次发送
+			}
+			err = l.DaoByShard(shard).DeleteOutbox(ctx, model.ID)
+			if err != nil {
+				return
+			}
+		}
+
+		if len(models) < int(limit) {
+			return
+		}
+		startID = models[len(models)-1].ID
+	}
+}
+
+func (r *outboxRelay) genLockKey(shard string) string {
+	return strings.ReplaceAll(conf.Conf.OutboxLockKeyFormat, templateString_ShardNum, shard)
+}
@@ -0,0 +1,59 @@
+package order
+
+import (
+	"testing"
+
+	"github.com/zlyuancn/order/conf"
+	"github.com/zlyuancn/order/dao"
+)
+
+func TestOutboxRelayLayouts(t *testing.T) {
+	old := conf.Conf
+	defer func() { conf.Conf = old }()
+	conf.Conf.TableShardNums = 2
+	conf.Conf.TableVersion = ""
+	conf.Conf.MigrateTableShardNums = 8
+	conf.Conf.MigrateTableVersion = "v2"
+
+	cur := dao.Layout{Version: "", ShardNums: 2}
+	dst := dao.Layout{Version: "v2", ShardNums: 8}
+	tests := []struct {
+		stage string
+		want  []dao.Layout
+	}{
+		{"", []dao.Layout{cur}},
+		{conf.MigrateStage_DualWrite, []dao.Layout{cur, dst}},
+		{conf.MigrateStage_Copy, []dao.Layout{cur, dst}},
+		{conf.MigrateStage_Cutover, []dao.Layout{dst, cur}},
+	}
+	r := &outboxRelay{}
+	for _, tt := range tests {
+		conf.Conf.MigrateStage = tt.stage
+		got := r.relayLayouts()
+		if len(got) != len(tt.want) {
+			t.Errorf("stage=%q relayLayouts() = %+v, want %+v", tt.stage, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("stage=%q relayLayouts()[%d] = %+v, want %+v", tt.stage, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestOutboxRelayLockKey(t *testing.T) {
+	old := conf.Conf
+	defer func() { conf.Conf = old }()
+	conf.Conf.OutboxLockKeyFormat = "order:lock:outbox:<shard_num>"
+
+	r := &outboxRelay{}
+	l := dao.Layout{Version: "v2", ShardNums: 8}
+	if got := r.genLockKey(l.TableSuffix("3")); got != "order:lock:outbox:v2_3" {
+		t.Errorf("genLockKey = %s, want order:lock:outbox:v2_3", got)
+	}
+	// 不同布局的同一分片不能共用锁
+	if r.genLockKey(l.TableSuffix("3")) == r.genLockKey(dao.Layout{ShardNums: 2}.TableSuffix("3")) {
+		t.Error("genLockKey should differ between layouts")
+	}
+}
@@ -0,0 +1,512 @@
+package order
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/bytedance/sonic"
+	"github.com/zly-app/zapp/logger"
+	"go.uber.org/zap"
+
+	"github.com/zlyuancn/order/dao"
+	"github.com/zlyuancn/order/order_model"
+)
+
+// 支付类型是否可以由订单系统主动扣款
+func (o orderCli) canDeduct(payType order_model.OrderPayType) bool {
+	if payType == order_model.OrderPayType_None {
+		return true
+	}
+	_, ok := o.GetPayProvider(payType)
+	return ok
+}
+
+/*
+生成扣款id, 用于支付提供者保证扣款幂等
+
+	legIndex 支付项索引, 非混合支付时为 -1
+*/
+func (orderCli) genPayID(orderID string, legIndex int) string {
+	if legIndex < 0 {
+		return orderID
+	}
+	return fmt.Sprintf("%s-%d", orderID, legIndex)
+}
+
+// 通过支付提供者扣款, 返回false一般为余额不足. 没有支付提供者的支付类型由外部支付, 未完成支付时返回 OrderPayNotSettledErr
+func (o orderCli) deductPay(ctx context.Context, order *order_model.Order, payType order_model.OrderPayType,
+	payID string, amount uint32) (bool, error) {
+	if payType == order_model.OrderPayType_None { // 无需支付
+		return true, nil
+	}
+	p, ok := o.GetPayProvider(payType)
+	if !ok { // 由外部支付, 等待支付完成
+		logger.Log.Warn(ctx, "orderApi deductPay pay not settled",
+			zap.Any("order", order),
+			zap.Int("payType", int(payType)),
+		)
+		return false, OrderPayNotSettledErr
+	}
+
+	// 查询是否已扣款, 防止重复扣款
+	payStatus, err := p.Query(ctx, order, payID)
+	if err != nil {
+		logger.Log.Error(ctx, "orderApi deductPay call PayProvider.Query err",
+			zap.Any("order", order),
+			zap.String("payID", payID),
+			zap.Error(err),
+		)
+		return false, err
+	}
+	if payStatus == order_model.OrderPayStatus_Success {
+		return true, nil
+	}
+
+	ok, err = p.Deduct(ctx, order, payID, amount)
+	if err != nil {
+		logger.Log.Error(ctx, "orderApi deductPay call PayProvider.Deduct err",
+			zap.Any("order", order),
+			zap.String("payID", payID),
+			zap.Uint32("amount", amount),
+			zap.Error(err),
+		)
+		return false, err
+	}
+	return ok, nil
+}
+
+// 通过支付提供者退款
+func (o orderCli) refundPay(ctx context.Context, order *order_model.Order, payType order_model.OrderPayType,
+	payID string, amount uint32) error {
+	if payType == order_model.OrderPayType_None { // 无需支付
+		return nil
+	}
+	p, ok := o.GetPayProvider(payType)
+	if !ok {
+		return fmt.Errorf("order refundPay unrealized payType=%v", payType)
+	}
+
+	err := p.Refund(ctx, order, payID, amount)
+	if err != nil {
+		logger.Log.Error(ctx, "orderApi refundPay call PayProvider.Refund err",
+			zap.Any("order", order),
+			zap.String("payID", payID),
+			zap.Uint32("amount", amount),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
+
+// 扣除一个支付项的余额, 返回false一般为余额不足
+func (o orderCli) deductPayLeg(ctx context.Context, order *order_model.Order, legIndex int) (bool, error) {
+	leg := order.PayLegs[legIndex]
+	return o.deductPay(ctx, order, leg.PayType, o.genPayID(order.OrderID, legIndex), leg.PayAmount)
+}
+
+// 退回一个支付项已扣除的余额
+func (o orderCli) refundPayLeg(ctx context.Context, order *order_model.Order, legIndex int) error {
+	leg := order.PayLegs[legIndex]
+	return o.refundPay(ctx, order, leg.PayType, o.genPayID(order.OrderID, legIndex), leg.PayAmount)
+}
+
+/*
+混合支付扣款
+
+只有在所有由外部支付的支付项都完成支付后才会开始扣款, 否则返回 OrderPayNotSettledErr.
+任意一个支付项扣款失败都会退回本次已扣款的支付项.
+
+return 扣除余额是否成功, false一般为余额不足
+*/
+func (o orderCli) deductPayLegs(ctx context.Context, order *order_model.Order) (bool, error) {
+	if i := o.unsettledExternalPayLeg(order); i >= 0 {
+		logger.Log.Warn(ctx, "orderApi deductPayLegs pay leg not settled",
+			zap.Any("order", order),
+			zap.Int("legIndex", i),
+		)
+		return false, OrderPayNotSettledErr
+	}
+
+	var deducted []int
+	for i, leg := range order.PayLegs {
+		if leg.PayStatus == order_model.OrderPayStatus_Success {
+			continue
+		}
+
+		ok, err := o.deductPayLeg(ctx, order, i)
+		if err != nil || !ok {
+			if err != nil {
+				logger.Log.Error(ctx, "orderApi deductPayLegs deductPayLeg err",
+					zap.Any("order", order),
+					zap.Int("legIndex", i),
+					zap.Error(err),
+				)
+			}
+			o.rollbackPayLegs(ctx, order, deducted)
+			return false, err
+		}
+		leg.PayStatus = order_model.OrderPayStatus_Success
+		deducted = append(deducted, i)
+	}
+
+	payLegs, err := sonic.MarshalString(order.PayLegs)
+	if err == nil {
+		err = dao.Dao(order.Uid).SetPayLegs(ctx, order.OrderID, payLegs, byte(order_model.OrderPayStatus_Success), "Auto Pay")
+	}
+	if err != nil {
+		logger.Log.Error(ctx, "orderApi deductPayLegs finish but set PayLegs err",
+			zap.Any("order", order),
+			zap.Error(err),
+		)
+		o.rollbackPayLegs(ctx, order, deducted)
+		return false, err
+	}
+	return true, nil
+}
+
+// 订单是否在等待外部支付完成, 订单系统不能主动扣款的支付类型由外部支付
+func (o orderCli) payNotSettled(order *order_model.Order) bool {
+	if order.PayStatus == order_model.OrderPayStatus_Success {
+		return false
+	}
+	if len(order.PayLegs) > 0 {
+		return o.unsettledExternalPayLeg(order) >= 0
+	}
+	return !o.canDeduct(order.PayType)
+}
+
+// 返回第一个等待外部支付的支付项索引, 不存在时返回 -1
+func (o orderCli) unsettledExternalPayLeg(order *order_model.Order) int {
+	for i, leg := range order.PayLegs {
+		if leg.PayStatus != order_model.OrderPayStatus_Success && !o.canDeduct(leg.PayType) {
+			return i
+		}
+	}
+	return -1
+}
+
+// 退回已扣款的支付项
+func (o orderCli) rollbackPayLegs(ctx context.Context, order *order_model.Order, deducted []int) {
+	for _, i := range deducted {
+		err := o.refundPayLeg(ctx, order, i)
+		if err != nil {
+			logger.Log.Error(ctx, "orderApi rollbackPayLegs refundPayLeg err",
+				zap.Any("order", order),
+				zap.Int("legIndex", i),
+				zap.Error(err),
+			)
+			continue
+		}
+		order.PayLegs[i].PayStatus = order_model.OrderPayStatus_None
+	}
+}
+
+/*
+更新混合支付中一个支付项的付费状态, 一般用于第三方支付平台的付费回调
+
+	legIndex 支付项索引
+	thirdPayOrderID 第三方支付订单id, 为空时不会更新
+
+已完成支付的支付项不能回退为未支付, 返回 OrderPayStatusBackwardErr.
+订单已关闭/取消等不会再交付的终态时收到支付完成会记录支付并退回这个支付项, 然后返回 OrderClosedErr 或 OrderTerminalErr
+*/
+func (o orderCli) UpdatePayLegStatus(ctx context.Context, orderID, uid string, legIndex int,
+	payStatus order_model.OrderPayStatus, thirdPayOrderID, remark string) error {
+	unlock, err := o.lockOrder(ctx, orderID, uid, "UpdatePayLegStatus")
+	if err != nil {
+		return err
+	}
+	defer unlock(ctx)
+
+	order, _, status, err := o.GetOrder(ctx, orderID, uid)
+	if err != nil {
+		return err
+	}
+	err = o.applyPayLegStatus(order, legIndex, payStatus, thirdPayOrderID)
+	if err != nil {
+		logger.Log.Warn(ctx, "orderApi UpdatePayLegStatus apply pay leg status err",
+			zap.Any("order", order),
+			zap.Int("legIndex", legIndex),
+			zap.Int("payStatus", int(payStatus)),
+			zap.Error(err),
+		)
+		return err
+	}
+	err = o.setPayLegs(ctx, order, legIndex, remark)
+	if err != nil {
+		return err
+	}
+
+	if payStatus != order_model.OrderPayStatus_Success || !o.refundLatePayLeg(order.OrderType, status) {
+		return nil
+	}
+	logger.Log.Warn(ctx, "orderApi UpdatePayLegStatus order is terminal, refund pay leg",
+		zap.Any("order", order),
+		zap.Int("status", int(status)),
+		zap.Int("legIndex", legIndex),
+		zap.String("remark", remark),
+	)
+	err = o.refundTerminalPayLeg(ctx, order, status, legIndex)
+	if err != nil {
+		return err
+	}
+	if status == order_model.OrderStatus_Closed {
+		return OrderClosedErr
+	}
+	return OrderTerminalErr
+}
+
+// 将支付项的付费状态写入订单数据, 不会写入db
+func (orderCli) applyPayLegStatus(order *order_model.Order, legIndex int, payStatus order_model.OrderPayStatus,
+	thirdPayOrderID string) error {
+	if legIndex < 0 || legIndex >= len(order.PayLegs) {
+		return fmt.Errorf("orderApi UpdatePayLegStatus legIndex %d out of range, legs=%d", legIndex, len(order.PayLegs))
+	}
+
+	leg := order.PayLegs[legIndex]
+	if leg.PayStatus == order_model.OrderPayStatus_Success && payStatus != order_model.OrderPayStatus_Success {
+		return OrderPayStatusBackwardErr
+	}
+	leg.PayStatus = payStatus
+	if thirdPayOrderID != "" {
+		leg.ThirdPayOrderID = thirdPayOrderID
+	}
+	return nil
+}
+
+// 订单处于这个状态时收到支付项付款是否需要退回. 已关闭/取消等不会再交付的内置终态需要退回, 完成的订单已经使用了这笔付款
+func (o orderCli) refundLatePayLeg(orderType order_model.OrderType, status order_model.OrderStatus) bool {
+	if status == order_model.OrderStatus_Finish || status >= order_model.OrderStatus_Custom {
+		return false
+	}
+	return o.GetOrderStateMachine(orderType).IsTerminal(status)
+}
+
+// 退回终态订单的一个支付项未退款的金额, 重复通知时可能已经退款
+func (o orderCli) refundTerminalPayLeg(ctx context.Context, order *order_model.Order, status order_model.OrderStatus,
+	legIndex int) error {
+	leg := order.PayLegs[legIndex]
+	if leg.PayType == order_model.OrderPayType_None || leg.RefundAmount >= leg.PayAmount {
+		return nil
+	}
+
+	amount := leg.PayAmount - leg.RefundAmount
+	err := o.refundPay(ctx, order, leg.PayType, o.genPayID(order.OrderID, legIndex), amount)
+	if err != nil {
+		logger.Log.Error(ctx, "orderApi UpdatePayLegStatus refund pay leg err",
+			zap.Any("order", order),
+			zap.Int("legIndex", legIndex),
+			zap.Uint32("amount", amount),
+			zap.Error(err),
+		)
+		return err
+	}
+	leg.RefundAmount += amount
+	order.RefundAmount += amount
+
+	payLegs, err := sonic.MarshalString(order.PayLegs)
+	if err != nil {
+		return err
+	}
+	expect := order_model.UpdateExpect{Status: status}
+	err = dao.Dao(order.Uid).SetRefund(ctx, order.OrderID, order.RefundAmount, payLegs, status, "order is terminal", expect, nil)
+	if err != nil {
+		logger.Log.Error(ctx, "orderApi UpdatePayLegStatus refund finish but call SetRefund err",
+			zap.Any("order", order),
+			zap.Int("legIndex", legIndex),
+			zap.Uint32("amount", amount),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
+
+// 写入混合支付的支付项, 所有支付项都完成支付时订单为支付完成
+func (o orderCli) setPayLegs(ctx context.Context, order *order_model.Order, legIndex int, remark string) error {
+	orderPayStatus := order_model.OrderPayStatus_None
+	if order.PayLegsSettled() {
+		orderPayStatus = order_model.OrderPayStatus_Success
+	}
+
+	payLegs, err := sonic.MarshalString(order.PayLegs)
+	if err != nil {
+		return err
+	}
+	err = dao.Dao(order.Uid).SetPayLegs(ctx, order.OrderID, payLegs, byte(orderPayStatus), remark)
+	if err != nil {
+		logger.Log.Error(ctx, "orderApi UpdatePayLegStatus call SetPayLegs err",
+			zap.Any("order", order),
+			zap.Int("legIndex", legIndex),
+			zap.String("remark", remark),
+			zap.Error(err),
+		)
+		return err
+	}
+	order.PayStatus = orderPayStatus
+	return nil
+}
+
+/*
+订单退款, 支持多次部分退款
+
+	amount 退款金额, 单位分, 为0表示退回所有可退款金额
+	reason 退款原因
+
+会先通过支付提供者退款, 记录退款后如果业务层实现了 order_model.OrderRefunder 会调用 RefundCallback 撤回已交付的内容.
+全额退款后订单状态会变为 OrderStatus_ReturnedBalance, 订单状态机不允许时返回 OrderStatusTransitionErr 且不会退款.
+混合支付未全部完成支付时可以退回已支付的支付项.
+*/
+func (o orderCli) RefundOrder(ctx context.Context, orderID, uid string, amount uint32, reason string) error {
+	unlock, err := o.lockOrder(ctx, orderID, uid, "RefundOrder")
+	if err != nil {
+		return err
+	}
+	defer unlock(ctx)
+
+	order, extendText, status, err := o.GetOrder(ctx, orderID, uid)
+	if err != nil {
+		return err
+	}
+	return o.refundOrder(ctx, order, extendText, status, amount, reason, true)
+}
+
+/*
+订单退款, 调用前需要持有订单锁
+
+	withCallback 是否调用业务层的 RefundCallback, 业务层已经在其它回调中撤回交付内容时传false
+*/
+func (o orderCli) refundOrder(ctx context.Context, order *order_model.Order, extendText string,
+	status order_model.OrderStatus, amount uint32, reason string, withCallback bool) error {
+	paid := order.PaidAmount()
+	if paid == 0 {
+		logger.Log.Warn(ctx, "orderApi refundOrder order not paid",
+			zap.Any("order", order),
+		)
+		return OrderNotPaidErr
+	}
+	refundable := paid - order.RefundAmount
+	if amount == 0 {
+		amount = refundable
+	}
+	if amount == 0 || amount > refundable {
+		logger.Log.Warn(ctx, "orderApi refundOrder amount exceeds refundable amount",
+			zap.Any("order", order),
+			zap.Uint32("amount", amount),
+			zap.Uint32("refundable", refundable),
+		)
+		return OrderRefundAmountErr
+	}
+
+	ob, ok := o.GetOrderBusiness(order.OrderType)
+	if !ok {
+		return fmt.Errorf("orderApi refundOrder OrderType %v not found OrderBusiness", order.OrderType)
+	}
+	extend, err := o.parseExtend(ctx, ob, extendText)
+	if err != nil {
+		return fmt.Errorf("orderApi refundOrder Unmarshal extend err. orderID=%v, err=%v", order.OrderID, err)
+	}
+
+	// 全额退款会变更订单状态, 在退款前检查, 避免退款后无法记录
+	if amount == refundable && !o.canRefundTransition(order.OrderType, status) {
+		logger.Log.Warn(ctx, "orderApi refundOrder transition not allowed",
+			zap.Any("order", order),
+			zap.Int("status", int(status)),
+		)
+		return OrderStatusTransitionErr
+	}
+
+	// 退款
+	refunded, refundErr := o.refundPaid(ctx, order, amount)
+	if refunded == 0 {
+		return refundErr
+	}
+
+	// 混合支付部分支付项退款失败时也需要记录已退款的金额
+	var payLegs string
+	if len(order.PayLegs) > 0 {
+		payLegs, err = sonic.MarshalString(order.PayLegs)
+		if err != nil {
+			return err
+		}
+	}
+	order.RefundAmount += refunded
+	newStatus := status
+	if order.RefundAmount == paid {
+		newStatus = order_model.OrderStatus_ReturnedBalance
+	}
+	expect := order_model.UpdateExpect{Status: status}
+	err = dao.Dao(order.Uid).SetRefund(ctx, order.OrderID, order.RefundAmount, payLegs, newStatus, reason, expect, o.canTransition)
+	if err != nil {
+		logger.Log.Error(ctx, "orderApi refundOrder refund finish but call SetRefund err",
+			zap.Any("order", order),
+			zap.Uint32("refunded", refunded),
+			zap.Int("status", int(newStatus)),
+			zap.String("reason", reason),
+			zap.Error(err),
+		)
+		return err
+	}
+
+	// 业务层撤回已退款部分对应的交付内容
+	if refunder, ok := order_model.AsOrderRefunder(ob); ok && withCallback {
+		err = refunder.RefundCallback(ctx, order, extend, refunded, reason)
+		if err != nil {
+			logger.Log.Error(ctx, "orderApi refundOrder refund finish but call RefundCallback err",
+				zap.Any("order", order),
+				zap.Any("extend", extend),
+				zap.Uint32("refunded", refunded),
+				zap.String("reason", reason),
+				zap.Error(err),
+			)
+			return err
+		}
+	}
+	return refundErr
+}
+
+// 订单状态是否允许全额退款后转为 OrderStatus_ReturnedBalance
+func (o orderCli) canRefundTransition(orderType order_model.OrderType, status order_model.OrderStatus) bool {
+	return status == order_model.OrderStatus_ReturnedBalance ||
+		o.canTransition(orderType, status, order_model.OrderStatus_ReturnedBalance)
+}
+
+// 通过支付提供者退回已支付的金额, 返回实际退款金额. 混合支付部分支付项退款失败时也会返回已退款的金额
+func (o orderCli) refundPaid(ctx context.Context, order *order_model.Order, amount uint32) (uint32, error) {
+	if len(order.PayLegs) > 0 {
+		return o.refundPayLegs(ctx, order, amount)
+	}
+	err := o.refundPay(ctx, order, order.PayType, o.genPayID(order.OrderID, -1), amount)
+	if err != nil {
+		return 0, err
+	}
+	return amount, nil
+}
+
+// 混合支付退款, 从最后一个支付项开始退款, 返回实际退款金额
+func (o orderCli) refundPayLegs(ctx context.Context, order *order_model.Order, amount uint32) (uint32, error) {
+	var refunded uint32
+	for i := len(order.PayLegs) - 1; i >= 0 && amount > 0; i-- {
+		leg := order.PayLegs[i]
+		if leg.PayStatus != order_model.OrderPayStatus_Success || leg.RefundAmount >= leg.PayAmount {
+			continue
+		}
+
+		legAmount := leg.PayAmount - leg.RefundAmount
+		if legAmount > amount {
+			legAmount = amount
+		}
+		err := o.refundPay(ctx, order, leg.PayType, o.genPayID(order.OrderID, i), legAmount)
+		if err != nil {
+			return refunded, err
+		}
+		leg.RefundAmount += legAmount
+		refunded += legAmount
+		amount -= legAmount
+	}
+	if amount > 0 {
+		return refunded, OrderRefundAmountErr
+	}
+	return refunded, nil
+}
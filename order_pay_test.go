@@ -0,0 +1,354 @@
+package order
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/zlyuancn/order/conf"
+	"github.com/zlyuancn/order/order_model"
+)
+
+// 测试用的支付类型
+const (
+	testPayType_Balance  order_model.OrderPayType = 9001 // 注册了支付提供者, 可以主动扣款
+	testPayType_External order_model.OrderPayType = 9002 // 由外部支付
+)
+
+var testPayProvider = &fakePayProvider{}
+
+func init() {
+	RegistryPayProvider(testPayType_Balance, testPayProvider)
+}
+
+// 测试用的支付提供者, 记录每个扣款id的扣款和退款金额
+type fakePayProvider struct {
+	deducts    map[string]uint32
+	refunds    map[string]uint32
+	paid       map[string]bool // 查询时返回已扣款的扣款id
+	noBalance  map[string]bool // 余额不足的扣款id
+	refundFail map[string]bool // 退款会失败的扣款id
+}
+
+// 清空退款记录, 并设置退款会失败的扣款id
+func (p *fakePayProvider) reset(refundFail ...string) {
+	p.deducts = make(map[string]uint32)
+	p.refunds = make(map[string]uint32)
+	p.paid = make(map[string]bool)
+	p.noBalance = make(map[string]bool)
+	p.refundFail = make(map[string]bool)
+	for _, payID := range refundFail {
+		p.refundFail[payID] = true
+	}
+}
+
+func (p *fakePayProvider) Deduct(ctx context.Context, order *order_model.Order, payID string, amount uint32) (bool, error) {
+	if p.noBalance[payID] {
+		return false, nil
+	}
+	p.deducts[payID] += amount
+	return true, nil
+}
+
+func (p *fakePayProvider) Refund(ctx context.Context, order *order_model.Order, payID string, amount uint32) error {
+	if p.refundFail[payID] {
+		return errors.New("refund failed")
+	}
+	p.refunds[payID] += amount
+	return nil
+}
+
+func (p *fakePayProvider) Query(ctx context.Context, order *order_model.Order, payID string) (order_model.OrderPayStatus, error) {
+	if p.paid[payID] {
+		return order_model.OrderPayStatus_Success, nil
+	}
+	return order_model.OrderPayStatus_None, nil
+}
+
+func TestPayNotSettled(t *testing.T) {
+	leg := func(payType order_model.OrderPayType, status order_model.OrderPayStatus) *order_model.OrderPayLeg {
+		return &order_model.OrderPayLeg{PayType: payType, PayStatus: status, PayAmount: 100}
+	}
+	tests := []struct {
+		name  string
+		order *order_model.Order
+		want  bool
+	}{
+		{"no pay", &order_model.Order{PayType: order_model.OrderPayType_None}, false},
+		{"balance", &order_model.Order{PayType: testPayType_Balance}, false},
+		{"external unpaid", &order_model.Order{PayType: testPayType_External}, true},
+		{"external paid", &order_model.Order{PayType: testPayType_External, PayStatus: order_model.OrderPayStatus_Success}, false},
+		{"legs external unpaid", &order_model.Order{PayLegs: []*order_model.OrderPayLeg{
+			leg(testPayType_Balance, order_model.OrderPayStatus_None),
+			leg(testPayType_External, order_model.OrderPayStatus_None),
+		}}, true},
+		{"legs external paid", &order_model.Order{PayLegs: []*order_model.OrderPayLeg{
+			leg(testPayType_Balance, order_model.OrderPayStatus_None),
+			leg(testPayType_External, order_model.OrderPayStatus_Success),
+		}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := orderApi.payNotSettled(tt.order); got != tt.want {
+				t.Errorf("payNotSettled = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeductPayNotSettled(t *testing.T) {
+	order := &order_model.Order{OrderID: "o1", PayType: testPayType_External, PayAmount: 100}
+	ok, err := orderApi.deductPay(context.Background(), order, order.PayType, "o1", order.PayAmount)
+	if ok || err != OrderPayNotSettledErr {
+		t.Errorf("deductPay = %v, %v, want false, OrderPayNotSettledErr", ok, err)
+	}
+
+	order = &order_model.Order{OrderID: "o2", PayLegs: []*order_model.OrderPayLeg{
+		{PayType: testPayType_External, PayAmount: 100},
+	}}
+	ok, err = orderApi.deductPayLegs(context.Background(), order)
+	if ok || err != OrderPayNotSettledErr {
+		t.Errorf("deductPayLegs = %v, %v, want false, OrderPayNotSettledErr", ok, err)
+	}
+}
+
+func TestForwardFailedPayNotSettled(t *testing.T) {
+	old := conf.Conf
+	defer func() { conf.Conf = old }()
+	conf.Conf.ForwardMaxAttempts = 1
+
+	// 等待支付不会计入推进失败次数, 不会访问数据库
+	order := &order_model.Order{OrderID: "o1", Uid: "u1", PayType: testPayType_External}
+	err := orderApi.forwardFailed(context.Background(), nil, order, nil, OrderPayNotSettledErr)
+	if err != OrderPayNotSettledErr {
+		t.Errorf("forwardFailed err = %v, want OrderPayNotSettledErr", err)
+	}
+	if OrderPayLegNotSettledErr != OrderPayNotSettledErr {
+		t.Error("OrderPayLegNotSettledErr should be the same sentinel as OrderPayNotSettledErr")
+	}
+}
+
+func TestApplyPayLegStatus(t *testing.T) {
+	newOrder := func() *order_model.Order {
+		return &order_model.Order{PayLegs: []*order_model.OrderPayLeg{
+			{PayType: testPayType_External, PayAmount: 100},
+			{PayType: testPayType_External, PayStatus: order_model.OrderPayStatus_Success, PayAmount: 100, ThirdPayOrderID: "t1"},
+		}}
+	}
+
+	order := newOrder()
+	if err := orderApi.applyPayLegStatus(order, 2, order_model.OrderPayStatus_Success, ""); err == nil {
+		t.Error("legIndex out of range should fail")
+	}
+	if err := orderApi.applyPayLegStatus(order, -1, order_model.OrderPayStatus_Success, ""); err == nil {
+		t.Error("negative legIndex should fail")
+	}
+
+	err := orderApi.applyPayLegStatus(order, 0, order_model.OrderPayStatus_Success, "t0")
+	if err != nil || order.PayLegs[0].PayStatus != order_model.OrderPayStatus_Success || order.PayLegs[0].ThirdPayOrderID != "t0" {
+		t.Errorf("apply success = %v, leg = %+v", err, *order.PayLegs[0])
+	}
+
+	// 重复通知支付完成, 不传第三方订单id时保留原值
+	err = orderApi.applyPayLegStatus(order, 1, order_model.OrderPayStatus_Success, "")
+	if err != nil || order.PayLegs[1].ThirdPayOrderID != "t1" {
+		t.Errorf("apply duplicate success = %v, leg = %+v", err, *order.PayLegs[1])
+	}
+
+	// 已支付不能回退
+	order = newOrder()
+	err = orderApi.applyPayLegStatus(order, 1, order_model.OrderPayStatus_None, "")
+	if err != OrderPayStatusBackwardErr || order.PayLegs[1].PayStatus != order_model.OrderPayStatus_Success {
+		t.Errorf("apply backward = %v, leg = %+v, want OrderPayStatusBackwardErr", err, *order.PayLegs[1])
+	}
+}
+
+func TestRefundLatePayLeg(t *testing.T) {
+	tests := []struct {
+		status order_model.OrderStatus
+		want   bool
+	}{
+		{order_model.OrderStatus_Forwarding, false},
+		{order_model.OrderStatus_UnableToAdvance, false},
+		{order_model.OrderStatus_Finish, false},
+		{order_model.OrderStatus_Closed, true},
+		{order_model.OrderStatus_BusinessCancelForward, true},
+		{order_model.OrderStatus_InsufficientBalance, true},
+		{order_model.OrderStatus_ReturnedBalance, true},
+		{order_model.OrderStatus_Custom, false},
+	}
+	for _, tt := range tests {
+		if got := orderApi.refundLatePayLeg(1, tt.status); got != tt.want {
+			t.Errorf("refundLatePayLeg(%d) = %v, want %v", tt.status, got, tt.want)
+		}
+	}
+}
+
+// 部分支付项已支付的混合支付订单
+func newPartlyPaidOrder() *order_model.Order {
+	return &order_model.Order{OrderID: "o1", Uid: "u1", PayLegs: []*order_model.OrderPayLeg{
+		{PayType: testPayType_Balance, PayStatus: order_model.OrderPayStatus_Success, PayAmount: 100},
+		{PayType: testPayType_External, PayAmount: 200},
+		{PayType: testPayType_Balance, PayStatus: order_model.OrderPayStatus_Success, PayAmount: 300},
+	}}
+}
+
+func TestRefundPaidPartlyPaid(t *testing.T) {
+	testPayProvider.reset()
+	order := newPartlyPaidOrder()
+	refunded, err := orderApi.refundPaid(context.Background(), order, order.PaidAmount())
+	if err != nil || refunded != 400 {
+		t.Fatalf("refundPaid = %d, %v, want 400, nil", refunded, err)
+	}
+	if testPayProvider.refunds["o1-0"] != 100 || testPayProvider.refunds["o1-2"] != 300 || len(testPayProvider.refunds) != 2 {
+		t.Errorf("refunds = %v, want only the captured legs", testPayProvider.refunds)
+	}
+	if order.PayLegs[0].RefundAmount != 100 || order.PayLegs[1].RefundAmount != 0 || order.PayLegs[2].RefundAmount != 300 {
+		t.Errorf("leg refund amounts = %d, %d, %d", order.PayLegs[0].RefundAmount, order.PayLegs[1].RefundAmount,
+			order.PayLegs[2].RefundAmount)
+	}
+}
+
+func TestRefundPaidFailed(t *testing.T) {
+	// 先退最后一个支付项, 第一个支付项退款失败时返回已退款的金额
+	testPayProvider.reset("o1-0")
+	order := newPartlyPaidOrder()
+	refunded, err := orderApi.refundPaid(context.Background(), order, order.PaidAmount())
+	if err == nil || refunded != 300 {
+		t.Errorf("refundPaid = %d, %v, want 300 and err", refunded, err)
+	}
+	if order.PayLegs[0].RefundAmount != 0 || order.PayLegs[2].RefundAmount != 300 {
+		t.Errorf("leg refund amounts = %d, %d", order.PayLegs[0].RefundAmount, order.PayLegs[2].RefundAmount)
+	}
+
+	// 单一支付类型退款失败
+	testPayProvider.reset("o2")
+	order = &order_model.Order{OrderID: "o2", PayType: testPayType_Balance, PayStatus: order_model.OrderPayStatus_Success, PayAmount: 100}
+	refunded, err = orderApi.refundPaid(context.Background(), order, 100)
+	if err == nil || refunded != 0 {
+		t.Errorf("refundPaid = %d, %v, want 0 and err", refunded, err)
+	}
+}
+
+func TestRefundOrderAmountCheck(t *testing.T) {
+	ctx := context.Background()
+	testPayProvider.reset()
+
+	// 没有已支付的支付项
+	order := &order_model.Order{OrderID: "o1", PayLegs: []*order_model.OrderPayLeg{
+		{PayType: testPayType_External, PayAmount: 100},
+	}}
+	err := orderApi.refundOrder(ctx, order, "", order_model.OrderStatus_BusinessCancelForward, 0, "", false)
+	if err != OrderNotPaidErr {
+		t.Errorf("refundOrder unpaid err = %v, want OrderNotPaidErr", err)
+	}
+
+	// 部分支付时最多退回已支付的金额
+	order = newPartlyPaidOrder()
+	err = orderApi.refundOrder(ctx, order, "", order_model.OrderStatus_BusinessCancelForward, 401, "", false)
+	if err != OrderRefundAmountErr {
+		t.Errorf("refundOrder over paid amount err = %v, want OrderRefundAmountErr", err)
+	}
+	if len(testPayProvider.refunds) != 0 {
+		t.Errorf("refunds = %v, want none", testPayProvider.refunds)
+	}
+}
+
+func TestGenPayID(t *testing.T) {
+	if got := orderApi.genPayID("o1", -1); got != "o1" {
+		t.Errorf("genPayID(o1, -1) = %q, want o1", got)
+	}
+	if got := orderApi.genPayID("o1", 2); got != "o1-2" {
+		t.Errorf("genPayID(o1, 2) = %q, want o1-2", got)
+	}
+}
+
+func TestDeductPayLegsRollback(t *testing.T) {
+	// 第二个支付项余额不足, 退回已扣款的第一个支付项, 不会写入数据库
+	testPayProvider.reset()
+	testPayProvider.noBalance["o1-2"] = true
+	order := &order_model.Order{OrderID: "o1", Uid: "u1", PayLegs: []*order_model.OrderPayLeg{
+		{PayType: testPayType_Balance, PayAmount: 100},
+		{PayType: testPayType_External, PayStatus: order_model.OrderPayStatus_Success, PayAmount: 200},
+		{PayType: testPayType_Balance, PayAmount: 300},
+	}}
+	ok, err := orderApi.deductPayLegs(context.Background(), order)
+	if ok || err != nil {
+		t.Fatalf("deductPayLegs = %v, %v, want false, nil", ok, err)
+	}
+	if testPayProvider.deducts["o1-0"] != 100 || testPayProvider.refunds["o1-0"] != 100 {
+		t.Errorf("deducts = %v, refunds = %v, want leg 0 deducted and refunded", testPayProvider.deducts, testPayProvider.refunds)
+	}
+	if _, ok := testPayProvider.refunds["o1-1"]; ok {
+		t.Error("external pay leg should not be refunded")
+	}
+	if order.PayLegs[0].PayStatus != order_model.OrderPayStatus_None || order.PayLegs[2].PayStatus != order_model.OrderPayStatus_None {
+		t.Errorf("balance legs should be unpaid after rollback")
+	}
+	if !order.HasCapturedPayLeg() {
+		t.Error("external pay leg is still captured")
+	}
+}
+
+func TestDeductPay(t *testing.T) {
+	ctx := context.Background()
+	order := &order_model.Order{OrderID: "o1", PayType: testPayType_Balance, PayAmount: 100}
+
+	testPayProvider.reset()
+	ok, err := orderApi.deductPay(ctx, order, order.PayType, "o1", 100)
+	if !ok || err != nil || testPayProvider.deducts["o1"] != 100 {
+		t.Errorf("deductPay = %v, %v, deducts = %v", ok, err, testPayProvider.deducts)
+	}
+
+	// 已扣款时不会重复扣款
+	testPayProvider.reset()
+	testPayProvider.paid["o1"] = true
+	ok, err = orderApi.deductPay(ctx, order, order.PayType, "o1", 100)
+	if !ok || err != nil || len(testPayProvider.deducts) != 0 {
+		t.Errorf("deductPay paid = %v, %v, deducts = %v", ok, err, testPayProvider.deducts)
+	}
+
+	testPayProvider.reset()
+	testPayProvider.noBalance["o1"] = true
+	ok, err = orderApi.deductPay(ctx, order, order.PayType, "o1", 100)
+	if ok || err != nil {
+		t.Errorf("deductPay no balance = %v, %v, want false, nil", ok, err)
+	}
+
+	// 无需支付
+	ok, err = orderApi.deductPay(ctx, order, order_model.OrderPayType_None, "o1", 100)
+	if !ok || err != nil {
+		t.Errorf("deductPay none = %v, %v, want true, nil", ok, err)
+	}
+}
+
+func TestRefundPay(t *testing.T) {
+	ctx := context.Background()
+	order := &order_model.Order{OrderID: "o1"}
+	testPayProvider.reset()
+	if err := orderApi.refundPay(ctx, order, testPayType_Balance, "o1", 100); err != nil || testPayProvider.refunds["o1"] != 100 {
+		t.Errorf("refundPay = %v, refunds = %v", err, testPayProvider.refunds)
+	}
+	if err := orderApi.refundPay(ctx, order, order_model.OrderPayType_None, "o1", 100); err != nil {
+		t.Errorf("refundPay none = %v, want nil", err)
+	}
+	if err := orderApi.refundPay(ctx, order, testPayType_External, "o1", 100); err == nil {
+		t.Error("refundPay without PayProvider should fail")
+	}
+}
+
+func TestRegistryPayProvider(t *testing.T) {
+	if !orderApi.canDeduct(testPayType_Balance) || !orderApi.canDeduct(order_model.OrderPayType_None) {
+		t.Error("canDeduct registered or none pay type = false, want true")
+	}
+	if orderApi.canDeduct(testPayType_External) {
+		t.Error("canDeduct external pay type = true, want false")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("repeated RegistryPayProvider should panic")
+		}
+	}()
+	RegistryPayProvider(testPayType_Balance, testPayProvider)
+}
@@ -0,0 +1,151 @@
+package order
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/zly-app/zapp/logger"
+	"go.uber.org/zap"
+
+	"github.com/zlyuancn/order/conf"
+	"github.com/zlyuancn/order/dao"
+	"github.com/zlyuancn/order/metrics"
+	"github.com/zlyuancn/order/order_model"
+)
+
+/*
+扫表补偿
+
+定时扫描各分表中更新时间早于 CompensationDelayTime 的推进中订单并推进, 用于进程崩溃等原因导致订单停留在推进中状态时的补偿, 不依赖mq.
+每个分表在每个扫表间隔内只会有一个实例在扫描.
+等待外部支付的订单(如不启用后置补偿的先下单后付款订单)不会被推进, 由支付回调推进.
+*/
+type dbScanner struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+var defDBScanner *dbScanner
+
+// 开始扫表补偿
+func startDBScan() {
+	if !conf.Conf.AllowDBScanCompensation {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defDBScanner = &dbScanner{ctx: ctx, cancel: cancel}
+	defDBScanner.wg.Add(1)
+	go func() {
+		defer defDBScanner.wg.Done()
+		defDBScanner.run()
+	}()
+}
+
+// 停止扫表补偿, 会等待正在推进的订单完成
+func stopDBScan() {
+	if defDBScanner == nil {
+		return
+	}
+	defDBScanner.cancel()
+	defDBScanner.wg.Wait()
+}
+
+func (s *dbScanner) run() {
+	interval := time.Duration(conf.Conf.DBScanInterval) * time.Second
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		for shard := uint32(0); shard < dao.ShardNums() && s.ctx.Err() == nil; shard++ {
+			s.scanShard(cast.ToString(shard))
+		}
+
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (s *dbScanner) scanShard(shard string) {
+	// 租约会在扫表间隔后过期, 避免其它实例在同一个间隔内重复扫描
+	key := s.genLockKey(shard)
+	ok, err := dao.GetLocker().Lease(s.ctx, key, int(conf.Conf.DBScanInterval))
+	if err != nil || !ok {
+		return
+	}
+
+	utime := time.Now().Add(-time.Duration(conf.Conf.CompensationDelayTime) * time.Second)
+	limit := uint(conf.Conf.DBScanBatchSize)
+	sem := make(chan struct{}, conf.Conf.DBScanConcurrency)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	startID := uint(0)
+	for s.ctx.Err() == nil {
+		models, err := dao.DaoByShard(shard).ListByStatusBefore(s.ctx, order_model.OrderStatus_Forwarding, utime, startID, limit)
+		if err != nil {
+			if s.ctx.Err() == nil {
+				logger.Log.Error(s.ctx, "orderApi dbScan ListByStatusBefore err",
+					zap.String("shard", shard),
+					zap.Uint("startID", startID),
+					zap.Error(err),
+				)
+			}
+			return
+		}
+
+		for _, model := range models {
+			if s.waitingPay(model) {
+				continue
+			}
+			select {
+			case <-s.ctx.Done():
+				return
+			case sem <- struct{}{}:
+			}
+			wg.Add(1)
+			go func(orderID, uid string) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				s.forward(orderID, uid)
+			}(model.OrderID, model.Uid)
+		}
+
+		if len(models) < int(limit) {
+			return
+		}
+		startID = models[len(models)-1].ID
+	}
+}
+
+// 订单是否在等待外部支付, 这类订单推进也只会失败
+func (s *dbScanner) waitingPay(model *dao.Model) bool {
+	order, err := orderApi.model2Order(model)
+	if err != nil {
+		return false // 交给推进流程处理
+	}
+	return orderApi.payNotSettled(order)
+}
+
+func (s *dbScanner) forward(orderID, uid string) {
+	ctx := context.Background() // 服务退出时也需要完成正在推进的订单
+	_, _, err := orderApi.forwardOrderID(ctx, orderID, uid, metrics.ForwardMethod_DBScan)
+	if err == nil || err == OrderBusinessCancelForwardErr || err == OrderUnableToAdvanceErr {
+		return
+	}
+	logger.Log.Warn(ctx, "orderApi dbScan forwardOrderID err",
+		zap.String("orderID", orderID),
+		zap.String("uid", uid),
+		zap.Error(err),
+	)
+}
+
+func (s *dbScanner) genLockKey(shard string) string {
+	return strings.ReplaceAll(conf.Conf.DBScanLockKeyFormat, templateString_ShardNum, shard)
+}
@@ -0,0 +1,32 @@
+package order
+
+import (
+	"testing"
+
+	"github.com/zlyuancn/order/dao"
+	"github.com/zlyuancn/order/order_model"
+)
+
+func TestDBScanWaitingPay(t *testing.T) {
+	s := &dbScanner{}
+	tests := []struct {
+		name  string
+		model *dao.Model
+		want  bool
+	}{
+		{"no pay", &dao.Model{PayType: int16(order_model.OrderPayType_None)}, false},
+		{"balance", &dao.Model{PayType: int16(testPayType_Balance)}, false},
+		{"external unpaid", &dao.Model{PayType: int16(testPayType_External)}, true},
+		{"external paid", &dao.Model{PayType: int16(testPayType_External), PayStatus: byte(order_model.OrderPayStatus_Success)}, false},
+		{"legs external unpaid", &dao.Model{PayLegs: `[{"PayType":9001,"PayAmount":100},{"PayType":9002,"PayAmount":100}]`}, true},
+		{"legs external paid", &dao.Model{PayLegs: `[{"PayType":9001,"PayAmount":100},{"PayType":9002,"PayStatus":1,"PayAmount":100}]`}, false},
+		{"invalid legs", &dao.Model{PayLegs: `[`}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.waitingPay(tt.model); got != tt.want {
+				t.Errorf("waitingPay = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
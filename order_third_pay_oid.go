@@ -0,0 +1,110 @@
+package order
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/spf13/cast"
+	"github.com/zly-app/zapp/logger"
+	"go.uber.org/zap"
+
+	"github.com/zlyuancn/order/conf"
+	"github.com/zlyuancn/order/dao"
+	"github.com/zlyuancn/order/order_model"
+)
+
+/*
+根据第三方支付订单id获取订单
+
+	uid 用户唯一标识, 为空时先通过映射表(需要开启 AllowThirdPayOIDMapping)查找订单所在分表, 映射表中不存在时扫描所有分表
+*/
+func (o orderCli) GetOrderByThirdPayOID(ctx context.Context, thirdPayOid, uid string) (
+	*order_model.Order, string, order_model.OrderStatus, error) {
+	model, err := o.findByThirdPayOID(ctx, thirdPayOid, uid)
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	order, err := o.model2Order(model)
+	if err != nil {
+		logger.Log.Error(ctx, "GetOrderByThirdPayOID Unmarshal PayLegs err",
+			zap.String("thirdPayOid", thirdPayOid),
+			zap.String("orderID", model.OrderID),
+			zap.String("payLegs", model.PayLegs),
+			zap.Error(err),
+		)
+		return nil, "", 0, err
+	}
+	return order, model.Extend, order_model.OrderStatus(model.OrderStatus), nil
+}
+
+/*
+根据第三方支付订单id更新付费状态, 用于只有第三方支付订单id的支付回调
+
+	uid 用户唯一标识, 可以为空, 查找方式同 GetOrderByThirdPayOID
+*/
+func (o orderCli) UpdatePayStatusByThirdPayOID(ctx context.Context, thirdPayOid, uid string,
+	payStatus order_model.OrderPayStatus, remark string) error {
+	model, err := o.findByThirdPayOID(ctx, thirdPayOid, uid)
+	if err != nil {
+		return err
+	}
+	return o.UpdatePayStatus(ctx, model.OrderID, model.Uid, payStatus, remark)
+}
+
+// 根据第三方支付订单id查找订单数据
+func (o orderCli) findByThirdPayOID(ctx context.Context, thirdPayOid, uid string) (*dao.Model, error) {
+	if thirdPayOid == "" {
+		return nil, errors.New("orderApi findByThirdPayOID thirdPayOid is empty")
+	}
+
+	var model *dao.Model
+	var err error
+	if uid != "" {
+		model, err = dao.Dao(uid).GetOneByThirdPayOID(ctx, thirdPayOid)
+	} else {
+		model, err = o.findByThirdPayOIDWithoutUid(ctx, thirdPayOid)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, OrderNotFoundErr
+		}
+		logger.Log.Error(ctx, "orderApi findByThirdPayOID err",
+			zap.String("thirdPayOid", thirdPayOid),
+			zap.String("uid", uid),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+	return model, nil
+}
+
+// 不知道uid时先查映射表, 映射表中不存在时扫描所有分表, 用于映射表启用前创建的订单
+func (o orderCli) findByThirdPayOIDWithoutUid(ctx context.Context, thirdPayOid string) (*dao.Model, error) {
+	if conf.Conf.AllowThirdPayOIDMapping {
+		m, err := dao.GetThirdPayOIDMapping(ctx, thirdPayOid)
+		if err == nil {
+			model, err := dao.Dao(m.Uid).GetOne(ctx, m.OrderID)
+			if err != nil {
+				return nil, err
+			}
+			model.ThirdPayOrderID = thirdPayOid
+			return model, nil
+		}
+		if err != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+
+	for shard := uint32(0); shard < dao.ShardNums(); shard++ {
+		model, err := dao.DaoByShard(cast.ToString(shard)).GetOneByThirdPayOID(ctx, thirdPayOid)
+		if err == nil {
+			return model, nil
+		}
+		if err != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+	return nil, sql.ErrNoRows
+}
@@ -0,0 +1,16 @@
+package order
+
+import (
+	"context"
+	"testing"
+)
+
+func TestFindByThirdPayOIDEmpty(t *testing.T) {
+	ctx := context.Background()
+	if _, err := orderApi.findByThirdPayOID(ctx, "", "u1"); err == nil {
+		t.Error("findByThirdPayOID with empty thirdPayOid err = nil")
+	}
+	if err := orderApi.UpdatePayStatusByThirdPayOID(ctx, "", "", 1, ""); err == nil {
+		t.Error("UpdatePayStatusByThirdPayOID with empty thirdPayOid err = nil")
+	}
+}
@@ -92,6 +92,121 @@ func GetOrder(ctx context.Context, orderID, uid string) (
 	return sp.Order, sp.Extend, sp.Status, err
 }
 
+type gowuReq struct {
+	OrderID string
+}
+
+// 不传uid获取订单, 根据订单号中的分片查询, 订单号需要能被 ParseOID 解析
+func GetOrderWithoutUid(ctx context.Context, orderID string) (
+	*order_model.Order, string, order_model.OrderStatus, error) {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "GetOrderWithoutUid")
+	r := &gowuReq{
+		OrderID: orderID,
+	}
+	sp := &goRsp{}
+	err := chain.HandleInject(ctx, r, sp, func(ctx context.Context, req, rsp interface{}) error {
+		r := req.(*gowuReq)
+		sp := rsp.(*goRsp)
+		order, extend, status, err := orderApi.GetOrderWithoutUid(ctx, r.OrderID)
+		sp.Order = order
+		sp.Extend = extend
+		sp.Status = status
+		return err
+	})
+	return sp.Order, sp.Extend, sp.Status, err
+}
+
+type gobtReq struct {
+	ThirdPayOrderID string
+	UID             string `json:"UID,omitempty"`
+}
+
+/*
+根据第三方支付订单id获取订单
+
+	uid 用户唯一标识, 为空时先通过映射表(需要开启 AllowThirdPayOIDMapping)查找订单所在分表, 映射表中不存在时扫描所有分表
+*/
+func GetOrderByThirdPayOID(ctx context.Context, thirdPayOid, uid string) (
+	*order_model.Order, string, order_model.OrderStatus, error) {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "GetOrderByThirdPayOID")
+	r := &gobtReq{
+		ThirdPayOrderID: thirdPayOid,
+		UID:             uid,
+	}
+	sp := &goRsp{}
+	err := chain.HandleInject(ctx, r, sp, func(ctx context.Context, req, rsp interface{}) error {
+		r := req.(*gobtReq)
+		sp := rsp.(*goRsp)
+		order, extend, status, err := orderApi.GetOrderByThirdPayOID(ctx, r.ThirdPayOrderID, r.UID)
+		sp.Order = order
+		sp.Extend = extend
+		sp.Status = status
+		return err
+	})
+	return sp.Order, sp.Extend, sp.Status, err
+}
+
+type gohReq struct {
+	OrderID string
+	UID     string
+}
+type gohRsp struct {
+	Logs []*order_model.OrderLog `json:"Logs"`
+}
+
+// 获取订单变动流水, 按变动顺序排列
+func GetOrderHistory(ctx context.Context, orderID, uid string) ([]*order_model.OrderLog, error) {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "GetOrderHistory")
+	r := &gohReq{
+		OrderID: orderID,
+		UID:     uid,
+	}
+	sp := &gohRsp{}
+	err := chain.HandleInject(ctx, r, sp, func(ctx context.Context, req, rsp interface{}) error {
+		r := req.(*gohReq)
+		sp := rsp.(*gohRsp)
+		logs, err := orderApi.GetOrderHistory(ctx, r.OrderID, r.UID)
+		sp.Logs = logs
+		return err
+	})
+	return sp.Logs, err
+}
+
+type luoReq struct {
+	UID    string
+	Filter *order_model.UserOrderFilter `json:"Filter"`
+}
+type luoRsp struct {
+	Orders     []*order_model.UserOrder `json:"Orders"`
+	NextCursor uint                     `json:"NextCursor,omitempty"`
+}
+
+/*
+查询用户的订单, 按创建顺序从新到旧排列
+
+	f 查询条件, f.Limit 必须大于0
+
+返回下一页的游标, 为0表示没有更多数据了
+*/
+func ListUserOrders(ctx context.Context, uid string, f *order_model.UserOrderFilter) (
+	[]*order_model.UserOrder, uint, error) {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "ListUserOrders")
+	r := &luoReq{
+		UID:    uid,
+		Filter: f,
+	}
+	sp := &luoRsp{}
+	err := chain.HandleInject(ctx, r, sp, func(ctx context.Context, req, rsp interface{}) error {
+		r := req.(*luoReq)
+		sp := rsp.(*luoRsp)
+		orders, next, err := orderApi.ListUserOrders(ctx, r.UID, r.Filter)
+		sp.Orders = orders
+		sp.NextCursor = next
+		return err
+	})
+	return sp.Orders, sp.NextCursor, err
+}
+
 type fReq struct {
 	Order  *order_model.Order `json:"Order"`
 	Extend interface{}        `json:"Extend,omitempty"`
@@ -160,6 +275,29 @@ func ForwardOrderID(ctx context.Context, orderID, uid string) (
 	return sp.Order, sp.Status, err
 }
 
+type foidwuReq struct {
+	OrderID string
+}
+
+// 不传uid推进, 根据订单号中的分片查找订单, 订单号需要能被 ParseOID 解析
+func ForwardOrderIDWithoutUid(ctx context.Context, orderID string) (
+	*order_model.Order, order_model.OrderStatus, error) {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "ForwardOrderIDWithoutUid")
+	r := &foidwuReq{
+		OrderID: orderID,
+	}
+	sp := &foidRsp{}
+	err := chain.HandleInject(ctx, r, sp, func(ctx context.Context, req, rsp interface{}) error {
+		r := req.(*foidwuReq)
+		sp := rsp.(*foidRsp)
+		order, status, err := orderApi.ForwardOrderIDWithoutUid(ctx, r.OrderID)
+		sp.Order = order
+		sp.Status = status
+		return err
+	})
+	return sp.Order, sp.Status, err
+}
+
 type upsReq struct {
 	OrderID   string
 	UID       string
@@ -167,7 +305,7 @@ type upsReq struct {
 	Remark    string `json:"Remark,omitempty"`
 }
 
-// 更新付费状态
+// 更新付费状态, 订单已过期关闭时收到支付完成会全额退款并返回 OrderClosedErr
 func UpdatePayStatus(ctx context.Context, orderID, uid string, payStatus order_model.OrderPayStatus, remark string) error {
 	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "UpdatePayStatus")
 	r := &upsReq{
@@ -183,6 +321,148 @@ func UpdatePayStatus(ctx context.Context, orderID, uid string, payStatus order_m
 	return err
 }
 
+type upswuReq struct {
+	OrderID   string
+	PayStatus order_model.OrderPayStatus
+	Remark    string `json:"Remark,omitempty"`
+}
+
+// 不传uid更新付费状态, 根据订单号中的分片查找订单, 订单号需要能被 ParseOID 解析
+func UpdatePayStatusWithoutUid(ctx context.Context, orderID string, payStatus order_model.OrderPayStatus, remark string) error {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "UpdatePayStatusWithoutUid")
+	r := &upswuReq{
+		OrderID:   orderID,
+		PayStatus: payStatus,
+		Remark:    remark,
+	}
+	_, err := chain.Handle(ctx, r, func(ctx context.Context, req interface{}) (rsp interface{}, err error) {
+		r := req.(*upswuReq)
+		return nil, orderApi.UpdatePayStatusWithoutUid(ctx, r.OrderID, r.PayStatus, r.Remark)
+	})
+	return err
+}
+
+type upsbtReq struct {
+	ThirdPayOrderID string
+	UID             string `json:"UID,omitempty"`
+	PayStatus       order_model.OrderPayStatus
+	Remark          string `json:"Remark,omitempty"`
+}
+
+/*
+根据第三方支付订单id更新付费状态, 用于只有第三方支付订单id的支付回调
+
+	uid 用户唯一标识, 可以为空, 查找方式同 GetOrderByThirdPayOID
+*/
+func UpdatePayStatusByThirdPayOID(ctx context.Context, thirdPayOid, uid string, payStatus order_model.OrderPayStatus,
+	remark string) error {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "UpdatePayStatusByThirdPayOID")
+	r := &upsbtReq{
+		ThirdPayOrderID: thirdPayOid,
+		UID:             uid,
+		PayStatus:       payStatus,
+		Remark:          remark,
+	}
+	_, err := chain.Handle(ctx, r, func(ctx context.Context, req interface{}) (rsp interface{}, err error) {
+		r := req.(*upsbtReq)
+		return nil, orderApi.UpdatePayStatusByThirdPayOID(ctx, r.ThirdPayOrderID, r.UID, r.PayStatus, r.Remark)
+	})
+	return err
+}
+
+type uplsReq struct {
+	OrderID         string
+	UID             string
+	LegIndex        int
+	PayStatus       order_model.OrderPayStatus
+	ThirdPayOrderID string `json:"ThirdPayOrderID,omitempty"`
+	Remark          string `json:"Remark,omitempty"`
+}
+
+/*
+更新混合支付中一个支付项的付费状态, 一般用于第三方支付平台的付费回调
+
+	legIndex 支付项索引
+	thirdPayOrderID 第三方支付订单id, 为空时不会更新
+*/
+func UpdatePayLegStatus(ctx context.Context, orderID, uid string, legIndex int,
+	payStatus order_model.OrderPayStatus, thirdPayOrderID, remark string) error {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "UpdatePayLegStatus")
+	r := &uplsReq{
+		OrderID:         orderID,
+		UID:             uid,
+		LegIndex:        legIndex,
+		PayStatus:       payStatus,
+		ThirdPayOrderID: thirdPayOrderID,
+		Remark:          remark,
+	}
+	_, err := chain.Handle(ctx, r, func(ctx context.Context, req interface{}) (rsp interface{}, err error) {
+		r := req.(*uplsReq)
+		return nil, orderApi.UpdatePayLegStatus(ctx, r.OrderID, r.UID, r.LegIndex, r.PayStatus, r.ThirdPayOrderID, r.Remark)
+	})
+	return err
+}
+
+type roReq struct {
+	OrderID string
+	UID     string
+	Amount  uint32
+	Reason  string `json:"Reason,omitempty"`
+}
+
+/*
+订单退款, 支持多次部分退款
+
+	amount 退款金额, 单位分, 为0表示退回所有可退款金额
+	reason 退款原因
+
+会先通过支付提供者退款, 记录退款后如果业务层实现了 order_model.OrderRefunder 会调用 RefundCallback 撤回已交付的内容.
+全额退款后订单状态会变为 OrderStatus_ReturnedBalance, 订单状态机不允许时返回 OrderStatusTransitionErr 且不会退款.
+*/
+func RefundOrder(ctx context.Context, orderID, uid string, amount uint32, reason string) error {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "RefundOrder")
+	r := &roReq{
+		OrderID: orderID,
+		UID:     uid,
+		Amount:  amount,
+		Reason:  reason,
+	}
+	_, err := chain.Handle(ctx, r, func(ctx context.Context, req interface{}) (rsp interface{}, err error) {
+		r := req.(*roReq)
+		return nil, orderApi.RefundOrder(ctx, r.OrderID, r.UID, r.Amount, r.Reason)
+	})
+	return err
+}
+
+type cancelReq struct {
+	OrderID string
+	UID     string
+	Reason  string `json:"Reason,omitempty"`
+}
+
+/*
+用户主动取消订单
+
+	reason 取消原因, 会记录到备注中
+
+终态订单不能取消, 返回 OrderTerminalErr. 业务层实现了 order_model.OrderCanceler 时会先调用 CancelCallback, 返回err时不会取消订单.
+订单状态变为 OrderStatus_BusinessCancelForward 后如果已支付会全额退款, 这次退款不会再调用 RefundCallback.
+退款失败时订单仍为已取消状态, 可以调用 RefundOrder 重试退款.
+*/
+func CancelOrder(ctx context.Context, orderID, uid, reason string) error {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "CancelOrder")
+	r := &cancelReq{
+		OrderID: orderID,
+		UID:     uid,
+		Reason:  reason,
+	}
+	_, err := chain.Handle(ctx, r, func(ctx context.Context, req interface{}) (rsp interface{}, err error) {
+		r := req.(*cancelReq)
+		return nil, orderApi.CancelOrder(ctx, r.OrderID, r.UID, r.Reason)
+	})
+	return err
+}
+
 type uosReq struct {
 	OrderID string
 	UID     string
@@ -209,6 +489,38 @@ func UpdateOrderStatus(ctx context.Context, orderID, uid string, extend interfac
 	return err
 }
 
+type cauosReq struct {
+	OrderID string
+	UID     string
+	Extend  interface{} `json:"Extend,omitempty"`
+	Status  order_model.OrderStatus
+	Remark  string `json:"Remark,omitempty"`
+	Expect  order_model.UpdateExpect
+}
+
+/*
+满足乐观锁条件时才更新订单状态和扩展数据
+
+	expect 乐观锁条件, 不满足时返回 OrderVersionConflictErr
+*/
+func CompareAndUpdateOrderStatus(ctx context.Context, orderID, uid string, extend interface{},
+	status order_model.OrderStatus, remark string, expect order_model.UpdateExpect) error {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "CompareAndUpdateOrderStatus")
+	r := &cauosReq{
+		OrderID: orderID,
+		UID:     uid,
+		Extend:  extend,
+		Status:  status,
+		Remark:  remark,
+		Expect:  expect,
+	}
+	_, err := chain.Handle(ctx, r, func(ctx context.Context, req interface{}) (rsp interface{}, err error) {
+		r := req.(*cauosReq)
+		return nil, orderApi.CompareAndUpdateOrderStatus(ctx, r.OrderID, r.UID, r.Extend, r.Status, r.Remark, r.Expect)
+	})
+	return err
+}
+
 type genOIDReq struct {
 	OrderType   order_model.OrderType
 	UID         string
@@ -274,3 +586,130 @@ func GenOID(ctx context.Context, orderType order_model.OrderType, uid string) (s
 	})
 	return sp.OrderID, err
 }
+
+type luaoReq struct {
+	Cursor order_model.ShardCursor
+	Limit  int
+}
+type luaoRsp struct {
+	Orders     []*order_model.OrderDetail `json:"Orders"`
+	NextCursor *order_model.ShardCursor   `json:"NextCursor,omitempty"`
+}
+
+/*
+跨分片查询需要人工介入的订单
+
+	cursor 分页游标, 零值表示从头开始
+	limit 最多返回多少条数据
+
+返回下一页的游标, 为nil表示没有更多数据了
+*/
+func ListUnableToAdvanceOrders(ctx context.Context, cursor order_model.ShardCursor, limit int) (
+	[]*order_model.OrderDetail, *order_model.ShardCursor, error) {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "ListUnableToAdvanceOrders")
+	r := &luaoReq{
+		Cursor: cursor,
+		Limit:  limit,
+	}
+	sp := &luaoRsp{}
+	err := chain.HandleInject(ctx, r, sp, func(ctx context.Context, req, rsp interface{}) error {
+		r := req.(*luaoReq)
+		sp := rsp.(*luaoRsp)
+		orders, next, err := orderApi.ListUnableToAdvanceOrders(ctx, r.Cursor, r.Limit)
+		sp.Orders = orders
+		sp.NextCursor = next
+		return err
+	})
+	return sp.Orders, sp.NextCursor, err
+}
+
+type forceReq struct {
+	OrderID  string
+	UID      string
+	Operator string
+	Remark   string `json:"Remark,omitempty"`
+}
+
+/*
+人工重试需要人工介入的订单, 订单会重新转为推进中状态并立即推进
+
+	operator 操作人, 会记录到备注中
+*/
+func ForceRetry(ctx context.Context, orderID, uid, operator string) (
+	*order_model.Order, order_model.OrderStatus, error) {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "ForceRetry")
+	r := &forceReq{
+		OrderID:  orderID,
+		UID:      uid,
+		Operator: operator,
+	}
+	sp := &foidRsp{}
+	err := chain.HandleInject(ctx, r, sp, func(ctx context.Context, req, rsp interface{}) error {
+		r := req.(*forceReq)
+		sp := rsp.(*foidRsp)
+		order, status, err := orderApi.ForceRetry(ctx, r.OrderID, r.UID, r.Operator)
+		sp.Order = order
+		sp.Status = status
+		return err
+	})
+	return sp.Order, sp.Status, err
+}
+
+/*
+人工完成需要人工介入的订单, 一般用于人工补发后结束订单, 会调用业务层的 ForwardFinishCallback
+
+	operator 操作人, 会记录到备注中
+*/
+func ForceFinish(ctx context.Context, orderID, uid, operator, remark string) error {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "ForceFinish")
+	r := &forceReq{
+		OrderID:  orderID,
+		UID:      uid,
+		Operator: operator,
+		Remark:   remark,
+	}
+	_, err := chain.Handle(ctx, r, func(ctx context.Context, req interface{}) (rsp interface{}, err error) {
+		r := req.(*forceReq)
+		return nil, orderApi.ForceFinish(ctx, r.OrderID, r.UID, r.Operator, r.Remark)
+	})
+	return err
+}
+
+/*
+人工取消需要人工介入的订单, 会调用业务层的 ForwardAbnormalCallback. 不会自动退款, 如有需要请调用 RefundOrder
+
+	operator 操作人, 会记录到备注中
+*/
+func ForceCancel(ctx context.Context, orderID, uid, operator, remark string) error {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "ForceCancel")
+	r := &forceReq{
+		OrderID:  orderID,
+		UID:      uid,
+		Operator: operator,
+		Remark:   remark,
+	}
+	_, err := chain.Handle(ctx, r, func(ctx context.Context, req interface{}) (rsp interface{}, err error) {
+		r := req.(*forceReq)
+		return nil, orderApi.ForceCancel(ctx, r.OrderID, r.UID, r.Operator, r.Remark)
+	})
+	return err
+}
+
+type gmpReq struct{}
+type gmpRsp struct {
+	Progress []*order_model.MigrateProgress `json:"Progress"`
+}
+
+// 获取扩容迁移复制存量数据的进度, 所有分片都复制完成后可以进入 cutover 阶段
+func GetMigrateProgress(ctx context.Context) ([]*order_model.MigrateProgress, error) {
+	ctx, chain := filter.GetClientFilter(ctx, clientType, clientName, "GetMigrateProgress")
+	r := &gmpReq{}
+	sp := &gmpRsp{}
+	err := chain.HandleInject(ctx, r, sp, func(ctx context.Context, req, rsp interface{}) error {
+		sp := rsp.(*gmpRsp)
+		progress, err := orderApi.GetMigrateProgress(ctx)
+		sp.Progress = progress
+		return err
+	})
+	return sp.Progress, err
+}
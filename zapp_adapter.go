@@ -6,6 +6,7 @@ import (
 	"github.com/zly-app/zapp/core"
 
 	"github.com/zlyuancn/order/conf"
+	"github.com/zlyuancn/order/mq"
 )
 
 func WithService() zapp.Option {
@@ -17,6 +18,10 @@ func WithService() zapp.Option {
 		switch conf.Conf.MQType {
 		case conf.MQType_Pulsar:
 			return addService(services, pulsar_consume.DefaultServiceType)
+		case conf.MQType_Kafka:
+			return addService(services, mq.KafkaConsumeServiceType)
+		case conf.MQType_Redis:
+			return addService(services, mq.RedisConsumeServiceType)
 		}
 		return services
 	})